@@ -0,0 +1,98 @@
+// Package config reads and writes the client settings file, ~/.rosewire_client.
+//
+// The first two lines are the nickname and the public key path used to log
+// in. Any further lines are "key value" settings:
+//
+//	ignore <nickname>      hide a user's chat and refuse their downloads
+//	sync-ignore off        keep the ignore list to this client only
+package config
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+const fileName = ".rosewire_client"
+
+// Config is the client's saved settings.
+type Config struct {
+	Nickname string
+	KeyPath  string
+	Ignored  []string
+	// SyncIgnore sends the ignore list to the relay so it stops routing
+	// ignored users' messages to us.
+	SyncIgnore bool
+}
+
+// Path returns where the settings file lives.
+func Path() (string, error) {
+	usr, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(usr.HomeDir, fileName), nil
+}
+
+// Load reads the settings file. A missing file gives defaults and an error
+// satisfying os.IsNotExist.
+func Load() (Config, error) {
+	cfg := Config{SyncIgnore: true}
+	path, err := Path()
+	if err != nil {
+		return cfg, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return cfg, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 0; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case n == 0:
+			cfg.Nickname = line
+		case n == 1:
+			cfg.KeyPath = line
+		case line == "":
+		default:
+			key, value, _ := strings.Cut(line, " ")
+			value = strings.TrimSpace(value)
+			switch key {
+			case "ignore":
+				if value != "" {
+					cfg.Ignored = append(cfg.Ignored, value)
+				}
+			case "sync-ignore":
+				cfg.SyncIgnore = value != "off"
+			}
+		}
+	}
+	return cfg, scanner.Err()
+}
+
+// Save writes the settings file.
+func (cfg Config) Save() error {
+	if cfg.Nickname == "" || cfg.KeyPath == "" {
+		return errors.New("config missing nickname/key")
+	}
+	path, err := Path()
+	if err != nil {
+		return err
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n%s\n", cfg.Nickname, cfg.KeyPath)
+	for _, nick := range cfg.Ignored {
+		fmt.Fprintf(&b, "ignore %s\n", nick)
+	}
+	if !cfg.SyncIgnore {
+		b.WriteString("sync-ignore off\n")
+	}
+	return os.WriteFile(path, []byte(b.String()), 0600)
+}
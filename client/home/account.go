@@ -0,0 +1,44 @@
+package home
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// handleAddKeyCommand lets /addkey take the path of a .pub file, which is
+// read here and its key sent to the relay. A key pasted inline is left for
+// the relay's own /addkey. It reports whether text was handled.
+func (m Model) handleAddKeyCommand(text string) (Model, tea.Cmd, bool) {
+	fields := strings.Fields(text)
+	if len(fields) != 2 || fields[0] != "/addkey" {
+		return m, nil, false
+	}
+	path := fields[1]
+	if rest, ok := strings.CutPrefix(path, "~/"); ok {
+		if home, err := os.UserHomeDir(); err == nil {
+			path = filepath.Join(home, rest)
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		m = m.appendToRoom(m.activeRoomName(), logEntry{Time: "[ERR]", Message: "Cannot read key: " + err.Error()})
+		return m, nil, true
+	}
+	return m, addKeyCmd(m.chatClient, string(data)), true
+}
+
+// addKeyCmd asks the relay to let another key log in as us.
+func addKeyCmd(c *ChatClient, publicKey string) tea.Cmd {
+	return func() tea.Msg {
+		if c == nil {
+			return nil
+		}
+		if err := c.Send("add_key", addKeyPayload{PublicKey: strings.TrimSpace(publicKey)}); err != nil {
+			return logEntry{Time: "[ERR]", Message: "Could not add key: " + err.Error()}
+		}
+		return nil
+	}
+}
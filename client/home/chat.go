@@ -2,30 +2,97 @@ package home
 
 import (
 	"bufio"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"os"
+	"math/rand"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"rosewire/hostkeys"
+	"rosewire/sshkey"
+
 	"golang.org/x/crypto/ssh"
 )
 
-// ChatClient manages the SSH session for chat.
-type ChatClient struct {
-	Nickname   string
-	KeyPath    string
-	ServerAddr string
+// Keepalive defaults. The relay pings us too; these catch a relay that
+// has vanished without closing the connection.
+const (
+	defaultPingInterval = 20 * time.Second
+	defaultPingTimeout  = 60 * time.Second
+)
+
+// Reconnect backoff: the first retry waits minBackoff, each failure doubles
+// the wait up to maxBackoff, and a random jitter of up to a quarter is added
+// so clients dropped together do not return together.
+const (
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+)
+
+var errNotConnected = errors.New("not connected")
+
+// ConnState is where the client is in its connection lifecycle.
+type ConnState int
 
+const (
+	StateConnecting ConnState = iota
+	StateConnected
+	StateReconnecting // waiting to retry
+	StateFailed       // gave up; see isFatal
+)
+
+// connStateMsg reports a connection state change to the TUI.
+type connStateMsg struct {
+	State   ConnState
+	Attempt int           // connection attempts since the last success
+	Retry   time.Duration // wait before the next attempt, when reconnecting
+	Err     error
+}
+
+// link is one SSH session to the relay. The client makes a new one every
+// time it reconnects.
+type link struct {
 	sshClient *ssh.Client
 	session   *ssh.Session
 	stdin     io.WriteCloser
 	stdout    io.Reader
+	lastHeard atomic.Int64 // UnixNano
+	down      chan struct{}
+	once      sync.Once
+}
+
+func (l *link) close() {
+	l.once.Do(func() {
+		close(l.down)
+		l.session.Close()
+		l.sshClient.Close()
+	})
+}
+
+// ChatClient manages the SSH session for chat. Run keeps it connected,
+// reconnecting with backoff whenever the session drops; Incoming carries
+// lines from every session in turn.
+type ChatClient struct {
+	Nickname   string
+	KeyPath    string
+	ServerAddr string
+
+	// PingInterval is how often we ping the relay, and PingTimeout how long
+	// it may stay silent before we give up on the connection.
+	PingInterval time.Duration
+	PingTimeout  time.Duration
+
+	mu   sync.Mutex
+	link *link // nil while disconnected
 
 	Incoming chan string
 	Outgoing chan string
-	Done     chan struct{}
+	States   chan connStateMsg
+	Done     chan struct{} // closed by Close, after which Run stops
 
 	once sync.Once
 }
@@ -35,93 +102,269 @@ func NewChatClient(nickname, keyPath, serverAddr string) *ChatClient {
 		Nickname:   nickname,
 		KeyPath:    keyPath,
 		ServerAddr: serverAddr,
-		Incoming:   make(chan string, 64),
-		Outgoing:   make(chan string, 8),
-		Done:       make(chan struct{}),
+
+		PingInterval: defaultPingInterval,
+		PingTimeout:  defaultPingTimeout,
+
+		Incoming: make(chan string, 64),
+		Outgoing: make(chan string, 8),
+		States:   make(chan connStateMsg, 8),
+		Done:     make(chan struct{}),
 	}
 }
 
-// Connect establishes the SSH "chat" session.
-func (c *ChatClient) Connect() error {
-	priv := strings.TrimSuffix(c.KeyPath, ".pub")
-	key, err := os.ReadFile(priv)
+// Run connects to the relay and reconnects whenever the connection is
+// lost, until Close is called or a fatal error (see isFatal) stops it.
+func (c *ChatClient) Run() {
+	backoff := minBackoff
+	attempt := 0
+	for {
+		attempt++
+		c.setState(connStateMsg{State: StateConnecting, Attempt: attempt})
+		l, err := c.connect()
+		if err == nil {
+			attempt, backoff = 0, minBackoff
+			c.setState(connStateMsg{State: StateConnected})
+			select {
+			case <-l.down:
+				err = errors.New("connection lost")
+			case <-c.Done:
+				return
+			}
+		} else if isFatal(err) {
+			c.setState(connStateMsg{State: StateFailed, Attempt: attempt, Err: err})
+			return
+		}
+
+		wait := backoff + time.Duration(rand.Int63n(int64(backoff/4)+1))
+		c.setState(connStateMsg{State: StateReconnecting, Attempt: attempt, Retry: wait, Err: err})
+		select {
+		case <-time.After(wait):
+		case <-c.Done:
+			return
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// isFatal reports whether err means retrying will not help: the relay
+// rejected our key, or we cannot vouch for the relay's.
+func isFatal(err error) bool {
+	var unknown *hostkeys.UnknownHostError
+	var changed *hostkeys.ChangedHostError
+	return errors.As(err, &unknown) || errors.As(err, &changed) ||
+		strings.Contains(err.Error(), "unable to authenticate")
+}
+
+// setState publishes a state change, waiting for the TUI to take it if the
+// buffer is full. None may be lost: the TUI restores the session when it
+// sees StateConnected, and marks downloads interrupted when it sees the
+// connection go. It listens for as long as Run goes on, so the wait ends
+// unless the client is closed.
+func (c *ChatClient) setState(s connStateMsg) {
+	select {
+	case c.States <- s:
+	case <-c.Done:
+	}
+}
+
+// Connected reports whether there is a live session to the relay.
+func (c *ChatClient) Connected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.link != nil
+}
+
+// connect establishes one SSH "chat" session and starts its loops.
+func (c *ChatClient) connect() (*link, error) {
+	signers, err := sshkey.Signers(c.KeyPath)
+	if err != nil {
+		return nil, err
+	}
+	// Login pinned the relay's key, so an unknown key is as bad as a changed one
+	hostKeyCallback, err := hostkeys.Callback()
 	if err != nil {
-		return fmt.Errorf("read key: %w", err)
+		return nil, fmt.Errorf("known hosts: %w", err)
 	}
-	signer, err := ssh.ParsePrivateKey(key)
+	hostKeyAlgorithms, err := hostkeys.Algorithms(c.ServerAddr)
 	if err != nil {
-		return fmt.Errorf("parse key: %w", err)
+		return nil, fmt.Errorf("known hosts: %w", err)
 	}
 	config := &ssh.ClientConfig{
-		User: c.Nickname,
-		Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Timeout: 4 * time.Second,
+		User:              c.Nickname,
+		Auth:              []ssh.AuthMethod{ssh.PublicKeys(signers...)},
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: hostKeyAlgorithms,
+		Timeout:           4 * time.Second,
+	}
+	// The relay explains refusals in a banner
+	var banner string
+	config.BannerCallback = func(message string) error {
+		banner = strings.TrimSpace(message)
+		return nil
 	}
 
 	client, err := ssh.Dial("tcp", c.ServerAddr, config)
 	if err != nil {
-		return fmt.Errorf("ssh dial: %w", err)
+		if banner != "" {
+			return nil, fmt.Errorf("%s (ssh dial: %w)", banner, err)
+		}
+		return nil, fmt.Errorf("ssh dial: %w", err)
 	}
-	c.sshClient = client
 	session, err := client.NewSession()
 	if err != nil {
 		client.Close()
-		return fmt.Errorf("session: %w", err)
+		return nil, fmt.Errorf("session: %w", err)
 	}
 	stdin, err := session.StdinPipe()
 	if err != nil {
 		client.Close()
-		return fmt.Errorf("stdin: %w", err)
+		return nil, fmt.Errorf("stdin: %w", err)
 	}
 	stdout, err := session.StdoutPipe()
 	if err != nil {
 		client.Close()
-		return fmt.Errorf("stdout: %w", err)
+		return nil, fmt.Errorf("stdout: %w", err)
 	}
 
 	// Start a "chat" subsystem (you must implement this on the server side)
 	if err := session.RequestSubsystem("chat"); err != nil {
 		client.Close()
-		return fmt.Errorf("request subsystem: %w", err)
+		return nil, fmt.Errorf("request subsystem: %w", err)
 	}
 
-	c.session = session
-	c.stdin = stdin
-	c.stdout = stdout
+	l := &link{
+		sshClient: client,
+		session:   session,
+		stdin:     stdin,
+		stdout:    stdout,
+		down:      make(chan struct{}),
+	}
+	l.lastHeard.Store(time.Now().UnixNano())
 
-	go c.readLoop()
-	go c.writeLoop()
+	c.mu.Lock()
+	select {
+	case <-c.Done:
+		// Closed while we were dialing
+		c.mu.Unlock()
+		l.close()
+		return nil, errNotConnected
+	default:
+	}
+	c.link = l
+	c.mu.Unlock()
 
-	return nil
+	// Anything queued for the previous session is stale
+	for len(c.Outgoing) > 0 {
+		<-c.Outgoing
+	}
+	go c.readLoop(l)
+	go c.writeLoop(l)
+	go c.keepaliveLoop(l)
+	return l, nil
 }
 
-func (c *ChatClient) readLoop() {
-	scanner := bufio.NewScanner(c.stdout)
+// drop ends a session, leaving Run to reconnect.
+func (c *ChatClient) drop(l *link) {
+	c.mu.Lock()
+	if c.link == l {
+		c.link = nil
+	}
+	c.mu.Unlock()
+	l.close()
+}
+
+func (c *ChatClient) readLoop(l *link) {
+	scanner := bufio.NewScanner(l.stdout)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
 	for scanner.Scan() {
+		l.lastHeard.Store(time.Now().UnixNano())
+		line := scanner.Text()
+		// Answer keepalives here so they never reach the UI
+		var msg inboundMessage
+		if json.Unmarshal([]byte(line), &msg) == nil {
+			switch msg.Type {
+			case "ping":
+				c.Send("pong", msg.Payload)
+				continue
+			case "pong":
+				continue
+			}
+		}
 		select {
-		case c.Incoming <- scanner.Text():
-		case <-c.Done:
+		case c.Incoming <- line:
+		case <-l.down:
+			return
+		}
+	}
+	c.drop(l)
+}
+
+// keepaliveLoop pings the relay over the chat session and with SSH
+// keepalive requests, and drops the session once the relay has been silent
+// for longer than PingTimeout.
+func (c *ChatClient) keepaliveLoop(l *link) {
+	if c.PingInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(c.PingInterval)
+	defer ticker.Stop()
+	var seq uint64
+	for {
+		select {
+		case <-ticker.C:
+			if c.PingTimeout > 0 && time.Since(time.Unix(0, l.lastHeard.Load())) > c.PingTimeout {
+				c.drop(l)
+				return
+			}
+			seq++
+			c.Send("ping", pingPayload{Seq: seq})
+			go func() {
+				// Any reply, even a refusal, shows the relay is alive
+				if _, _, err := l.sshClient.SendRequest("keepalive@openssh.com", true, nil); err == nil {
+					l.lastHeard.Store(time.Now().UnixNano())
+				}
+			}()
+		case <-l.down:
 			return
 		}
 	}
-	c.Close()
 }
 
-func (c *ChatClient) writeLoop() {
+func (c *ChatClient) writeLoop(l *link) {
 	for {
 		select {
 		case msg := <-c.Outgoing:
-			fmt.Fprintln(c.stdin, msg)
-		case <-c.Done:
+			if _, err := fmt.Fprintln(l.stdin, msg); err != nil {
+				c.drop(l)
+				return
+			}
+		case <-l.down:
 			return
 		}
 	}
 }
 
-func (c *ChatClient) Send(msg string) {
-	if msg = strings.TrimSpace(msg); msg != "" {
-		c.Outgoing <- msg
+// Send queues a typed JSON message for the server. It fails while we are
+// disconnected rather than hold the message for a later session.
+func (c *ChatClient) Send(msgType string, payload interface{}) error {
+	line, err := json.Marshal(outboundMessage{Type: msgType, Payload: payload})
+	if err != nil {
+		return fmt.Errorf("marshal %s: %w", msgType, err)
+	}
+	c.mu.Lock()
+	l := c.link
+	c.mu.Unlock()
+	if l == nil {
+		return errNotConnected
+	}
+	select {
+	case c.Outgoing <- string(line):
+		return nil
+	case <-l.down:
+		return errNotConnected
 	}
 }
 
@@ -129,42 +372,46 @@ func (c *ChatClient) Receive() <-chan string {
 	return c.Incoming
 }
 
+// Close disconnects for good.
 func (c *ChatClient) Close() {
 	c.once.Do(func() {
+		c.mu.Lock()
 		close(c.Done)
-		if c.session != nil {
-			c.session.Close()
-		}
-		if c.sshClient != nil {
-			c.sshClient.Close()
+		l := c.link
+		c.link = nil
+		c.mu.Unlock()
+		if l != nil {
+			l.close()
 		}
 	})
 }
 
 // ChatLogEntry represents a single chat message for the UI.
 type ChatLogEntry struct {
-	Time    string
+	ID      uint64    // server-assigned, 0 for local lines
+	At      time.Time // when it was said
+	Time    string    // At in local time, for display
+	Room    string
 	Sender  string
 	Message string
+	Action  bool // sent with /me
 }
 
-// ParseChatLine parses "[14:35] alice: hello" or just "alice: hi"
-func ParseChatLine(line string) ChatLogEntry {
-	ts := time.Now().Format("[15:04]")
-	sender := "???"
-	msg := line
-	if i := strings.Index(line, "] "); i > 0 {
-		ts = line[:i+1]
-		rest := line[i+2:]
-		if j := strings.Index(rest, ": "); j > 0 {
-			sender = rest[:j]
-			msg = rest[j+2:]
-		} else {
-			msg = rest
-		}
-	} else if j := strings.Index(line, ": "); j > 0 {
-		sender = line[:j]
-		msg = line[j+2:]
+// daySeparator returns a divider to draw before cur when it falls on a
+// different local day than prev, or "" if it does not.
+func daySeparator(prev, cur time.Time, width int) string {
+	if cur.IsZero() {
+		return ""
+	}
+	py, pm, pd := prev.Local().Date()
+	cy, cm, cd := cur.Local().Date()
+	if !prev.IsZero() && py == cy && pm == cm && pd == cd {
+		return ""
 	}
-	return ChatLogEntry{Time: ts, Sender: sender, Message: msg}
-}
\ No newline at end of file
+	label := " " + cur.Local().Format("Monday, 2 January 2006") + " "
+	pad := (width - len(label)) / 2
+	if pad < 3 {
+		pad = 3
+	}
+	return normalStyle.Render(strings.Repeat("─", pad) + label + strings.Repeat("─", pad))
+}
@@ -0,0 +1,72 @@
+package home
+
+import (
+	"sort"
+	"strings"
+)
+
+// commandListMsg is the set of slash commands the server lets us use.
+type commandListMsg []commandInfo
+
+// completion remembers the matches for the word being tab-completed so that
+// pressing Tab again cycles through them.
+type completion struct {
+	base    string // input before the word being completed
+	matches []string
+	index   int
+}
+
+// completionCandidates returns the words that could complete word. The first
+// word of a line starting with '/' completes commands, anything else
+// completes nicknames.
+func (m Model) completionCandidates(word string, first bool) []string {
+	var pool []string
+	if first && strings.HasPrefix(word, "/") {
+		for _, c := range m.commands {
+			pool = append(pool, "/"+c.Name)
+		}
+	} else {
+		for _, p := range m.Peers {
+			pool = append(pool, p.Name)
+		}
+	}
+	var matches []string
+	lower := strings.ToLower(word)
+	for _, c := range pool {
+		if strings.HasPrefix(strings.ToLower(c), lower) {
+			matches = append(matches, c)
+		}
+	}
+	sort.Strings(matches)
+	return matches
+}
+
+// completeChatInput completes the last word of the chat input, cycling
+// through the candidates on repeated presses.
+func (m Model) completeChatInput() Model {
+	if m.tabCompletion != nil {
+		c := m.tabCompletion
+		c.index = (c.index + 1) % len(c.matches)
+		m.chatInput = c.base + c.matches[c.index] + " "
+		return m
+	}
+
+	cut := strings.LastIndex(m.chatInput, " ") + 1
+	base, word := m.chatInput[:cut], m.chatInput[cut:]
+	if word == "" {
+		return m
+	}
+	matches := m.completionCandidates(word, strings.TrimSpace(base) == "")
+	switch len(matches) {
+	case 0:
+		return m
+	case 1:
+		m.chatInput = base + matches[0] + " "
+		return m
+	}
+	// Several matches: the first Tab shows the first of them; further
+	// presses cycle
+	m.tabCompletion = &completion{base: base, matches: matches}
+	m.chatInput = base + matches[0] + " "
+	return m
+}
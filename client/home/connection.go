@@ -0,0 +1,112 @@
+package home
+
+import (
+	"fmt"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+var (
+	connectedStyle    = lipgloss.NewStyle().Foreground(lipgloss.Color("#a6e3a1"))
+	reconnectingStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("#f9e2af"))
+	failedStyle       = lipgloss.NewStyle().Foreground(lipgloss.Color("#f38ba8"))
+)
+
+// connTickMsg redraws the reconnect countdown.
+type connTickMsg struct{}
+
+func connTickCmd() tea.Cmd {
+	return tea.Tick(time.Second, func(time.Time) tea.Msg { return connTickMsg{} })
+}
+
+// connStateListener waits for the chat client's next connection state.
+func connStateListener(c *ChatClient) tea.Cmd {
+	return func() tea.Msg {
+		select {
+		case s := <-c.States:
+			return s
+		case <-c.Done:
+			return nil
+		}
+	}
+}
+
+// applyConnState tracks the connection and, once we are back after losing
+// it, restores what the relay forgot: our shares, ignore list, status,
+// rooms and downloads.
+func (m Model) applyConnState(msg connStateMsg) (Model, tea.Cmd) {
+	prev := m.conn
+	m.conn = msg
+	if msg.State == StateReconnecting {
+		m.retryAt = time.Now().Add(msg.Retry)
+	}
+
+	switch msg.State {
+	case StateConnected:
+		cmds := []tea.Cmd{connStateListener(m.chatClient)}
+		if m.sharesScanned {
+			cmds = append(cmds, NotifyServerOfSharedFilesCmd(m.chatClient, m.SharedFiles))
+		}
+		if m.syncIgnore && len(m.ignored) > 0 {
+			cmds = append(cmds, SyncIgnoreListCmd(m.chatClient, m.ignoredNames()))
+		}
+		if !m.wasConnected {
+			m.wasConnected = true
+			m = m.appendToRoom(lobbyRoom, logEntry{Time: "[SYS]", Message: "Connected to the relay."})
+			return m, tea.Batch(cmds...)
+		}
+
+		m = m.appendToRoom(lobbyRoom, logEntry{Time: "[SYS]", Message: "Reconnected to the relay."})
+		// The relay's presence list may already have reset our status, so
+		// use the one we had when the connection dropped
+		if saved := m.savedStatus; saved != nil && (saved[0] != "online" || saved[1] != "") {
+			cmds = append(cmds, SetStatusCmd(m.chatClient, saved[0], saved[1]))
+		}
+		m.savedStatus = nil
+		for _, r := range m.Rooms[1:] {
+			m.rejoining[r.Name] = true
+			cmds = append(cmds, JoinRoomCmd(m.chatClient, r.Name))
+		}
+		cmds = append(cmds, m.resumeDownloadsCmd())
+		return m, tea.Batch(cmds...)
+
+	case StateReconnecting:
+		if prev.State == StateConnected {
+			m.savedStatus = &[2]string{m.Status, m.StatusMessage}
+			m.interruptDownloads()
+			m = m.appendToRoom(m.activeRoomName(), logEntry{Time: "[ERR]", Message: fmt.Sprintf("Lost connection to the relay, reconnecting in %s.", msg.Retry.Round(time.Second))})
+		} else if msg.Attempt == 1 && !m.wasConnected {
+			m = m.appendToRoom(lobbyRoom, logEntry{Time: "[ERR]", Message: fmt.Sprintf("Cannot reach the relay (%v), retrying.", msg.Err)})
+		}
+		return m, tea.Batch(connStateListener(m.chatClient), connTickCmd())
+
+	case StateFailed:
+		m.interruptDownloads()
+		m = m.appendToRoom(m.activeRoomName(), logEntry{Time: "[ERR]", Message: fmt.Sprintf("Disconnected for good: %v", msg.Err)})
+		return m, nil
+	}
+	return m, connStateListener(m.chatClient)
+}
+
+// renderConnState is the connection indicator shown in the header.
+func renderConnState(m Model) string {
+	switch m.conn.State {
+	case StateConnected:
+		return connectedStyle.Render("● online")
+	case StateReconnecting:
+		wait := time.Until(m.retryAt).Round(time.Second)
+		if wait < 0 {
+			wait = 0
+		}
+		return reconnectingStyle.Render(fmt.Sprintf("◌ offline, retry in %s", wait))
+	case StateFailed:
+		return failedStyle.Render("✕ disconnected")
+	default:
+		if m.conn.Attempt > 1 {
+			return reconnectingStyle.Render(fmt.Sprintf("◌ connecting (attempt %d)", m.conn.Attempt))
+		}
+		return reconnectingStyle.Render("◌ connecting")
+	}
+}
@@ -3,7 +3,11 @@ package home
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
@@ -57,6 +61,282 @@ func scanDownloads() ([]download, error) {
 	return downloads, nil
 }
 
+// activeDownload is a file being received. The data streams write their
+// ranges straight into a ".part" file, which is renamed once every range is
+// full. A download cut off by a lost connection is kept, Interrupted, and
+// asked for again from the end of the data it has without gaps once we are
+// back.
+type activeDownload struct {
+	TransferID  string
+	FileName    string
+	remoteName  string // as the peer shares it
+	Peer        string
+	Size        int64
+	Interrupted bool
+	file        *os.File
+
+	// This attempt: the ranges it was split into and how much of each
+	// has arrived
+	ranges   []streamRange
+	got      []atomic.Int64
+	stop     chan struct{} // closed to abandon the streams
+	finished chan struct{} // closed once they have all ended
+
+	// Counts the resumes scheduled, so only the latest one goes out
+	resumeSeq int
+}
+
+// start sets d up to receive [offset, Size) as transfer id.
+func (d *activeDownload) start(id string, offset int64) {
+	d.TransferID = id
+	d.ranges = transferRanges(offset, d.Size)
+	d.got = make([]atomic.Int64, len(d.ranges))
+	d.stop = make(chan struct{})
+	d.finished = make(chan struct{})
+}
+
+// received is how many bytes of the file we have.
+func (d *activeDownload) received() int64 {
+	n := d.ranges[0].Start
+	for i := range d.got {
+		n += d.got[i].Load()
+	}
+	return n
+}
+
+// resumeOffset is where the file stops being complete: the end of the
+// first range still missing data.
+func (d *activeDownload) resumeOffset() int64 {
+	for i, r := range d.ranges {
+		if got := d.got[i].Load(); r.Start+got < r.End {
+			return r.Start + got
+		}
+	}
+	return d.Size
+}
+
+// Transfer events from the relay.
+type transferStartMsg struct {
+	TransferID string
+	FileName   string
+	Size       int64
+	Peer       string
+	Offset     int64 // non-zero when resuming
+}
+
+// transferErrorMsg is a failed transfer. A get_file the relay cannot start
+// has no TransferID and names the file and peer instead.
+type transferErrorMsg struct {
+	TransferID string
+	FileName   string
+	Peer       string
+	Message    string
+	RetryAfter time.Duration // the relay rate limited the get_file
+}
+
+// GetFileCmd asks the relay to fetch fileName from peer.
+func GetFileCmd(c *ChatClient, fileName, peer string) tea.Cmd {
+	return getFileCmd(c, fileName, peer, 0)
+}
+
+// ResumeDownloadCmd asks the relay for the rest of an interrupted download.
+func ResumeDownloadCmd(c *ChatClient, d *activeDownload) tea.Cmd {
+	return getFileCmd(c, d.remoteName, d.Peer, d.resumeOffset())
+}
+
+func getFileCmd(c *ChatClient, fileName, peer string, offset int64) tea.Cmd {
+	return func() tea.Msg {
+		if c == nil {
+			return logEntry{Time: "[ERR]", Message: "Cannot download, not connected."}
+		}
+		if err := c.Send("get_file", getFilePayload{FileName: fileName, Peer: peer, Offset: offset}); err != nil {
+			return logEntry{Time: "[ERR]", Message: "Download request failed: " + err.Error()}
+		}
+		if offset > 0 {
+			return logEntry{Time: "[SYS]", Message: fmt.Sprintf("Resuming %s from %s at %s.", fileName, peer, formatBytes(offset))}
+		}
+		return logEntry{Time: "[SYS]", Message: fmt.Sprintf("Requested %s from %s.", fileName, peer)}
+	}
+}
+
+// applyTransferMsg handles the relay's transfer events for our downloads
+// and the end of their data streams.
+func (m Model) applyTransferMsg(msg tea.Msg) (Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case transferStartMsg:
+		if d := m.interruptedDownload(msg.FileName, msg.Peer); d != nil {
+			// Carry on in the partial file from wherever the relay starts
+			prev := d.finished
+			delete(m.transfers, d.TransferID)
+			d.Size, d.Interrupted = msg.Size, false
+			d.start(msg.TransferID, msg.Offset)
+			m.transfers[d.TransferID] = d
+			return m, receiveCmd(m.chatClient, d, prev)
+		}
+		name := filepath.Base(msg.FileName)
+		f, err := os.Create(filepath.Join(downloadsDir, name+".part"))
+		if err != nil {
+			return m, logCmd("[ERR]", "Cannot start download: "+err.Error())
+		}
+		d := &activeDownload{
+			FileName:   name,
+			remoteName: msg.FileName,
+			Peer:       msg.Peer,
+			Size:       msg.Size,
+			file:       f,
+		}
+		d.start(msg.TransferID, 0)
+		m.transfers[d.TransferID] = d
+		return m, tea.Batch(receiveCmd(m.chatClient, d, nil), transferTickCmd())
+
+	case streamsDoneMsg:
+		d, ok := m.transfers[msg.TransferID]
+		if !ok {
+			return m, nil
+		}
+		if d.received() == d.Size {
+			delete(m.transfers, msg.TransferID)
+			part := d.file.Name()
+			d.file.Close()
+			if err := os.Rename(part, strings.TrimSuffix(part, ".part")); err != nil {
+				return m, logCmd("[ERR]", fmt.Sprintf("Could not finish %s: %v", d.FileName, err))
+			}
+			return m, tea.Batch(logCmd("[SYS]", fmt.Sprintf("Downloaded %s from %s.", d.FileName, d.Peer)), ScanDownloadsCmd())
+		}
+		if d.Interrupted || msg.Lost {
+			// Picked up again when we reconnect
+			d.Interrupted = true
+			return m, nil
+		}
+		m.abortDownload(d)
+		if msg.Err != nil {
+			return m, logCmd("[ERR]", fmt.Sprintf("Download of %s failed: %v", d.FileName, msg.Err))
+		}
+		return m, logCmd("[ERR]", fmt.Sprintf("Download of %s failed: got %s of %s.", d.FileName, formatBytes(d.received()), formatBytes(d.Size)))
+
+	case resumeDownloadMsg:
+		d := msg.d
+		if m.transfers[d.TransferID] != d || !d.Interrupted || d.resumeSeq != msg.seq || !m.chatClient.Connected() {
+			// Resumed, dropped or rescheduled meanwhile, or cut off
+			// again: the next reconnect asks anew
+			return m, nil
+		}
+		return m, ResumeDownloadCmd(m.chatClient, d)
+
+	case transferErrorMsg:
+		d, ok := m.transfers[msg.TransferID]
+		if msg.TransferID == "" {
+			d = m.interruptedDownload(msg.FileName, msg.Peer)
+			ok = d != nil
+			if ok && msg.RetryAfter > 0 {
+				return m, tea.Batch(resumeAfter(d, msg.RetryAfter),
+					logCmd("[SYS]", fmt.Sprintf("The relay is busy; resuming %s in %s.", d.FileName, msg.RetryAfter)))
+			}
+		} else if ok && d.Interrupted {
+			// The uploader noticed the lost connection too; we resume
+			// with a new transfer
+			return m, nil
+		}
+		if ok {
+			m.abortDownload(d)
+		}
+		return m, logCmd("[ERR]", "Transfer failed: "+msg.Message)
+
+	case transferTickMsg:
+		// Redraw progress while anything is downloading
+		for _, d := range m.transfers {
+			if !d.Interrupted {
+				return m, transferTickCmd()
+			}
+		}
+	}
+	return m, nil
+}
+
+// transferTickMsg redraws download progress.
+type transferTickMsg struct{}
+
+func transferTickCmd() tea.Cmd {
+	return tea.Tick(time.Second, func(time.Time) tea.Msg { return transferTickMsg{} })
+}
+
+// interruptDownloads marks every download in progress as cut off, keeping
+// its partial file for ResumeDownloadCmd.
+func (m Model) interruptDownloads() {
+	for _, d := range m.transfers {
+		d.Interrupted = true
+	}
+}
+
+// After a reconnect the first resumeBurst interrupted downloads are asked
+// for at once and the rest one every resumeInterval, inside the relay's
+// default get_file limit (a burst of 10, then one every 5s).
+const (
+	resumeBurst    = 5
+	resumeInterval = 5 * time.Second
+)
+
+// resumeDownloadMsg asks again for d, unless a later resume has been
+// scheduled since.
+type resumeDownloadMsg struct {
+	d   *activeDownload
+	seq int
+}
+
+// resumeAfter schedules asking again for d after delay.
+func resumeAfter(d *activeDownload, delay time.Duration) tea.Cmd {
+	d.resumeSeq++
+	msg := resumeDownloadMsg{d: d, seq: d.resumeSeq}
+	if delay <= 0 {
+		return func() tea.Msg { return msg }
+	}
+	return tea.Tick(delay, func(time.Time) tea.Msg { return msg })
+}
+
+// resumeDownloadsCmd asks again for every interrupted download, paced.
+func (m Model) resumeDownloadsCmd() tea.Cmd {
+	var pending []*activeDownload
+	for _, d := range m.transfers {
+		if d.Interrupted {
+			pending = append(pending, d)
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].FileName < pending[j].FileName })
+	cmds := []tea.Cmd{transferTickCmd()}
+	for i, d := range pending {
+		cmds = append(cmds, resumeAfter(d, time.Duration(max(i-resumeBurst+1, 0))*resumeInterval))
+	}
+	return tea.Batch(cmds...)
+}
+
+// interruptedDownload finds the interrupted download of fileName from peer.
+func (m Model) interruptedDownload(fileName, peer string) *activeDownload {
+	for _, d := range m.transfers {
+		if d.Interrupted && d.remoteName == fileName && d.Peer == peer {
+			return d
+		}
+	}
+	return nil
+}
+
+// abortDownload drops a download and its partial file.
+func (m Model) abortDownload(d *activeDownload) {
+	delete(m.transfers, d.TransferID)
+	close(d.stop)
+	d.file.Close()
+	os.Remove(d.file.Name())
+}
+
+// logCmd reports a line to the log.
+func logCmd(tag, message string) tea.Cmd {
+	return func() tea.Msg {
+		return logEntry{Time: tag, Message: message}
+	}
+}
+
 // renderDownloadsPanel draws the UI for the Downloads tab.
 func renderDownloadsPanel(m Model) string {
 	var b strings.Builder
@@ -67,7 +347,20 @@ func renderDownloadsPanel(m Model) string {
 	b.WriteString(sectionTitle.Render(header) + "\n")
 	b.WriteString(line + "\n")
 
-	if len(m.Downloads) == 0 {
+	for _, d := range m.transfers {
+		progress := formatBytes(d.received())
+		if d.Size > 0 {
+			progress = fmt.Sprintf("%d%% of %s", d.received()*100/d.Size, formatBytes(d.Size))
+		}
+		status := "DOWNLOADING"
+		if d.Interrupted {
+			status = "INTERRUPTED"
+		}
+		row := fmt.Sprintf("%-2s %-24s %-20s %-12s %-12s", " ", d.FileName, progress, status, d.Peer)
+		b.WriteString(cursorStyle.Render(row) + "\n")
+	}
+
+	if len(m.Downloads) == 0 && len(m.transfers) == 0 {
 		b.WriteString("\n  No downloads found in the 'downloads' directory.\n")
 	}
 
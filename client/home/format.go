@@ -0,0 +1,144 @@
+package home
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// chatMarkup matches, in order of precedence: `code`, **bold**, links,
+// [[file]] references and @mentions. Code spans are matched first so that
+// nothing inside them is formatted.
+var chatMarkup = regexp.MustCompile("`([^`]+)`" + `|\*\*([^*]+)\*\*|(https?://[^\s]+)|\[\[([^\]]+)\]\]|@([\p{L}\p{M}\p{N}_.-]+)`)
+
+var (
+	codeStyle     = lipgloss.NewStyle().Foreground(lipgloss.Color("#a6e3a1")).Background(lipgloss.Color("#2b2b2b"))
+	boldStyle     = lipgloss.NewStyle().Bold(true)
+	linkStyle     = lipgloss.NewStyle().Foreground(lipgloss.Color("#89b4fa")).Underline(true)
+	fileRefStyle  = lipgloss.NewStyle().Foreground(pink).Underline(true)
+	selectedRef   = lipgloss.NewStyle().Foreground(lipgloss.Color("#1b1b1b")).Background(pink)
+	mentionStyle  = lipgloss.NewStyle().Foreground(pink).Bold(true)
+	mentionedLine = lipgloss.NewStyle().Background(lipgloss.Color("#3b1030"))
+)
+
+// fileRef is a [[file]] mentioned in chat; it refers to a file shared by
+// whoever said it.
+type fileRef struct {
+	FileName string
+	Peer     string
+}
+
+// formatChat styles a chat line's text. selected is the index, among the
+// line's file references, of the one to highlight, or -1.
+func formatChat(text, self string, selected int) string {
+	var b strings.Builder
+	last, ref := 0, 0
+	for _, loc := range chatMarkup.FindAllStringSubmatchIndex(text, -1) {
+		b.WriteString(text[last:loc[0]])
+		last = loc[1]
+		group := func(i int) string { return text[loc[2*i]:loc[2*i+1]] }
+		switch {
+		case loc[2] >= 0:
+			b.WriteString(codeStyle.Render(group(1)))
+		case loc[4] >= 0:
+			b.WriteString(boldStyle.Render(group(2)))
+		case loc[6] >= 0:
+			b.WriteString(linkStyle.Render(group(3)))
+		case loc[8] >= 0:
+			style := fileRefStyle
+			if ref == selected {
+				style = selectedRef
+			}
+			b.WriteString(style.Render("[" + group(4) + "]"))
+			ref++
+		default:
+			if n, ok := mentionOf(group(5), self); ok {
+				b.WriteString(mentionStyle.Render("@" + group(5)[:n]))
+				b.WriteString(group(5)[n:])
+			} else {
+				b.WriteString(boldStyle.Render("@" + group(5)))
+			}
+		}
+	}
+	b.WriteString(text[last:])
+	return b.String()
+}
+
+// mentions reports whether text mentions nick with @nick.
+func mentions(text, nick string) bool {
+	for _, loc := range chatMarkup.FindAllStringSubmatchIndex(text, -1) {
+		if loc[10] >= 0 {
+			if _, ok := mentionOf(text[loc[10]:loc[11]], nick); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// mentionOf reports whether name, captured after an @, is nick, and how
+// much of it the nick takes up. Sentence punctuation the capture swallowed,
+// as in "thanks @bob.", is left over.
+func mentionOf(name, nick string) (int, bool) {
+	for n := len(name); n > 0; n-- {
+		if strings.EqualFold(name[:n], nick) {
+			return n, true
+		}
+		if c := name[n-1]; c != '.' && c != '-' {
+			break
+		}
+	}
+	return 0, false
+}
+
+// fileRefs lists the [[file]] references in text, outside code spans.
+func fileRefs(text string) []string {
+	var refs []string
+	for _, m := range chatMarkup.FindAllStringSubmatch(text, -1) {
+		if m[4] != "" {
+			refs = append(refs, m[4])
+		}
+	}
+	return refs
+}
+
+// roomFileRefs lists the file references in a room, oldest first.
+func roomFileRefs(r chatRoom) []fileRef {
+	var refs []fileRef
+	for _, l := range r.Lines {
+		if l.Sender == "" {
+			continue
+		}
+		for _, name := range fileRefs(l.Text) {
+			refs = append(refs, fileRef{FileName: name, Peer: l.Sender})
+		}
+	}
+	return refs
+}
+
+// notifyCmd rings the terminal bell and, where a notifier is installed,
+// shows a desktop notification.
+func notifyCmd(title, body string) tea.Cmd {
+	return func() tea.Msg {
+		fmt.Fprint(os.Stdout, "\a")
+		var cmd *exec.Cmd
+		switch runtime.GOOS {
+		case "darwin":
+			cmd = exec.Command("osascript", "-e", fmt.Sprintf("display notification %q with title %q", body, title))
+		case "linux":
+			if _, err := exec.LookPath("notify-send"); err == nil {
+				cmd = exec.Command("notify-send", title, body)
+			}
+		}
+		if cmd != nil {
+			_ = cmd.Run()
+		}
+		return nil
+	}
+}
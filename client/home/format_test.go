@@ -0,0 +1,93 @@
+package home
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMentions(t *testing.T) {
+	tests := []struct {
+		text string
+		want bool
+	}{
+		{"@bob hi", true},
+		{"hi @Bob", true},
+		{"thanks @bob.", true},
+		{"see you @bob...", true},
+		{"ping @bob-", true},
+		{"@bob, are you there?", true},
+		{"@bobby hi", false},
+		{"@bob.smith hi", false},
+		{"bob hi", false},
+		{"mail bob@example.com", false},
+		{"`@bob` is the syntax", false},
+		{"[[@bob.txt]]", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			if got := mentions(tt.text, "bob"); got != tt.want {
+				t.Errorf("mentions(%q, bob) = %v, want %v", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMentionsNickWithPunctuation(t *testing.T) {
+	for _, text := range []string{"hi @bob.", "hi @bob.."} {
+		if !mentions(text, "bob.") {
+			t.Errorf("mentions(%q, bob.) = false, want true", text)
+		}
+	}
+	if mentions("hi @bob", "bob.") {
+		t.Error(`mentions("hi @bob", bob.) = true, want false`)
+	}
+}
+
+func TestFileRefs(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"no files here", nil},
+		{"try [[song.flac]]", []string{"song.flac"}},
+		{"[[a.txt]] and [[b c.txt]]", []string{"a.txt", "b c.txt"}},
+		{"`[[not a ref]]` but [[a.txt]]", []string{"a.txt"}},
+		{"[[]] is empty", nil},
+		{"[[unclosed", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			if got := fileRefs(tt.text); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("fileRefs(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatChat(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		selected int
+		want     string
+	}{
+		{name: "plain", text: "hello", selected: -1, want: "hello"},
+		{name: "code", text: "run `go **test**`", selected: -1, want: "run " + codeStyle.Render("go **test**")},
+		{name: "bold", text: "**hi** there", selected: -1, want: boldStyle.Render("hi") + " there"},
+		{name: "link", text: "see https://example.com/x", selected: -1, want: "see " + linkStyle.Render("https://example.com/x")},
+		{name: "file refs", text: "[[a.txt]] [[b.txt]]", selected: 1,
+			want: fileRefStyle.Render("[a.txt]") + " " + selectedRef.Render("[b.txt]")},
+		{name: "mention of self", text: "hi @Bob", selected: -1, want: "hi " + mentionStyle.Render("@Bob")},
+		{name: "mention with full stop", text: "thanks @bob.", selected: -1, want: "thanks " + mentionStyle.Render("@bob") + "."},
+		{name: "mention with dash", text: "@bob- look", selected: -1, want: mentionStyle.Render("@bob") + "- look"},
+		{name: "mention of another", text: "thanks @cid.", selected: -1, want: "thanks " + boldStyle.Render("@cid.")},
+		{name: "longer nick", text: "@bobby", selected: -1, want: boldStyle.Render("@bobby")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatChat(tt.text, "bob", tt.selected); got != tt.want {
+				t.Errorf("formatChat(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
@@ -17,11 +17,12 @@ const (
 	tabShared
 	tabDownloads
 	tabPeers
+	tabMessages
 	tabLogs
 	numTabs
 )
 
-var tabLabels = []string{"Search", "Shared", "Downloads", "Peers", "Logs/Chat"}
+var tabLabels = []string{"Search", "Shared", "Downloads", "Peers", "Messages", "Logs/Chat"}
 
 // searchResult is now defined in search.go
 
@@ -39,20 +40,20 @@ type download struct {
 	Source   string
 }
 
-type peer struct {
-	Name   string
-	Host   string
-	Online bool
-}
-
 type logEntry struct {
 	Time    string
 	Message string
+	ID      uint64    // server message ID, 0 for local lines
+	At      time.Time // set when the line is added if not known
+	// For chat lines: who said it and what, which is the tail of Message
+	Sender  string
+	Text    string
+	Mention bool // mentions us
 }
 
 type Model struct {
-	Nickname string
-	Key      string
+	Nickname   string
+	Key        string
 	CurrentTab tab
 	Cursor     int
 	Width      int
@@ -61,16 +62,45 @@ type Model struct {
 	InputMode  bool   // True if editing search input
 
 	// Chat integration
-	chatClient *ChatClient
+	chatClient    *ChatClient
 	chatInput     string
 	chatInputMode bool
+	roomPrompt    string // "join" or "topic" while InputMode is on the chat tab
+	commands      []commandInfo
+	ignored       map[string]bool
+	transfers     map[string]*activeDownload // downloads in progress by transfer ID
+	fileRefSel    int                        // selected [[file]] in the active room, 0 is the newest
+	syncIgnore    bool
+	tabCompletion *completion
+
+	// Connection to the relay, and what to restore when it comes back
+	conn          connStateMsg
+	retryAt       time.Time
+	wasConnected  bool
+	sharesScanned bool
+	rejoining     map[string]bool // rooms we asked to rejoin after reconnecting
+	savedStatus   *[2]string      // status and message when the connection dropped
+
+	// Private conversations, most recent first
+	Conversations []conversation
+	selectedPeer  string
+	pmInput       string
+	pmInputMode   bool
+
+	// Our own presence
+	Status        string
+	StatusMessage string
+	autoAway      bool
+	lastInput     time.Time
 
 	// Data stores
 	SearchResults []searchResult
 	SharedFiles   []sharedFile
 	Downloads     []download
 	Peers         []peer
-	Logs          []logEntry
+	// Chat rooms we are in; the lobby is always first and also holds local logs
+	Rooms      []chatRoom
+	ActiveRoom int
 }
 
 var (
@@ -85,26 +115,27 @@ var (
 )
 
 // --- Chat message event for Bubble Tea
-type chatLineMsg string
+type chatLineMsg ChatLogEntry
 
-// chatLineListener now dispatches between search results and chat messages.
+// chatLineListener waits for the next message from the server that the TUI
+// understands and wraps it in a serverMsg.
 func chatLineListener(c *ChatClient) tea.Cmd {
 	return func() tea.Msg {
-		line, ok := <-c.Receive()
-		if !ok {
-			return nil
-		}
-
-		if strings.HasPrefix(line, "[SEARCH] ") {
-			payload := strings.TrimPrefix(line, "[SEARCH] ")
-			return ParseSearchResults(payload)
+		for {
+			select {
+			case line := <-c.Receive():
+				if msg := decodeServerMessage(line); msg != nil {
+					return serverMsg{Msg: msg}
+				}
+			case <-c.Done:
+				return nil
+			}
 		}
-
-		return chatLineMsg(line)
 	}
 }
 
 func NewModel(nickname, key string, client *ChatClient) Model {
+	ignored, syncIgnore := loadIgnoreList()
 	return Model{
 		Nickname: nickname,
 		Key:      key,
@@ -115,34 +146,59 @@ func NewModel(nickname, key string, client *ChatClient) Model {
 		// SharedFiles and Downloads are now populated from the filesystem
 		SharedFiles: []sharedFile{},
 		Downloads:   []download{},
-		Peers: []peer{
-			{"alice", "host2", true},
-			{"bob", "host3", false},
-			{"eve", "host5", true},
-		},
-		Logs: []logEntry{
-			{"[SYS]", "Welcome to RoseWire!"},
-		},
+		Peers:       []peer{},
+		Status:      "online",
+		lastInput:   time.Now(),
+		ignored:     ignored,
+		transfers:   make(map[string]*activeDownload),
+		rejoining:   make(map[string]bool),
+		syncIgnore:  syncIgnore,
+		Rooms: []chatRoom{{
+			Name:  lobbyRoom,
+			Lines: []logEntry{{Time: "[SYS]", Message: "Welcome to RoseWire!", At: time.Now()}},
+		}},
 	}
 }
 
 func (m Model) Init() tea.Cmd {
 	// Listen for chat messages and scan local file directories at startup
+	// Shares and the ignore list go to the relay each time we connect
 	return tea.Batch(
 		chatLineListener(m.chatClient),
+		connStateListener(m.chatClient),
 		ScanUploadsCmd(),
 		ScanDownloadsCmd(),
+		presenceTickCmd(),
 	)
 }
 
 func (m Model) Update(msg tea.Msg) (Model, tea.Cmd) {
 	switch msg := msg.(type) {
+	// Anything decoded from the server: handle it, then listen for the next one
+	case serverMsg:
+		var cmd tea.Cmd
+		m, cmd = m.Update(msg.Msg)
+		return m, tea.Batch(cmd, chatLineListener(m.chatClient))
+
 	// Handle the list of files from the local 'uploads' scan
 	case SharedFilesLoadedMsg:
 		m.SharedFiles = msg
+		m.sharesScanned = true
 		// After loading our files, create a command to notify the server
+		if m.conn.State != StateConnected {
+			return m, nil
+		}
 		return m, NotifyServerOfSharedFilesCmd(m.chatClient, m.SharedFiles)
 
+	case connStateMsg:
+		return m.applyConnState(msg)
+
+	case connTickMsg:
+		if m.conn.State == StateReconnecting && time.Now().Before(m.retryAt) {
+			return m, connTickCmd()
+		}
+		return m, nil
+
 	// Handle the list of files from the local 'downloads' scan
 	case DownloadsLoadedMsg:
 		m.Downloads = msg
@@ -153,106 +209,320 @@ func (m Model) Update(msg tea.Msg) (Model, tea.Cmd) {
 		m.SearchResults = msg
 		return m, nil
 
+	// Handle the peer list and pushed presence changes
+	case PeersLoadedMsg:
+		m.Peers = msg
+		for _, p := range msg {
+			if p.Name == m.Nickname {
+				m.Status, m.StatusMessage = p.Status, p.StatusMessage
+			}
+		}
+		return m, nil
+
+	case peerUpdateMsg:
+		m.Peers = applyPeerUpdate(m.Peers, msg)
+		if msg.Peer.Name == m.Nickname {
+			m.Status, m.StatusMessage = msg.Peer.Status, msg.Peer.StatusMessage
+		}
+		return m, nil
+
+	case presenceTickMsg:
+		// Re-rendering refreshes the online/idle durations; also go away if idle
+		if m.Status == "online" && time.Since(m.lastInput) >= autoAwayAfter {
+			m.autoAway = true
+			return m, tea.Batch(presenceTickCmd(), SetStatusCmd(m.chatClient, "away", m.StatusMessage))
+		}
+		return m, presenceTickCmd()
+
+	case privateMessageMsg:
+		if msg.From != m.Nickname && m.isIgnored(msg.From) {
+			return m, nil
+		}
+		m = m.addPrivateMessage(msg)
+		return m, nil
+
+	case roomJoinedMsg, roomPartedMsg, roomTopicMsg, roomListMsg, chatHistoryMsg:
+		m = m.applyRoomMsg(msg)
+		return m, nil
+
+	case commandListMsg:
+		m.commands = msg
+		return m, nil
+
+	case uploadRequestMsg:
+		if m.isIgnored(msg.Requester) {
+			m = m.appendToRoom(lobbyRoom, logEntry{Time: "[SYS]", Message: fmt.Sprintf("Refused %s's request for %s (ignored).", msg.Requester, msg.FileName)})
+			return m, refuseUploadCmd(m.chatClient, msg.TransferID)
+		}
+		return m, uploadCmd(m.chatClient, msg)
+
+	case transferStartMsg, streamsDoneMsg, transferErrorMsg, transferTickMsg, resumeDownloadMsg:
+		return m.applyTransferMsg(msg)
+
 	case chatLineMsg:
-		// Handle a new chat message
-		entry := ParseChatLine(string(msg))
-		m.Logs = append(m.Logs, logEntry{
-			Time:    entry.Time,
-			Message: fmt.Sprintf("%s: %s", entry.Sender, entry.Message),
-		})
-		// Listen for the next chat message
-		return m, chatLineListener(m.chatClient)
+		if m.isIgnored(msg.Sender) {
+			return m, nil
+		}
+		// Handle a new chat message; network-wide notices go to the lobby
+		entry := m.markMention(chatLine(ChatLogEntry(msg)))
+		m = m.appendToRoom(msg.Room, entry)
+		if entry.Mention {
+			if i := m.roomIndex(msg.Room); i >= 0 && (i != m.ActiveRoom || m.CurrentTab != tabLogs) {
+				m.Rooms[i].Mentioned = true
+			}
+			return m, notifyCmd("RoseWire", fmt.Sprintf("%s mentioned you in #%s: %s", entry.Sender, msg.Room, entry.Text))
+		}
+		return m, nil
 
 	// A log entry can now be a message
 	case logEntry:
-		m.Logs = append(m.Logs, msg)
+		m = m.appendToRoom(lobbyRoom, msg)
 		return m, nil
 
 	case tea.KeyMsg:
-		// Chat input mode
-		if m.CurrentTab == tabLogs && m.chatInputMode {
-			switch msg.String() {
-			case "enter":
-				if strings.TrimSpace(m.chatInput) != "" && m.chatClient != nil {
-					m.chatClient.Send(m.chatInput)
-					m.Logs = append(m.Logs, logEntry{
-						Time:    time.Now().Format("[15:04]"),
-						Message: fmt.Sprintf("%s: %s", m.Nickname, m.chatInput),
-					})
-				}
-				m.chatInput = ""
-				m.chatInputMode = false
-			case "esc":
-				m.chatInput = ""
-				m.chatInputMode = false
-			case "backspace":
-				if len(m.chatInput) > 0 {
-					m.chatInput = m.chatInput[:len(m.chatInput)-1]
-				}
-			default:
-				if msg.Type == tea.KeyRunes {
-					m.chatInput += msg.String()
-				}
+		m.lastInput = time.Now()
+		var wake tea.Cmd
+		if m.autoAway {
+			m.autoAway = false
+			wake = SetStatusCmd(m.chatClient, "online", m.StatusMessage)
+		}
+		var cmd tea.Cmd
+		m, cmd = m.handleKey(msg)
+		return m, tea.Batch(wake, cmd)
+
+	case tea.WindowSizeMsg:
+		m.Width = msg.Width
+		m.Height = msg.Height
+	}
+	return m, nil
+}
+
+// handleKey processes a keypress for the current tab and input mode.
+func (m Model) handleKey(msg tea.KeyMsg) (Model, tea.Cmd) {
+	// Chat input mode
+	if m.CurrentTab == tabLogs && m.chatInputMode {
+		if msg.String() == "tab" {
+			return m.completeChatInput(), nil
+		}
+		m.tabCompletion = nil
+		switch msg.String() {
+		case "enter":
+			// The server echoes our message back, so it is logged on arrival
+			if mm, cmd, ok := m.handleIgnoreCommand(m.chatInput); ok {
+				mm.chatInput = ""
+				mm.chatInputMode = false
+				return mm, cmd
+			}
+			if mm, cmd, ok := m.handleAddKeyCommand(m.chatInput); ok {
+				mm.chatInput = ""
+				mm.chatInputMode = false
+				return mm, cmd
+			}
+			if text := strings.TrimSpace(m.chatInput); text != "" && m.chatClient != nil {
+				m.chatClient.Send("chat_message", chatMessagePayload{Text: text, Room: m.activeRoomName()})
+			}
+			m.chatInput = ""
+			m.chatInputMode = false
+		case "esc":
+			m.chatInput = ""
+			m.chatInputMode = false
+		case "backspace":
+			if len(m.chatInput) > 0 {
+				m.chatInput = m.chatInput[:len(m.chatInput)-1]
+			}
+		default:
+			if msg.Type == tea.KeyRunes {
+				m.chatInput += msg.String()
 			}
-			return m, nil
 		}
-		switch {
-		case m.InputMode:
-			switch msg.String() {
-			case "enter":
-				m.InputMode = false
-				if m.CurrentTab == tabSearch && strings.TrimSpace(m.Input) != "" {
-					return m, SearchCmd(m.chatClient, m.Input)
-				}
-			case "esc":
-				m.InputMode = false
-			case "backspace":
-				if len(m.Input) > 0 {
-					m.Input = m.Input[:len(m.Input)-1]
-				}
-			default:
-				if msg.Type == tea.KeyRunes {
-					m.Input += msg.String()
-				}
+		return m, nil
+	}
+	// Private message input mode
+	if m.CurrentTab == tabMessages && m.pmInputMode {
+		switch msg.String() {
+		case "enter":
+			text := strings.TrimSpace(m.pmInput)
+			m.pmInput = ""
+			m.pmInputMode = false
+			if peer := m.activeConversation(); text != "" && peer != "" {
+				return m, SendPrivateMessageCmd(m.chatClient, peer, text)
+			}
+		case "esc":
+			m.pmInput = ""
+			m.pmInputMode = false
+		case "backspace":
+			if len(m.pmInput) > 0 {
+				m.pmInput = m.pmInput[:len(m.pmInput)-1]
 			}
 		default:
-			switch msg.String() {
-			case "ctrl+c", "q":
-				if m.chatClient != nil {
-					m.chatClient.Close()
+			if msg.Type == tea.KeyRunes {
+				m.pmInput += msg.String()
+			}
+		}
+		return m, nil
+	}
+	switch {
+	case m.InputMode:
+		switch msg.String() {
+		case "enter":
+			m.InputMode = false
+			if m.CurrentTab == tabSearch && strings.TrimSpace(m.Input) != "" {
+				return m, SearchCmd(m.chatClient, m.Input)
+			}
+			if m.CurrentTab == tabPeers {
+				return m, SetStatusCmd(m.chatClient, m.Status, m.Input)
+			}
+			if m.CurrentTab == tabLogs && m.roomPrompt == "join" && strings.TrimSpace(m.Input) != "" {
+				return m, JoinRoomCmd(m.chatClient, m.Input)
+			}
+			if m.CurrentTab == tabLogs && m.roomPrompt == "topic" {
+				return m, SetTopicCmd(m.chatClient, m.activeRoomName(), m.Input)
+			}
+			if peer := strings.TrimSpace(m.Input); m.CurrentTab == tabMessages && peer != "" {
+				m = m.openConversation(peer)
+				m.pmInputMode = true
+			}
+		case "esc":
+			m.InputMode = false
+		case "backspace":
+			if len(m.Input) > 0 {
+				m.Input = m.Input[:len(m.Input)-1]
+			}
+		default:
+			if msg.Type == tea.KeyRunes {
+				m.Input += msg.String()
+			}
+		}
+	default:
+		switch msg.String() {
+		case "ctrl+c", "q":
+			if m.chatClient != nil {
+				m.chatClient.Close()
+			}
+			return m, tea.Quit
+		case "tab":
+			m.CurrentTab = (m.CurrentTab + 1) % numTabs
+			m.Cursor = 0
+			if m.CurrentTab == tabMessages {
+				m = m.selectConversation()
+			}
+			if m.CurrentTab == tabLogs {
+				m = m.switchRoom(0)
+			}
+		case "shift+tab":
+			m.CurrentTab = (m.CurrentTab - 1 + numTabs) % numTabs
+			m.Cursor = 0
+			if m.CurrentTab == tabMessages {
+				m = m.selectConversation()
+			}
+			if m.CurrentTab == tabLogs {
+				m = m.switchRoom(0)
+			}
+		case "left", "right":
+			if m.CurrentTab == tabLogs {
+				if msg.String() == "left" {
+					m = m.switchRoom(-1)
+				} else {
+					m = m.switchRoom(1)
 				}
-				return m, tea.Quit
-			case "tab":
-				m.CurrentTab = (m.CurrentTab + 1) % numTabs
-				m.Cursor = 0
-			case "shift+tab":
-				m.CurrentTab = (m.CurrentTab - 1 + numTabs) % numTabs
-				m.Cursor = 0
-			case "up", "k":
-				if m.Cursor > 0 {
-					m.Cursor--
+			}
+		case "+", "t":
+			if m.CurrentTab == tabLogs {
+				m.InputMode = true
+				m.Input = ""
+				m.roomPrompt = "join"
+				if msg.String() == "t" {
+					m.Input = m.Rooms[m.ActiveRoom].Topic
+					m.roomPrompt = "topic"
 				}
-			case "down", "j":
-				m.Cursor++
-			case "enter":
-				if m.CurrentTab == tabSearch && !m.InputMode {
-					m.InputMode = true
-					m.Input = ""
-				} else if m.CurrentTab == tabLogs && !m.chatInputMode {
-					m.chatInputMode = true
+			}
+		case "pgup", "pgdown":
+			if m.CurrentTab == tabLogs {
+				page := m.logPageSize()
+				if msg.String() == "pgdown" {
+					return m.scrollRoom(-page, page)
 				}
-			case "r": // Refresh list
-				if m.CurrentTab == tabShared {
-					return m, ScanUploadsCmd()
+				return m.scrollRoom(page, page)
+			}
+		case "-":
+			if m.CurrentTab == tabLogs && m.activeRoomName() != lobbyRoom {
+				return m, PartRoomCmd(m.chatClient, m.activeRoomName())
+			}
+		case "l":
+			if m.CurrentTab == tabLogs {
+				return m, ListRoomsCmd(m.chatClient)
+			}
+		case "f":
+			if m.CurrentTab == tabLogs {
+				if n := len(roomFileRefs(m.Rooms[m.ActiveRoom])); n > 0 {
+					m.fileRefSel = (m.fileRefSel + 1) % n
 				}
-				if m.CurrentTab == tabDownloads {
-					return m, ScanDownloadsCmd()
+			}
+		case "d":
+			if m.CurrentTab == tabLogs {
+				refs := roomFileRefs(m.Rooms[m.ActiveRoom])
+				if i := len(refs) - 1 - m.fileRefSel; i >= 0 && i < len(refs) {
+					return m, GetFileCmd(m.chatClient, refs[i].FileName, refs[i].Peer)
 				}
 			}
+			if m.CurrentTab == tabSearch && m.Cursor < len(m.SearchResults) {
+				r := m.SearchResults[m.Cursor]
+				return m, GetFileCmd(m.chatClient, r.FileName, r.Peer)
+			}
+		case "up", "k":
+			if m.Cursor > 0 {
+				m.Cursor--
+			}
+			if m.CurrentTab == tabMessages {
+				m = m.selectConversation()
+			}
+		case "down", "j":
+			m.Cursor++
+			if m.CurrentTab == tabMessages {
+				m = m.selectConversation()
+			}
+		case "enter":
+			if m.CurrentTab == tabSearch && !m.InputMode {
+				m.InputMode = true
+				m.Input = ""
+			} else if m.CurrentTab == tabMessages && m.activeConversation() != "" {
+				m.pmInputMode = true
+			} else if m.CurrentTab == tabPeers && !m.InputMode {
+				m.InputMode = true
+				m.Input = m.StatusMessage
+			} else if m.CurrentTab == tabLogs && !m.chatInputMode {
+				m.chatInputMode = true
+			}
+		case "r": // Refresh list
+			if m.CurrentTab == tabShared {
+				return m, ScanUploadsCmd()
+			}
+			if m.CurrentTab == tabDownloads {
+				return m, ScanDownloadsCmd()
+			}
+			if m.CurrentTab == tabPeers {
+				return m, RefreshPeersCmd(m.chatClient)
+			}
+		case "s":
+			if m.CurrentTab == tabPeers {
+				return m, SetStatusCmd(m.chatClient, nextStatus(m.Status), m.StatusMessage)
+			}
+		case "m":
+			if m.CurrentTab == tabPeers && m.Cursor < len(m.Peers) && m.Peers[m.Cursor].Name != m.Nickname {
+				m = m.openConversation(m.Peers[m.Cursor].Name)
+				m.pmInputMode = true
+			}
+		case "i":
+			if m.CurrentTab == tabPeers && m.Cursor < len(m.Peers) {
+				nick := m.Peers[m.Cursor].Name
+				return m.setIgnored(nick, !m.isIgnored(nick))
+			}
+		case "n":
+			if m.CurrentTab == tabMessages {
+				m.InputMode = true
+				m.Input = ""
+			}
 		}
-	case tea.WindowSizeMsg:
-		m.Width = msg.Width
-		m.Height = msg.Height
 	}
 	return m, nil
 }
@@ -261,12 +531,15 @@ func (m Model) View() string {
 	var b strings.Builder
 
 	// Pink header, stretch to width
-	header := pinkHeader.Width(m.Width).Render(fmt.Sprintf("🌹 RoseWire - [%s | %s]", m.Nickname, filepath.Base(m.Key)))
+	header := pinkHeader.Width(m.Width).Render(fmt.Sprintf("🌹 RoseWire - [%s | %s]  %s", m.Nickname, filepath.Base(m.Key), renderConnState(m)))
 	b.WriteString(header + "\n")
 
 	// Tabs - use pink for active, stretch to width
 	var tabViews []string
 	for i, label := range tabLabels {
+		if tab(i) == tabMessages && m.totalUnread() > 0 {
+			label = fmt.Sprintf("%s (%d)", label, m.totalUnread())
+		}
 		if tab(i) == m.CurrentTab {
 			tabViews = append(tabViews, activeTabStyle.Render(label))
 		} else {
@@ -290,6 +563,8 @@ func (m Model) View() string {
 		b.WriteString(renderDownloadsPanel(m))
 	case tabPeers:
 		b.WriteString(renderPeersPanel(m))
+	case tabMessages:
+		b.WriteString(renderMessagesPanel(m))
 	case tabLogs:
 		b.WriteString(renderLogsPanel(m))
 	}
@@ -331,52 +606,82 @@ func renderSharedPanel(m Model) string {
 	return b.String()
 }
 
-func renderPeersPanel(m Model) string {
-	var b strings.Builder
-	b.WriteString(sectionTitle.Render("Peers:\n"))
-	line := lipgloss.NewStyle().Foreground(pink).Width(m.Width).Render(strings.Repeat("-", m.Width))
-	b.WriteString(line + "\n")
-	header := fmt.Sprintf("%-2s %-10s %-14s %-9s", "", "Name", "Host", "Status")
-	b.WriteString(sectionTitle.Render(header) + "\n")
-	b.WriteString(line + "\n")
-	for i, p := range m.Peers {
-		cursor := " "
-		if i == m.Cursor {
-			cursor = cursorStyle.Render(">")
-		}
-		status := normalStyle.Render("OFFLINE")
-		if p.Online {
-			status = cursorStyle.Render("ONLINE")
-		}
-		row := fmt.Sprintf("%s %-10s %-14s %-9s %s", cursor, p.Name, p.Host, status, cursorStyle.Render("[Remove]"))
-		b.WriteString(row + "\n")
+// logPageSize is how many chat lines fit on the Logs/Chat tab.
+func (m Model) logPageSize() int {
+	maxLogs := m.Height - 12 // Heuristic for available space
+	if maxLogs < 1 {
+		maxLogs = 1
 	}
-	b.WriteString("\n" + cursorStyle.Render("[A] Add peer (by SSH endpoint)") + "\n")
-	return b.String()
+	return maxLogs
 }
 
 func renderLogsPanel(m Model) string {
 	var b strings.Builder
-	b.WriteString(sectionTitle.Render("Logs & Chat:\n"))
+	room := m.Rooms[m.ActiveRoom]
+	b.WriteString(sectionTitle.Render("Logs & Chat: ") + renderRoomBar(m) + "\n")
+	if room.Topic != "" {
+		b.WriteString(normalStyle.Render("Topic: "+room.Topic) + "\n")
+	}
 	line := lipgloss.NewStyle().Foreground(pink).Width(m.Width).Render(strings.Repeat("-", m.Width))
 	b.WriteString(line + "\n")
 	// Render logs from the bottom up to keep recent messages visible
-	maxLogs := m.Height - 12 // Heuristic for available space
-	if maxLogs < 1 {
-		maxLogs = 1
+	maxLogs := m.logPageSize()
+	end := len(room.Lines) - room.Scroll
+	if end < 0 {
+		end = 0
 	}
-	start := len(m.Logs) - maxLogs
+	start := end - maxLogs
 	if start < 0 {
 		start = 0
 	}
-	for _, entry := range m.Logs[start:] {
-		b.WriteString(fmt.Sprintf("%-7s %s\n", entry.Time, entry.Message))
+	if start == 0 && room.HasMore {
+		b.WriteString(normalStyle.Render("  [PgUp] Load earlier messages") + "\n")
+	}
+	var prev time.Time
+	if start > 0 {
+		prev = room.Lines[start-1].At
+	}
+	// File references are numbered across the whole room so the selection
+	// lines up with roomFileRefs
+	selected := len(roomFileRefs(room)) - 1 - m.fileRefSel
+	ref := 0
+	for _, entry := range room.Lines[:start] {
+		if entry.Sender != "" {
+			ref += len(fileRefs(entry.Text))
+		}
+	}
+	for _, entry := range room.Lines[start:end] {
+		if sep := daySeparator(prev, entry.At, m.Width); sep != "" {
+			b.WriteString(sep + "\n")
+		}
+		prev = entry.At
+		text := entry.Message
+		if entry.Sender != "" {
+			text = strings.TrimSuffix(entry.Message, entry.Text) + formatChat(entry.Text, m.Nickname, selected-ref)
+			ref += len(fileRefs(entry.Text))
+		}
+		row := fmt.Sprintf("%-7s %s", entry.Time, text)
+		if entry.Mention {
+			row = mentionedLine.Render(row)
+		}
+		b.WriteString(row + "\n")
 	}
 	// Chat input bar
-	if m.chatInputMode {
-		b.WriteString("\n> " + m.chatInput + "_\n")
-	} else {
-		b.WriteString("\n[Enter] Type a chat message\n")
+	switch {
+	case m.chatInputMode:
+		b.WriteString(fmt.Sprintf("\n#%s> %s_\n", room.Name, m.chatInput))
+		b.WriteString(footerStyle.Render("[Tab] Complete  /help lists commands") + "\n")
+	case room.Scroll > 0:
+		b.WriteString("\n" + cursorStyle.Render(fmt.Sprintf("-- %d newer lines below, [PgDn] to scroll down --", room.Scroll)) + "\n")
+	case m.InputMode && m.roomPrompt == "join":
+		b.WriteString("\n" + cursorStyle.Render(fmt.Sprintf("Join room: [_ %s_]", m.Input)) + "\n")
+	case m.InputMode && m.roomPrompt == "topic":
+		b.WriteString("\n" + cursorStyle.Render(fmt.Sprintf("Topic for #%s: [_ %s_]", room.Name, m.Input)) + "\n")
+	default:
+		b.WriteString("\n[Enter] Type a chat message  [←/→] Switch room  [+] Join  [-] Leave  [T] Topic  [L] List rooms\n")
+		if len(roomFileRefs(room)) > 0 {
+			b.WriteString("[D] Download highlighted [[file]]  [F] Select an earlier file\n")
+		}
 	}
 	return b.String()
-}
\ No newline at end of file
+}
@@ -0,0 +1,130 @@
+package home
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"rosewire/config"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// uploadRequestMsg is the relay asking us to send a file to another user.
+type uploadRequestMsg struct {
+	TransferID string
+	FileName   string
+	Requester  string
+	Offset     int64 // resuming: send from this byte on
+}
+
+// loadIgnoreList reads the ignore list and sync setting from the client config.
+func loadIgnoreList() (map[string]bool, bool) {
+	cfg, _ := config.Load()
+	ignored := make(map[string]bool, len(cfg.Ignored))
+	for _, nick := range cfg.Ignored {
+		ignored[nick] = true
+	}
+	return ignored, cfg.SyncIgnore
+}
+
+// ignoredNames is the ignore list, sorted.
+func (m Model) ignoredNames() []string {
+	names := make([]string, 0, len(m.ignored))
+	for nick := range m.ignored {
+		names = append(names, nick)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// isIgnored reports whether we hide messages from nick.
+func (m Model) isIgnored(nick string) bool {
+	return m.ignored[nick]
+}
+
+// saveIgnoreListCmd persists the ignore list and, if syncing is on, tells
+// the relay about it.
+func saveIgnoreListCmd(c *ChatClient, names []string, sync bool) tea.Cmd {
+	return func() tea.Msg {
+		cfg, _ := config.Load()
+		cfg.Ignored = names
+		if err := cfg.Save(); err != nil {
+			return logEntry{Time: "[ERR]", Message: "Could not save ignore list: " + err.Error()}
+		}
+		if sync {
+			return SyncIgnoreListCmd(c, names)()
+		}
+		return nil
+	}
+}
+
+// SyncIgnoreListCmd sends the ignore list to the relay so it stops routing
+// those users' chat and private messages to us.
+func SyncIgnoreListCmd(c *ChatClient, names []string) tea.Cmd {
+	return func() tea.Msg {
+		if c == nil {
+			return nil
+		}
+		if err := c.Send("set_ignore_list", ignoreListPayload{Nicknames: names}); err != nil {
+			return logEntry{Time: "[ERR]", Message: "Could not sync ignore list: " + err.Error()}
+		}
+		return nil
+	}
+}
+
+// setIgnored adds or removes nick from the ignore list.
+func (m Model) setIgnored(nick string, ignore bool) (Model, tea.Cmd) {
+	nick = strings.TrimSpace(nick)
+	var note string
+	switch {
+	case nick == "" || nick == m.Nickname:
+		return m, nil
+	case ignore && m.ignored[nick]:
+		note = fmt.Sprintf("Already ignoring %s.", nick)
+	case ignore:
+		m.ignored[nick] = true
+		note = fmt.Sprintf("Ignoring %s. Their chat is hidden and downloads from you refused.", nick)
+	case !m.ignored[nick]:
+		note = fmt.Sprintf("You were not ignoring %s.", nick)
+	default:
+		delete(m.ignored, nick)
+		note = fmt.Sprintf("No longer ignoring %s.", nick)
+	}
+	m = m.appendToRoom(m.activeRoomName(), logEntry{Time: "[SYS]", Message: note})
+	return m, saveIgnoreListCmd(m.chatClient, m.ignoredNames(), m.syncIgnore)
+}
+
+// handleIgnoreCommand runs /ignore and /unignore locally so the list is
+// kept in the client config. It reports whether text was one of them.
+func (m Model) handleIgnoreCommand(text string) (Model, tea.Cmd, bool) {
+	fields := strings.Fields(text)
+	if len(fields) == 0 || (fields[0] != "/ignore" && fields[0] != "/unignore") {
+		return m, nil, false
+	}
+	if len(fields) < 2 {
+		if fields[0] == "/unignore" {
+			m = m.appendToRoom(m.activeRoomName(), logEntry{Time: "[SYS]", Message: "Usage: /unignore <nickname>"})
+		} else if names := m.ignoredNames(); len(names) == 0 {
+			m = m.appendToRoom(m.activeRoomName(), logEntry{Time: "[SYS]", Message: "You are not ignoring anyone."})
+		} else {
+			m = m.appendToRoom(m.activeRoomName(), logEntry{Time: "[SYS]", Message: "Ignoring: " + strings.Join(names, ", ")})
+		}
+		return m, nil, true
+	}
+	m, cmd := m.setIgnored(fields[1], fields[0] == "/ignore")
+	return m, cmd, true
+}
+
+// refuseUploadCmd turns down a download request from an ignored user.
+func refuseUploadCmd(c *ChatClient, transferID string) tea.Cmd {
+	return func() tea.Msg {
+		if c == nil {
+			return nil
+		}
+		if err := c.Send("upload_error", uploadErrorPayload{TransferID: transferID, Message: "The peer declined the transfer."}); err != nil {
+			return logEntry{Time: "[ERR]", Message: "Could not refuse upload: " + err.Error()}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,186 @@
+package home
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// conversation is the private message history with one peer.
+type conversation struct {
+	Peer   string
+	Lines  []ChatLogEntry
+	Unread int
+}
+
+// privateMessageMsg is a private message to or from us.
+type privateMessageMsg struct {
+	At      time.Time
+	From    string
+	To      string
+	Text    string
+	Offline bool
+}
+
+// SendPrivateMessageCmd sends text to a single peer.
+func SendPrivateMessageCmd(c *ChatClient, to, text string) tea.Cmd {
+	return func() tea.Msg {
+		if c == nil {
+			return logEntry{Time: "[ERR]", Message: "Cannot send message, not connected."}
+		}
+		if err := c.Send("private_message", privateMessagePayload{To: to, Text: text}); err != nil {
+			return logEntry{Time: "[ERR]", Message: "Private message failed: " + err.Error()}
+		}
+		return nil
+	}
+}
+
+// addPrivateMessage files a private message under the right conversation,
+// moving it to the top of the list.
+func (m Model) addPrivateMessage(pm privateMessageMsg) Model {
+	other := pm.From
+	if other == m.Nickname {
+		other = pm.To
+	}
+	text := pm.Text
+	if pm.Offline {
+		if pm.From == m.Nickname {
+			text += " (queued until they log in)"
+		} else {
+			text += " (sent while you were away)"
+		}
+	}
+	line := ChatLogEntry{At: pm.At, Time: pm.At.Local().Format("[15:04]"), Sender: pm.From, Message: text}
+
+	conv := conversation{Peer: other}
+	if i := m.conversationIndex(other); i >= 0 {
+		conv = m.Conversations[i]
+		m.Conversations = append(m.Conversations[:i:i], m.Conversations[i+1:]...)
+	}
+	conv.Lines = append(conv.Lines, line)
+	if pm.From != m.Nickname && !(m.CurrentTab == tabMessages && m.selectedPeer == other) {
+		conv.Unread++
+	}
+	m.Conversations = append([]conversation{conv}, m.Conversations...)
+	// Keep the cursor on the conversation the user was looking at
+	if i := m.conversationIndex(m.selectedPeer); i >= 0 {
+		m.Cursor = i
+	}
+	return m
+}
+
+// openConversation selects (creating if needed) the conversation with peer.
+func (m Model) openConversation(peer string) Model {
+	if m.conversationIndex(peer) < 0 {
+		m.Conversations = append([]conversation{{Peer: peer}}, m.Conversations...)
+	}
+	m.CurrentTab = tabMessages
+	m.Cursor = m.conversationIndex(peer)
+	return m.selectConversation()
+}
+
+func (m Model) conversationIndex(peer string) int {
+	for i, c := range m.Conversations {
+		if c.Peer == peer {
+			return i
+		}
+	}
+	return -1
+}
+
+// selectConversation makes the conversation under the cursor the active one
+// and marks it read.
+func (m Model) selectConversation() Model {
+	if len(m.Conversations) == 0 {
+		m.Cursor = 0
+		m.selectedPeer = ""
+		return m
+	}
+	if m.Cursor >= len(m.Conversations) {
+		m.Cursor = len(m.Conversations) - 1
+	}
+	m.selectedPeer = m.Conversations[m.Cursor].Peer
+	m.Conversations[m.Cursor].Unread = 0
+	return m
+}
+
+// activeConversation is the peer whose conversation is under the cursor.
+func (m Model) activeConversation() string {
+	if m.Cursor >= 0 && m.Cursor < len(m.Conversations) {
+		return m.Conversations[m.Cursor].Peer
+	}
+	return ""
+}
+
+// totalUnread counts unread private messages across all conversations.
+func (m Model) totalUnread() int {
+	n := 0
+	for _, c := range m.Conversations {
+		n += c.Unread
+	}
+	return n
+}
+
+// renderMessagesPanel draws the UI for the Messages tab.
+func renderMessagesPanel(m Model) string {
+	var b strings.Builder
+	b.WriteString(sectionTitle.Render("Private Messages:\n"))
+	line := lipgloss.NewStyle().Foreground(pink).Width(m.Width).Render(strings.Repeat("-", m.Width))
+	b.WriteString(line + "\n")
+
+	if len(m.Conversations) == 0 {
+		b.WriteString("\n  No conversations yet. Press [N] to message someone, or [M] on the Peers tab.\n")
+	}
+
+	// Conversation list
+	for i, c := range m.Conversations {
+		cursor := " "
+		if i == m.Cursor {
+			cursor = cursorStyle.Render(">")
+		}
+		unread := ""
+		if c.Unread > 0 {
+			unread = cursorStyle.Render(fmt.Sprintf("(%d new)", c.Unread))
+		}
+		b.WriteString(fmt.Sprintf("%s %-20s %s\n", cursor, c.Peer, unread))
+	}
+
+	// Selected conversation
+	if peer := m.activeConversation(); peer != "" {
+		conv := m.Conversations[m.Cursor]
+		b.WriteString(line + "\n")
+		b.WriteString(sectionTitle.Render("Conversation with "+peer) + "\n")
+		maxLines := m.Height - 14 - len(m.Conversations)
+		if maxLines < 1 {
+			maxLines = 1
+		}
+		start := len(conv.Lines) - maxLines
+		if start < 0 {
+			start = 0
+		}
+		var prev time.Time
+		if start > 0 {
+			prev = conv.Lines[start-1].At
+		}
+		for _, l := range conv.Lines[start:] {
+			if sep := daySeparator(prev, l.At, m.Width); sep != "" {
+				b.WriteString(sep + "\n")
+			}
+			prev = l.At
+			b.WriteString(fmt.Sprintf("%-7s %s: %s\n", l.Time, l.Sender, l.Message))
+		}
+	}
+
+	switch {
+	case m.pmInputMode:
+		b.WriteString("\n> " + m.pmInput + "_\n")
+	case m.InputMode:
+		b.WriteString("\n" + cursorStyle.Render(fmt.Sprintf("Message who? [_ %s_]", m.Input)) + "\n")
+	default:
+		b.WriteString("\n[Enter] Reply  [N] New conversation\n")
+	}
+	return b.String()
+}
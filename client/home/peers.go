@@ -0,0 +1,184 @@
+package home
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// peerIdleAfter mirrors the relay's idle threshold so a peer that stops
+// talking turns idle without waiting for a push from the server.
+const peerIdleAfter = 5 * time.Minute
+
+// autoAwayAfter is how long the TUI waits without a keypress before
+// marking us away.
+const autoAwayAfter = 10 * time.Minute
+
+// statusCycle is the order the [S] key steps through our own status.
+var statusCycle = []string{"online", "away", "busy", "invisible"}
+
+// peer is a user currently connected to the relay.
+type peer struct {
+	Name          string
+	Status        string
+	StatusMessage string
+	SharedFiles   int
+	OnlineSince   time.Time
+	LastActive    time.Time
+	Idle          bool
+}
+
+// PeersLoadedMsg carries the full peer list from the server.
+type PeersLoadedMsg []peer
+
+// peerUpdateMsg is a single join/leave/update pushed by the server.
+type peerUpdateMsg struct {
+	Event string
+	Peer  peer
+}
+
+// presenceTickMsg redraws online/idle durations and drives auto-away.
+type presenceTickMsg time.Time
+
+func peerFromPresence(u presenceInfo) peer {
+	return peer{
+		Name:          u.Nickname,
+		Status:        u.Status,
+		StatusMessage: u.StatusMessage,
+		SharedFiles:   u.SharedFiles,
+		OnlineSince:   parseTime(u.OnlineSince),
+		LastActive:    parseTime(u.LastActive),
+		Idle:          u.Idle,
+	}
+}
+
+// RefreshPeersCmd asks the server for the current peer list.
+func RefreshPeersCmd(c *ChatClient) tea.Cmd {
+	return func() tea.Msg {
+		if c == nil {
+			return logEntry{Time: "[ERR]", Message: "Cannot list peers, not connected."}
+		}
+		if err := c.Send("get_presence", nil); err != nil {
+			return logEntry{Time: "[ERR]", Message: "Peer refresh failed: " + err.Error()}
+		}
+		return nil
+	}
+}
+
+// SetStatusCmd tells the server our new presence state and status message.
+func SetStatusCmd(c *ChatClient, status, message string) tea.Cmd {
+	return func() tea.Msg {
+		if c == nil {
+			return logEntry{Time: "[ERR]", Message: "Cannot set status, not connected."}
+		}
+		if err := c.Send("set_status", setStatusPayload{Status: status, Message: message}); err != nil {
+			return logEntry{Time: "[ERR]", Message: "Set status failed: " + err.Error()}
+		}
+		return nil
+	}
+}
+
+func presenceTickCmd() tea.Cmd {
+	return tea.Tick(30*time.Second, func(t time.Time) tea.Msg {
+		return presenceTickMsg(t)
+	})
+}
+
+// nextStatus returns the status after cur in statusCycle.
+func nextStatus(cur string) string {
+	for i, s := range statusCycle {
+		if s == cur {
+			return statusCycle[(i+1)%len(statusCycle)]
+		}
+	}
+	return statusCycle[0]
+}
+
+// statusLabel renders a peer's status column.
+func statusLabel(p peer) string {
+	switch p.Status {
+	case "away":
+		return normalStyle.Render("AWAY")
+	case "busy":
+		return normalStyle.Render("BUSY")
+	case "invisible":
+		return normalStyle.Render("INVISIBLE")
+	}
+	if idle := time.Since(p.LastActive); p.Idle || idle >= peerIdleAfter {
+		return normalStyle.Render("IDLE " + formatDuration(idle))
+	}
+	return cursorStyle.Render("ONLINE")
+}
+
+// applyPeerUpdate merges a pushed presence event into the list.
+func applyPeerUpdate(peers []peer, u peerUpdateMsg) []peer {
+	out := make([]peer, 0, len(peers)+1)
+	for _, p := range peers {
+		if p.Name != u.Peer.Name {
+			out = append(out, p)
+		}
+	}
+	if u.Event != "leave" {
+		out = append(out, u.Peer)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
+
+// formatDuration renders a duration in the largest sensible unit pair.
+func formatDuration(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return "<1m"
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh%02dm", int(d.Hours()), int(d.Minutes())%60)
+	default:
+		return fmt.Sprintf("%dd%02dh", int(d.Hours())/24, int(d.Hours())%24)
+	}
+}
+
+// renderPeersPanel draws the UI for the Peers tab.
+func renderPeersPanel(m Model) string {
+	var b strings.Builder
+	b.WriteString(sectionTitle.Render(fmt.Sprintf("Peers online (%d):\n", len(m.Peers))))
+	b.WriteString(fmt.Sprintf("You are %s", strings.ToUpper(m.Status)))
+	if m.InputMode {
+		b.WriteString(cursorStyle.Render(fmt.Sprintf("  [_ %s_]", m.Input)))
+	} else if m.StatusMessage != "" {
+		b.WriteString(normalStyle.Render("  \"" + m.StatusMessage + "\""))
+	}
+	b.WriteString("\n")
+	line := lipgloss.NewStyle().Foreground(pink).Width(m.Width).Render(strings.Repeat("-", m.Width))
+	b.WriteString(line + "\n")
+	header := fmt.Sprintf("%-2s %-20s %-8s %-10s %-14s %s", "", "Name", "Files", "Online", "Status", "Message")
+	b.WriteString(sectionTitle.Render(header) + "\n")
+	b.WriteString(line + "\n")
+
+	if len(m.Peers) == 0 {
+		b.WriteString("\n  No peers online.\n")
+	}
+
+	for i, p := range m.Peers {
+		cursor := " "
+		if i == m.Cursor {
+			cursor = cursorStyle.Render(">")
+		}
+		status := lipgloss.NewStyle().Width(14).Render(statusLabel(p))
+		message := p.StatusMessage
+		if m.isIgnored(p.Name) {
+			message = "(ignored) " + message
+		}
+		row := fmt.Sprintf("%s %-20s %-8d %-10s %s %s", cursor, p.Name, p.SharedFiles, formatDuration(time.Since(p.OnlineSince)), status, message)
+		b.WriteString(row + "\n")
+	}
+	b.WriteString("\n" + cursorStyle.Render("[R] Refresh List  [M] Message  [S] Change Status  [I] Ignore/Unignore  [Enter] Set Status Message") + "\n")
+	return b.String()
+}
@@ -0,0 +1,355 @@
+package home
+
+import (
+	"encoding/json"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// The relay speaks newline-delimited JSON on the chat subsystem. These types
+// mirror the ones in the server's protocol.go.
+
+type inboundMessage struct {
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+type outboundMessage struct {
+	Type    string      `json:"type"`
+	Payload interface{} `json:"payload"`
+}
+
+// --- Client to Server Payloads ---
+
+type wireSharedFile struct {
+	Name  string
+	Size  int64
+	IsDir bool
+}
+
+type sharePayload struct {
+	Files []wireSharedFile `json:"files"`
+}
+
+type addKeyPayload struct {
+	PublicKey string `json:"publicKey"`
+}
+
+type pingPayload struct {
+	Seq uint64 `json:"seq"`
+}
+
+type getFilePayload struct {
+	FileName string `json:"fileName"`
+	Peer     string `json:"peer"`
+	Offset   int64  `json:"offset,omitempty"` // resume from this byte
+}
+
+type transferStartPayload struct {
+	TransferID string `json:"transferID"`
+	FileName   string `json:"fileName"`
+	Size       int64  `json:"size"`
+	FromUser   string `json:"fromUser"`
+	Offset     int64  `json:"offset"`
+}
+
+type uploadDonePayload struct {
+	TransferID string `json:"transferID"`
+}
+
+type searchPayload struct {
+	Query string `json:"query"`
+}
+
+type chatMessagePayload struct {
+	Text string `json:"text"`
+	Room string `json:"room,omitempty"`
+}
+
+type roomPayload struct {
+	Room string `json:"room"`
+}
+
+type chatHistoryRequestPayload struct {
+	Room   string `json:"room"`
+	Before string `json:"before,omitempty"`
+}
+
+type setTopicPayload struct {
+	Room  string `json:"room"`
+	Topic string `json:"topic"`
+}
+
+type privateMessagePayload struct {
+	To   string `json:"to"`
+	Text string `json:"text"`
+}
+
+type setStatusPayload struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+// --- Server to Client Payloads ---
+
+type wireSearchResult struct {
+	FileName string `json:"fileName"`
+	Size     int64  `json:"size"`
+	Peer     string `json:"peer"`
+}
+
+type searchResultsPayload struct {
+	Results []wireSearchResult `json:"results"`
+}
+
+type chatBroadcastPayload struct {
+	ID        uint64 `json:"id"`
+	Timestamp string `json:"timestamp"`
+	Room      string `json:"room"`
+	Nickname  string `json:"nickname"`
+	Text      string `json:"text"`
+	IsSystem  bool   `json:"isSystem"`
+	IsAction  bool   `json:"isAction"`
+}
+
+type commandInfo struct {
+	Name string `json:"name"`
+	Args string `json:"args"`
+	Help string `json:"help"`
+}
+
+type commandListPayload struct {
+	Commands []commandInfo `json:"commands"`
+}
+
+type privateMessageDeliveryPayload struct {
+	ID        uint64 `json:"id"`
+	Timestamp string `json:"timestamp"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Text      string `json:"text"`
+	Offline   bool   `json:"offline"`
+}
+
+type chatHistoryPayload struct {
+	Room     string                 `json:"room"`
+	Messages []chatBroadcastPayload `json:"messages"`
+	Oldest   string                 `json:"oldest"`
+	HasMore  bool                   `json:"hasMore"`
+}
+
+type roomInfo struct {
+	Name    string `json:"name"`
+	Topic   string `json:"topic"`
+	Members int    `json:"members"`
+}
+
+type roomListPayload struct {
+	Rooms []roomInfo `json:"rooms"`
+}
+
+type roomJoinedPayload struct {
+	Room    string   `json:"room"`
+	Topic   string   `json:"topic"`
+	Members []string `json:"members"`
+}
+
+type roomTopicPayload struct {
+	Room  string `json:"room"`
+	Topic string `json:"topic"`
+	SetBy string `json:"setBy"`
+}
+
+type ignoreListPayload struct {
+	Nicknames []string `json:"nicknames"`
+}
+
+type uploadRequestPayload struct {
+	TransferID string `json:"transferID"`
+	FileName   string `json:"fileName"`
+	Requester  string `json:"requester"`
+	Offset     int64  `json:"offset"` // send from this byte on
+}
+
+type uploadErrorPayload struct {
+	TransferID string `json:"transferID"`
+	Message    string `json:"message"`
+}
+
+type transferErrorPayload struct {
+	TransferID string `json:"transferID"`
+	FileName   string `json:"fileName"`
+	Peer       string `json:"peer"`
+	Message    string `json:"message"`
+	RetryAfter int    `json:"retryAfter"` // seconds
+}
+
+type presenceInfo struct {
+	Nickname      string `json:"nickname"`
+	Status        string `json:"status"`
+	StatusMessage string `json:"statusMessage"`
+	SharedFiles   int    `json:"sharedFiles"`
+	OnlineSince   string `json:"onlineSince"`
+	LastActive    string `json:"lastActive"`
+	Idle          bool   `json:"idle"`
+}
+
+type presenceListPayload struct {
+	Users []presenceInfo `json:"users"`
+}
+
+type presenceUpdatePayload struct {
+	Event string       `json:"event"`
+	User  presenceInfo `json:"user"`
+}
+
+// serverMsg wraps a decoded server message so Update knows to keep listening.
+type serverMsg struct {
+	Msg tea.Msg
+}
+
+// decodeServerMessage turns one line from the relay into a Bubble Tea message.
+// It returns nil for message types the TUI does not handle.
+func decodeServerMessage(line string) tea.Msg {
+	var msg inboundMessage
+	if err := json.Unmarshal([]byte(line), &msg); err != nil {
+		return logEntry{Time: "[ERR]", Message: "Bad message from server: " + err.Error()}
+	}
+
+	switch msg.Type {
+	case "chat_broadcast", "system_broadcast":
+		var p chatBroadcastPayload
+		if err := json.Unmarshal(msg.Payload, &p); err != nil {
+			return nil
+		}
+		return chatLineMsg(chatLogEntry(p))
+
+	case "command_list":
+		var p commandListPayload
+		if err := json.Unmarshal(msg.Payload, &p); err != nil {
+			return nil
+		}
+		return commandListMsg(p.Commands)
+
+	case "chat_history":
+		var p chatHistoryPayload
+		if err := json.Unmarshal(msg.Payload, &p); err != nil {
+			return nil
+		}
+		h := chatHistoryMsg{Room: p.Room, Oldest: p.Oldest, HasMore: p.HasMore}
+		for _, cm := range p.Messages {
+			h.Lines = append(h.Lines, chatLogEntry(cm))
+		}
+		return h
+
+	case "room_list":
+		var p roomListPayload
+		if err := json.Unmarshal(msg.Payload, &p); err != nil {
+			return nil
+		}
+		return roomListMsg(p.Rooms)
+
+	case "room_joined":
+		var p roomJoinedPayload
+		if err := json.Unmarshal(msg.Payload, &p); err != nil {
+			return nil
+		}
+		return roomJoinedMsg{Room: p.Room, Topic: p.Topic, Members: p.Members}
+
+	case "room_parted":
+		var p roomPayload
+		if err := json.Unmarshal(msg.Payload, &p); err != nil {
+			return nil
+		}
+		return roomPartedMsg(p.Room)
+
+	case "room_topic":
+		var p roomTopicPayload
+		if err := json.Unmarshal(msg.Payload, &p); err != nil {
+			return nil
+		}
+		return roomTopicMsg{Room: p.Room, Topic: p.Topic, SetBy: p.SetBy}
+
+	case "private_message":
+		var p privateMessageDeliveryPayload
+		if err := json.Unmarshal(msg.Payload, &p); err != nil {
+			return nil
+		}
+		return privateMessageMsg{At: parseTime(p.Timestamp), From: p.From, To: p.To, Text: p.Text, Offline: p.Offline}
+
+	case "search_results":
+		var p searchResultsPayload
+		if err := json.Unmarshal(msg.Payload, &p); err != nil {
+			return nil
+		}
+		results := make([]searchResult, 0, len(p.Results))
+		for _, r := range p.Results {
+			results = append(results, searchResult{
+				FileName: r.FileName,
+				Peer:     r.Peer,
+				Size:     formatBytes(r.Size),
+			})
+		}
+		return SearchResultsMsg(results)
+
+	case "presence_list":
+		var p presenceListPayload
+		if err := json.Unmarshal(msg.Payload, &p); err != nil {
+			return nil
+		}
+		peers := make([]peer, 0, len(p.Users))
+		for _, u := range p.Users {
+			peers = append(peers, peerFromPresence(u))
+		}
+		return PeersLoadedMsg(peers)
+
+	case "presence_update":
+		var p presenceUpdatePayload
+		if err := json.Unmarshal(msg.Payload, &p); err != nil {
+			return nil
+		}
+		return peerUpdateMsg{Event: p.Event, Peer: peerFromPresence(p.User)}
+
+	case "upload_request":
+		var p uploadRequestPayload
+		if err := json.Unmarshal(msg.Payload, &p); err != nil {
+			return nil
+		}
+		return uploadRequestMsg{TransferID: p.TransferID, FileName: p.FileName, Requester: p.Requester, Offset: p.Offset}
+
+	case "transfer_start":
+		var p transferStartPayload
+		if err := json.Unmarshal(msg.Payload, &p); err != nil {
+			return nil
+		}
+		return transferStartMsg{TransferID: p.TransferID, FileName: p.FileName, Size: p.Size, Peer: p.FromUser, Offset: p.Offset}
+
+	case "transfer_error":
+		var p transferErrorPayload
+		if err := json.Unmarshal(msg.Payload, &p); err != nil {
+			return nil
+		}
+		return transferErrorMsg{TransferID: p.TransferID, FileName: p.FileName, Peer: p.Peer, Message: p.Message, RetryAfter: time.Duration(p.RetryAfter) * time.Second}
+	}
+	return nil
+}
+
+// chatLogEntry converts a chat or system broadcast for display.
+func chatLogEntry(p chatBroadcastPayload) ChatLogEntry {
+	sender := p.Nickname
+	if p.IsSystem {
+		sender = "*"
+	}
+	at := parseTime(p.Timestamp)
+	return ChatLogEntry{ID: p.ID, At: at, Time: at.Local().Format("[15:04]"), Room: p.Room, Sender: sender, Message: p.Text, Action: p.IsAction}
+}
+
+// parseTime reads an RFC 3339 timestamp from the server, falling back to now.
+func parseTime(s string) time.Time {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Now()
+	}
+	return t
+}
@@ -0,0 +1,277 @@
+package home
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// lobbyRoom is joined automatically by the server and cannot be left.
+const lobbyRoom = "lobby"
+
+// chatRoom is a room we are in and what has been said there.
+type chatRoom struct {
+	Name      string
+	Topic     string
+	Lines     []logEntry
+	Unread    int
+	Mentioned bool // an unread line mentions us
+
+	// Scrollback: Scroll is how many lines up from the bottom we are, and
+	// Oldest is the server's cursor for fetching earlier history.
+	Scroll         int
+	Oldest         string
+	HasMore        bool
+	loadingHistory bool
+}
+
+// roomJoinedMsg confirms we joined a room.
+type roomJoinedMsg struct {
+	Room    string
+	Topic   string
+	Members []string
+}
+
+// roomPartedMsg confirms we left a room.
+type roomPartedMsg string
+
+// roomTopicMsg is a topic change in one of our rooms.
+type roomTopicMsg struct {
+	Room  string
+	Topic string
+	SetBy string
+}
+
+// roomListMsg is the server's directory of rooms.
+type roomListMsg []roomInfo
+
+// chatHistoryMsg is a page of earlier messages for a room, oldest first.
+type chatHistoryMsg struct {
+	Room    string
+	Lines   []ChatLogEntry
+	Oldest  string
+	HasMore bool
+}
+
+// sendRoomCmd sends a room-related request to the server.
+func sendRoomCmd(c *ChatClient, msgType string, payload interface{}) tea.Cmd {
+	return func() tea.Msg {
+		if c == nil {
+			return logEntry{Time: "[ERR]", Message: "Cannot reach rooms, not connected."}
+		}
+		if err := c.Send(msgType, payload); err != nil {
+			return logEntry{Time: "[ERR]", Message: "Room request failed: " + err.Error()}
+		}
+		return nil
+	}
+}
+
+// JoinRoomCmd asks to join (or create) a room.
+func JoinRoomCmd(c *ChatClient, room string) tea.Cmd {
+	return sendRoomCmd(c, "join_room", roomPayload{Room: room})
+}
+
+// PartRoomCmd asks to leave a room.
+func PartRoomCmd(c *ChatClient, room string) tea.Cmd {
+	return sendRoomCmd(c, "part_room", roomPayload{Room: room})
+}
+
+// ListRoomsCmd asks for the room directory.
+func ListRoomsCmd(c *ChatClient) tea.Cmd {
+	return sendRoomCmd(c, "list_rooms", nil)
+}
+
+// SetTopicCmd changes a room's topic.
+func SetTopicCmd(c *ChatClient, room, topic string) tea.Cmd {
+	return sendRoomCmd(c, "set_topic", setTopicPayload{Room: room, Topic: topic})
+}
+
+// ChatHistoryCmd asks for messages in room older than the before cursor.
+func ChatHistoryCmd(c *ChatClient, room, before string) tea.Cmd {
+	return sendRoomCmd(c, "chat_history", chatHistoryRequestPayload{Room: room, Before: before})
+}
+
+// chatLine formats a chat message as a log line.
+func chatLine(e ChatLogEntry) logEntry {
+	line := logEntry{Time: e.Time, Message: fmt.Sprintf("%s: %s", e.Sender, e.Message), ID: e.ID, At: e.At, Sender: e.Sender, Text: e.Message}
+	if e.Action {
+		line.Message = fmt.Sprintf("* %s %s", e.Sender, e.Message)
+	}
+	if e.Sender == "*" {
+		// System notices are not formatted
+		line.Sender, line.Text = "", ""
+	}
+	return line
+}
+
+// markMention flags a line from someone else that mentions us.
+func (m Model) markMention(l logEntry) logEntry {
+	l.Mention = l.Sender != "" && l.Sender != m.Nickname && mentions(l.Text, m.Nickname)
+	return l
+}
+
+func (m Model) roomIndex(name string) int {
+	for i, r := range m.Rooms {
+		if r.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// activeRoomName is the room the chat input sends to.
+func (m Model) activeRoomName() string {
+	return m.Rooms[m.ActiveRoom].Name
+}
+
+// appendToRoom adds a line to a room, falling back to the lobby for rooms
+// we are not in. Rooms not on screen count it as unread.
+func (m Model) appendToRoom(room string, entry logEntry) Model {
+	i := m.roomIndex(room)
+	if i < 0 {
+		i = 0
+	}
+	if entry.At.IsZero() {
+		entry.At = time.Now()
+	}
+	m.Rooms[i].Lines = append(m.Rooms[i].Lines, entry)
+	if i != m.ActiveRoom || m.CurrentTab != tabLogs {
+		m.Rooms[i].Unread++
+	}
+	return m
+}
+
+// switchRoom moves the active room by delta, wrapping around.
+func (m Model) switchRoom(delta int) Model {
+	n := len(m.Rooms)
+	if delta != 0 {
+		m.fileRefSel = 0
+	}
+	m.ActiveRoom = (m.ActiveRoom + delta + n) % n
+	m.Rooms[m.ActiveRoom].Unread = 0
+	m.Rooms[m.ActiveRoom].Mentioned = false
+	return m
+}
+
+// applyRoomMsg updates the room list from a room event.
+func (m Model) applyRoomMsg(msg tea.Msg) Model {
+	switch msg := msg.(type) {
+	case roomJoinedMsg:
+		i := m.roomIndex(msg.Room)
+		if i < 0 {
+			m.Rooms = append(m.Rooms, chatRoom{Name: msg.Room})
+			i = len(m.Rooms) - 1
+		}
+		m.Rooms[i].Topic = msg.Topic
+		verb := "Joined"
+		if m.rejoining[msg.Room] {
+			// Back after a reconnect; stay where the user was
+			delete(m.rejoining, msg.Room)
+			verb = "Rejoined"
+		} else {
+			m.ActiveRoom = i
+		}
+		m = m.appendToRoom(msg.Room, logEntry{Time: "[SYS]", Message: fmt.Sprintf("%s #%s with %s", verb, msg.Room, strings.Join(msg.Members, ", "))})
+
+	case roomPartedMsg:
+		if i := m.roomIndex(string(msg)); i > 0 {
+			m.Rooms = append(m.Rooms[:i:i], m.Rooms[i+1:]...)
+			if m.ActiveRoom >= i {
+				m.ActiveRoom--
+			}
+		}
+
+	case roomTopicMsg:
+		if i := m.roomIndex(msg.Room); i >= 0 {
+			m.Rooms[i].Topic = msg.Topic
+		}
+		m = m.appendToRoom(msg.Room, logEntry{Time: "[SYS]", Message: fmt.Sprintf("%s set the topic of #%s: %s", msg.SetBy, msg.Room, msg.Topic)})
+
+	case chatHistoryMsg:
+		i := m.roomIndex(msg.Room)
+		if i < 0 {
+			break
+		}
+		// Skip anything we already have, e.g. a message that arrived live
+		// while the backlog was on its way
+		have := make(map[uint64]bool, len(m.Rooms[i].Lines))
+		for _, l := range m.Rooms[i].Lines {
+			if l.ID != 0 {
+				have[l.ID] = true
+			}
+		}
+		lines := make([]logEntry, 0, len(msg.Lines)+len(m.Rooms[i].Lines))
+		for _, e := range msg.Lines {
+			if (e.ID == 0 || !have[e.ID]) && !m.isIgnored(e.Sender) {
+				lines = append(lines, m.markMention(chatLine(e)))
+			}
+		}
+		// History sent after a reconnect covers what we missed, so it is
+		// merged by time rather than put in front
+		m.Rooms[i].Lines = append(lines, m.Rooms[i].Lines...)
+		sort.SliceStable(m.Rooms[i].Lines, func(a, b int) bool {
+			return m.Rooms[i].Lines[a].At.Before(m.Rooms[i].Lines[b].At)
+		})
+		if msg.Oldest != "" {
+			m.Rooms[i].Oldest = msg.Oldest
+		}
+		m.Rooms[i].HasMore = msg.HasMore
+		m.Rooms[i].loadingHistory = false
+
+	case roomListMsg:
+		var b strings.Builder
+		b.WriteString("Rooms:")
+		for _, r := range msg {
+			b.WriteString(fmt.Sprintf(" #%s (%d)", r.Name, r.Members))
+			if r.Topic != "" {
+				b.WriteString(" - " + r.Topic + ";")
+			}
+		}
+		m = m.appendToRoom(m.activeRoomName(), logEntry{Time: "[SYS]", Message: b.String()})
+	}
+	return m
+}
+
+// scrollRoom moves the active room's view by delta lines (positive is up).
+// Scrolling past the top fetches earlier history from the server.
+func (m Model) scrollRoom(delta, page int) (Model, tea.Cmd) {
+	r := &m.Rooms[m.ActiveRoom]
+	r.Scroll += delta
+	if r.Scroll < 0 {
+		r.Scroll = 0
+	}
+	if top := len(r.Lines) - page; r.Scroll >= top {
+		if top < 0 {
+			top = 0
+		}
+		r.Scroll = top
+		if r.HasMore && !r.loadingHistory {
+			r.loadingHistory = true
+			return m, ChatHistoryCmd(m.chatClient, r.Name, r.Oldest)
+		}
+	}
+	return m, nil
+}
+
+// renderRoomBar draws the row of joined rooms above the chat log.
+func renderRoomBar(m Model) string {
+	var parts []string
+	for i, r := range m.Rooms {
+		label := "#" + r.Name
+		if r.Unread > 0 {
+			label += fmt.Sprintf("(%d)", r.Unread)
+		}
+		if r.Mentioned {
+			label += "@"
+		}
+		if i == m.ActiveRoom {
+			parts = append(parts, activeTabStyle.Render(label))
+		} else {
+			parts = append(parts, normalStyle.Render(label))
+		}
+	}
+	return strings.Join(parts, " ")
+}
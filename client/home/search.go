@@ -2,7 +2,6 @@ package home
 
 import (
 	"fmt"
-	"strconv"
 	"strings"
 
 	tea "github.com/charmbracelet/bubbletea"
@@ -25,42 +24,15 @@ func SearchCmd(c *ChatClient, query string) tea.Cmd {
 		if c == nil {
 			return logEntry{Time: "[ERR]", Message: "Cannot search, not connected."}
 		}
-		command := "/search " + query
-		c.Send(command)
+		if err := c.Send("search", searchPayload{Query: query}); err != nil {
+			return logEntry{Time: "[ERR]", Message: "Search failed: " + err.Error()}
+		}
 		// We don't return a message here; the result will come from the server
 		// and be handled by the chatLineListener.
 		return nil
 	}
 }
 
-// ParseSearchResults decodes the server's search result payload.
-// Payload format: name1:raw_size1:peer1|name2:raw_size2:peer2
-func ParseSearchResults(payload string) tea.Msg {
-	var results []searchResult
-	if strings.TrimSpace(payload) == "" {
-		return SearchResultsMsg(results)
-	}
-
-	items := strings.Split(payload, "|")
-	for _, item := range items {
-		parts := strings.SplitN(item, ":", 3)
-		if len(parts) != 3 {
-			continue // Malformed part
-		}
-		size, err := strconv.ParseInt(parts[1], 10, 64)
-		if err != nil {
-			continue // Malformed size
-		}
-
-		results = append(results, searchResult{
-			FileName: parts[0],
-			Peer:     parts[2],
-			Size:     formatBytes(size), // formatBytes is in shared.go
-		})
-	}
-	return SearchResultsMsg(results)
-}
-
 // renderSearchPanel draws the UI for the Search tab.
 func renderSearchPanel(m Model) string {
 	var b strings.Builder
@@ -68,7 +40,7 @@ func renderSearchPanel(m Model) string {
 	if m.InputMode {
 		b.WriteString(cursorStyle.Render(fmt.Sprintf("[_ %s_]\n", m.Input)))
 	} else {
-		b.WriteString("[Press Enter to type your query]\n")
+		b.WriteString("[Press Enter to type your query, D to download the selected file]\n")
 	}
 	line := lipgloss.NewStyle().Foreground(pink).Width(m.Width).Render(strings.Repeat("-", m.Width))
 	b.WriteString(line + "\n")
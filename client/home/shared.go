@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-	"strings"
 
 	tea "github.com/charmbracelet/bubbletea"
 )
@@ -71,19 +70,17 @@ func formatBytes(b int64) string {
 // NotifyServerOfSharedFilesCmd creates a command to send the file list to the server.
 func NotifyServerOfSharedFilesCmd(c *ChatClient, files []sharedFile) tea.Cmd {
 	return func() tea.Msg {
-		if c == nil || c.sshClient == nil {
+		if c == nil || !c.Connected() {
 			return logEntry{Time: "[ERR]", Message: "Cannot notify server, not connected."}
 		}
 
-		var parts []string
+		payload := sharePayload{Files: make([]wireSharedFile, 0, len(files))}
 		for _, f := range files {
-			// Format: name:raw_size_bytes:isDir
-			part := fmt.Sprintf("%s:%d:%t", f.Name, f.rawSize, f.IsDir)
-			parts = append(parts, part)
+			payload.Files = append(payload.Files, wireSharedFile{Name: f.Name, Size: f.rawSize, IsDir: f.IsDir})
+		}
+		if err := c.Send("share", payload); err != nil {
+			return logEntry{Time: "[ERR]", Message: "Share failed: " + err.Error()}
 		}
-		payload := strings.Join(parts, "|")
-		command := "/share " + payload
-		c.Send(command)
 
 		return logEntry{Time: "[SYS]", Message: "Shared file list sent to server."}
 	}
@@ -0,0 +1,219 @@
+package home
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"golang.org/x/crypto/ssh"
+)
+
+// File bytes do not go over chat. The uploader and the downloader each open
+// numDataStreams SSH sessions with the subsystem
+// "data-transfer:<transferID>:<i>", and the relay pipes stream i of one to
+// stream i of the other. Stream i carries the i-th of numDataStreams equal
+// parts of the file from the offset the download starts at; the Flutter
+// client splits files the same way.
+const numDataStreams = 50
+
+// streamRange is the part of a file, [Start, End), one data stream carries.
+type streamRange struct {
+	Start, End int64
+}
+
+// transferRanges splits [offset, size) between the data streams. Small
+// files leave some ranges empty; no stream is opened for those.
+func transferRanges(offset, size int64) []streamRange {
+	ranges := make([]streamRange, numDataStreams)
+	n := size - offset
+	if n < 0 {
+		n = 0
+	}
+	part := (n + numDataStreams - 1) / numDataStreams
+	for i := range ranges {
+		start := min(offset+int64(i)*part, size)
+		ranges[i] = streamRange{Start: start, End: min(start+part, size)}
+	}
+	return ranges
+}
+
+// dataStream is one data-transfer session to the relay.
+type dataStream struct {
+	session *ssh.Session
+	stdin   io.WriteCloser
+	stdout  io.Reader
+}
+
+// openDataStream opens stream i of a transfer on the current connection.
+func (c *ChatClient) openDataStream(transferID string, i int) (*dataStream, error) {
+	c.mu.Lock()
+	l := c.link
+	c.mu.Unlock()
+	if l == nil {
+		return nil, errNotConnected
+	}
+	session, err := l.sshClient.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("session: %w", err)
+	}
+	// Take stdin even when only reading: left alone, the session would
+	// close it at once and the relay would end the stream
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, fmt.Errorf("stdin: %w", err)
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, fmt.Errorf("stdout: %w", err)
+	}
+	if err := session.RequestSubsystem(fmt.Sprintf("data-transfer:%s:%d", transferID, i)); err != nil {
+		session.Close()
+		return nil, fmt.Errorf("request subsystem: %w", err)
+	}
+	return &dataStream{session: session, stdin: stdin, stdout: stdout}, nil
+}
+
+// runStreams opens a data stream for every non-empty range and runs fn on
+// each, all at once, returning the first error. Closing stop cuts them
+// short.
+func runStreams(c *ChatClient, transferID string, ranges []streamRange, stop <-chan struct{}, fn func(i int, s *dataStream) error) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(ranges))
+	for i, r := range ranges {
+		if r.Start >= r.End {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s, err := c.openDataStream(transferID, i)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			done := make(chan struct{})
+			go func() {
+				select {
+				case <-stop:
+					s.session.Close()
+				case <-done:
+				}
+			}()
+			errs[i] = fn(i, s)
+			close(done)
+			s.session.Close()
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rangeWriter writes one stream's bytes into its range of a download.
+type rangeWriter struct {
+	file *os.File
+	r    streamRange
+	got  *atomic.Int64
+}
+
+func (w *rangeWriter) Write(p []byte) (int, error) {
+	off := w.r.Start + w.got.Load()
+	if off+int64(len(p)) > w.r.End {
+		return 0, errors.New("peer sent more than the file holds")
+	}
+	n, err := w.file.WriteAt(p, off)
+	w.got.Add(int64(n))
+	return n, err
+}
+
+// streamsDoneMsg reports that every data stream of a download has ended.
+type streamsDoneMsg struct {
+	TransferID string
+	Err        error
+	Lost       bool // the connection to the relay went with them
+}
+
+// receiveCmd receives d over its data streams. When resuming, prev is the
+// previous attempt's finished channel: its streams may still be winding
+// down, and must be gone before the file is cut back to where this one
+// starts.
+func receiveCmd(c *ChatClient, d *activeDownload, prev <-chan struct{}) tea.Cmd {
+	id, ranges, got, file, stop, finished := d.TransferID, d.ranges, d.got, d.file, d.stop, d.finished
+	return func() tea.Msg {
+		defer close(finished)
+		if prev != nil {
+			<-prev
+		}
+		if err := file.Truncate(ranges[0].Start); err != nil {
+			return streamsDoneMsg{TransferID: id, Err: err}
+		}
+		err := runStreams(c, id, ranges, stop, func(i int, s *dataStream) error {
+			_, err := io.Copy(&rangeWriter{file: file, r: ranges[i], got: &got[i]}, s.stdout)
+			return err
+		})
+		return streamsDoneMsg{TransferID: id, Err: err, Lost: !c.Connected()}
+	}
+}
+
+// uploadCmd answers an upload request: it sends the file from the uploads
+// directory over the data streams, then tells the relay it is done.
+func uploadCmd(c *ChatClient, req uploadRequestMsg) tea.Cmd {
+	return func() tea.Msg {
+		if c == nil {
+			return nil
+		}
+		if err := sendFile(c, req); err != nil {
+			c.Send("upload_error", uploadErrorPayload{TransferID: req.TransferID, Message: err.Error()})
+			return logEntry{Time: "[ERR]", Message: fmt.Sprintf("Upload of %s to %s failed: %v", req.FileName, req.Requester, err)}
+		}
+		if err := c.Send("upload_done", uploadDonePayload{TransferID: req.TransferID}); err != nil {
+			return logEntry{Time: "[ERR]", Message: fmt.Sprintf("Upload of %s to %s failed: %v", req.FileName, req.Requester, err)}
+		}
+		return logEntry{Time: "[SYS]", Message: fmt.Sprintf("Sent %s to %s.", req.FileName, req.Requester)}
+	}
+}
+
+func sendFile(c *ChatClient, req uploadRequestMsg) error {
+	name := filepath.Base(req.FileName)
+	if name != req.FileName || name == "." || name == ".." {
+		return errors.New("file not found locally")
+	}
+	f, err := os.Open(filepath.Join(uploadsDir, name))
+	if err != nil {
+		return errors.New("file not found locally")
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return errors.New("folders cannot be downloaded")
+	}
+	if req.Offset < 0 || req.Offset > info.Size() {
+		return fmt.Errorf("cannot resume at byte %d, the file has changed", req.Offset)
+	}
+
+	ranges := transferRanges(req.Offset, info.Size())
+	return runStreams(c, req.TransferID, ranges, nil, func(i int, s *dataStream) error {
+		r := ranges[i]
+		if _, err := io.Copy(s.stdin, io.NewSectionReader(f, r.Start, r.End-r.Start)); err != nil {
+			return err
+		}
+		// The relay closes the stream once the requester has it all
+		s.stdin.Close()
+		_, err := io.Copy(io.Discard, s.stdout)
+		return err
+	})
+}
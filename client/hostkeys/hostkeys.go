@@ -0,0 +1,177 @@
+// Package hostkeys pins relay host keys on first use, in
+// ~/.rosewire_known_hosts. The file uses the OpenSSH known_hosts format, so
+// ssh-keygen -R and friends work on it.
+package hostkeys
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const fileName = ".rosewire_known_hosts"
+
+// UnknownHostError means the relay is not in the known hosts file yet. The
+// user should be shown Fingerprint and asked whether to Trust it.
+type UnknownHostError struct {
+	Host string
+	Key  ssh.PublicKey
+}
+
+func (e *UnknownHostError) Error() string {
+	return fmt.Sprintf("unknown relay %s with host key %s", e.Host, e.Fingerprint())
+}
+
+// Fingerprint is the key's SHA256 fingerprint, as ssh-keygen -l shows it.
+func (e *UnknownHostError) Fingerprint() string {
+	return ssh.FingerprintSHA256(e.Key)
+}
+
+// ChangedHostError means the relay presented a different key from the one
+// of that type pinned for it. Either the relay's key was replaced or someone is in the
+// middle, so the connection is refused.
+type ChangedHostError struct {
+	Host string
+	Key  ssh.PublicKey
+	Want knownhosts.KnownKey
+}
+
+func (e *ChangedHostError) Error() string {
+	return fmt.Sprintf("the host key of relay %s has changed: it presented %s but %s:%d pins %s. "+
+		"Someone may be intercepting the connection. If the relay's operator confirms the key was replaced, "+
+		"delete that line and connect again",
+		e.Host, ssh.FingerprintSHA256(e.Key), e.Want.Filename, e.Want.Line, ssh.FingerprintSHA256(e.Want.Key))
+}
+
+// Path returns where the known hosts file lives.
+func Path() (string, error) {
+	usr, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(usr.HomeDir, fileName), nil
+}
+
+// Callback checks relays against the known hosts file, failing with
+// *UnknownHostError or *ChangedHostError when it cannot vouch for one.
+func Callback() (ssh.HostKeyCallback, error) {
+	path, err := Path()
+	if err != nil {
+		return nil, err
+	}
+	return callback(path)
+}
+
+func callback(path string) (ssh.HostKeyCallback, error) {
+	check, err := load(path)
+	if err != nil {
+		return nil, err
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := check(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) {
+			return err
+		}
+		// A key of a type not pinned yet is new rather than changed
+		for _, want := range keyErr.Want {
+			if want.Key.Type() == key.Type() {
+				return &ChangedHostError{Host: hostname, Key: key, Want: want}
+			}
+		}
+		return &UnknownHostError{Host: hostname, Key: key}
+	}, nil
+}
+
+// Algorithms returns the host key algorithms to offer host, those of the
+// keys pinned for it first. The relay may have several host keys; without
+// this it could present one of a type not pinned yet.
+func Algorithms(host string) ([]string, error) {
+	path, err := Path()
+	if err != nil {
+		return nil, err
+	}
+	return algorithms(path, host)
+}
+
+func algorithms(path, host string) ([]string, error) {
+	check, err := load(path)
+	if err != nil {
+		return nil, err
+	}
+	// Checking a key nobody has lists the keys pinned for host
+	var keyErr *knownhosts.KeyError
+	if err := check(host, &net.TCPAddr{}, noKey); !errors.As(err, &keyErr) || len(keyErr.Want) == 0 {
+		return nil, nil
+	}
+	var pinned []string
+	for _, want := range keyErr.Want {
+		for _, algo := range keyAlgorithms(want.Key.Type()) {
+			if !slices.Contains(pinned, algo) {
+				pinned = append(pinned, algo)
+			}
+		}
+	}
+	algos := pinned
+	for _, algo := range ssh.SupportedAlgorithms().HostKeys {
+		if !slices.Contains(algos, algo) {
+			algos = append(algos, algo)
+		}
+	}
+	return algos, nil
+}
+
+// noKey is an all-zero ed25519 key, which no relay has.
+var noKey, _ = ssh.NewPublicKey(ed25519.PublicKey(make([]byte, ed25519.PublicKeySize)))
+
+// keyAlgorithms lists the algorithms that can use a key of keyType.
+func keyAlgorithms(keyType string) []string {
+	if keyType == ssh.KeyAlgoRSA {
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	}
+	return []string{keyType}
+}
+
+// load reads the known hosts file at path, creating it if need be.
+func load(path string) (ssh.HostKeyCallback, error) {
+	// knownhosts needs the file to exist
+	f, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	check, err := knownhosts.New(path)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+	return check, nil
+}
+
+// Trust pins key for host by adding it to the known hosts file.
+func Trust(host string, key ssh.PublicKey) error {
+	path, err := Path()
+	if err != nil {
+		return err
+	}
+	return trust(path, host, key)
+}
+
+func trust(path, host string, key ssh.PublicKey) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(f, knownhosts.Line([]string{knownhosts.Normalize(host)}, key)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,153 @@
+package hostkeys
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func newSigner(t *testing.T, key crypto.Signer) ssh.Signer {
+	t.Helper()
+	signer, err := ssh.NewSignerFromSigner(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// serveHandshakes accepts SSH connections presenting hostKeys until the
+// test ends, and returns the address to dial.
+func serveHandshakes(t *testing.T, hostKeys ...ssh.Signer) string {
+	t.Helper()
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	for _, key := range hostKeys {
+		config.AddHostKey(key)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if sshConn, _, _, err := ssh.NewServerConn(conn, config); err == nil {
+					sshConn.Close()
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestRelayWithSeveralHostKeys(t *testing.T) {
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	_, otherEdKey, _ := ed25519.GenerateKey(rand.Reader)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed, otherEd, ec := newSigner(t, edKey), newSigner(t, otherEdKey), newSigner(t, ecKey)
+	// The ECDSA key comes first in Go's default preference
+	addr := serveHandshakes(t, ed, ec)
+
+	tests := []struct {
+		name        string
+		pinned      []ssh.PublicKey
+		defaultAlgs bool // offer Go's default host key algorithms
+		wantErr     any
+	}{
+		{name: "pinned ed25519", pinned: []ssh.PublicKey{ed.PublicKey()}},
+		{name: "pinned ecdsa", pinned: []ssh.PublicKey{ec.PublicKey()}},
+		{name: "pinned both", pinned: []ssh.PublicKey{ec.PublicKey(), ed.PublicKey()}},
+		{name: "not pinned", wantErr: new(*UnknownHostError)},
+		{name: "other type presented", pinned: []ssh.PublicKey{ed.PublicKey()}, defaultAlgs: true, wantErr: new(*UnknownHostError)},
+		{name: "pinned key replaced", pinned: []ssh.PublicKey{otherEd.PublicKey()}, wantErr: new(*ChangedHostError)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "known_hosts")
+			for _, key := range tt.pinned {
+				if err := trust(path, addr, key); err != nil {
+					t.Fatal(err)
+				}
+			}
+			check, err := callback(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var algos []string
+			if !tt.defaultAlgs {
+				if algos, err = algorithms(path, addr); err != nil {
+					t.Fatal(err)
+				}
+			}
+			client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+				User:              "ana",
+				HostKeyCallback:   check,
+				HostKeyAlgorithms: algos,
+				Timeout:           4 * time.Second,
+			})
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatalf("Dial = %v, want success", err)
+				}
+				client.Close()
+				return
+			}
+			if !errors.As(err, tt.wantErr) {
+				t.Fatalf("Dial = %v, want %T", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAlgorithmsNotPinned(t *testing.T) {
+	algos, err := algorithms(filepath.Join(t.TempDir(), "known_hosts"), "relay.example:2222")
+	if err != nil || algos != nil {
+		t.Errorf("algorithms = %v, %v; want nil, nil so Go's defaults apply", algos, err)
+	}
+}
+
+func TestAlgorithmsRSA(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := trust(path, "relay.example:2222", key); err != nil {
+		t.Fatal(err)
+	}
+	algos, err := algorithms(path, "relay.example:2222")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	if len(algos) < len(want) {
+		t.Fatalf("algorithms = %v, want %v first", algos, want)
+	}
+	for i, algo := range want {
+		if algos[i] != algo {
+			t.Fatalf("algorithms = %v, want %v first", algos, want)
+		}
+	}
+}
@@ -10,6 +10,11 @@ import (
 	"path/filepath"
 	"strings"
 	"time"
+	"unicode/utf8"
+
+	"rosewire/config"
+	"rosewire/hostkeys"
+	"rosewire/sshkey"
 
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
@@ -25,6 +30,8 @@ const (
 	stepCreateKey
 	stepEnterNickname
 	stepConnecting
+	stepTrustHost
+	stepEnterInvite
 	stepDone
 )
 
@@ -36,6 +43,7 @@ const (
 	focusCreate
 	focusKeyList
 	focusNickname
+	focusInvite
 	focusDone
 )
 
@@ -54,8 +62,7 @@ var (
 )
 
 const (
-	configPathDefault = ".rosewire_client"
-	relayAddrDefault  = "127.0.0.1:2222"
+	relayAddrDefault = "127.0.0.1:2222"
 )
 
 type Model struct {
@@ -76,6 +83,12 @@ type Model struct {
 	Nickname      string
 	NicknameInput bool
 
+	// Host key waiting for the user to trust it
+	trustHost *unknownHostMsg
+
+	// Invite code for registering on an invite-only relay
+	InviteCode string
+
 	// Auto-login state
 	autoLoginTried bool
 	// Remembered username/key
@@ -110,38 +123,25 @@ func findSSHKeys() []string {
 
 // Loads stored nickname/key path from ~/.rosewire_client (if present and valid)
 func tryAutoLogin() (nickname, keypath string, err error) {
-	usr, err := user.Current()
-	if err != nil {
-		return "", "", err
-	}
-	cfg := filepath.Join(usr.HomeDir, configPathDefault)
-	data, err := os.ReadFile(cfg)
+	cfg, err := config.Load()
 	if err != nil {
 		return "", "", err
 	}
-	lines := strings.Split(string(data), "\n")
-	if len(lines) < 2 {
-		return "", "", errors.New("incomplete rosewire config")
-	}
-	nick := strings.TrimSpace(lines[0])
-	keypath = strings.TrimSpace(lines[1])
-	if nick == "" || keypath == "" {
+	if cfg.Nickname == "" || cfg.KeyPath == "" {
 		return "", "", errors.New("rosewire config missing nickname/key")
 	}
-	if _, err := os.Stat(keypath); err != nil {
-		return "", "", errors.New("key file missing: " + keypath)
+	if _, err := os.Stat(cfg.KeyPath); err != nil {
+		return "", "", errors.New("key file missing: " + cfg.KeyPath)
 	}
-	return nick, keypath, nil
+	return cfg.Nickname, cfg.KeyPath, nil
 }
 
+// saveLogin remembers the nickname and key, keeping any other settings.
 func saveLogin(nickname, keypath string) error {
-	usr, err := user.Current()
-	if err != nil {
-		return err
-	}
-	cfg := filepath.Join(usr.HomeDir, configPathDefault)
-	content := fmt.Sprintf("%s\n%s\n", nickname, keypath)
-	return os.WriteFile(cfg, []byte(content), 0600)
+	cfg, _ := config.Load()
+	cfg.Nickname = nickname
+	cfg.KeyPath = keypath
+	return cfg.Save()
 }
 
 func (m Model) Init() tea.Cmd {
@@ -157,10 +157,26 @@ func (m Model) Init() tea.Cmd {
 type sshKeysMsg []string
 type createKeyMsg string
 
-type tryLoginMsg struct{ Nickname, KeyPath string }
+type tryLoginMsg struct{ Nickname, KeyPath, Invite string }
 type loginResultMsg struct{ Success bool; Err string }
 type autoLoginCandidateMsg struct{ Nickname, KeyPath string }
 
+// unknownHostMsg asks the user whether to trust a relay seen for the
+// first time before logging in to it.
+type unknownHostMsg struct {
+	Nickname, KeyPath, Invite string
+	Host                      string
+	Key                       ssh.PublicKey
+}
+
+// needInviteMsg means the relay is invite-only and the nickname is new, so
+// the user must enter an invite code.
+type needInviteMsg struct{ Nickname, KeyPath string }
+
+// errNeedInvite stops a login the relay asked an invite code for when we
+// have none yet.
+var errNeedInvite = errors.New("invite code needed")
+
 func createSSHKeyCmd() tea.Cmd {
 	return func() tea.Msg {
 		usr, _ := user.Current()
@@ -178,28 +194,67 @@ func createSSHKeyCmd() tea.Cmd {
 	}
 }
 
-func tryLoginCmd(nickname, pubkeypath string) tea.Cmd {
+// tryLoginCmd logs in to the relay to check the nickname and key work,
+// registering the nickname with invite if the relay asks for a code.
+func tryLoginCmd(nickname, pubkeypath, invite string) tea.Cmd {
 	return func() tea.Msg {
-		// Guess private key path for pubkey (strip .pub)
-		priv := strings.TrimSuffix(pubkeypath, ".pub")
-		key, err := os.ReadFile(priv)
+		signers, err := sshkey.Signers(pubkeypath)
+		if err != nil {
+			return loginResultMsg{false, "Cannot load your key: " + err.Error()}
+		}
+		hostKeyCallback, err := hostkeys.Callback()
 		if err != nil {
-			return loginResultMsg{false, "Failed to read private key: " + err.Error()}
+			return loginResultMsg{false, "Cannot read known hosts: " + err.Error()}
 		}
-		signer, err := ssh.ParsePrivateKey(key)
+		hostKeyAlgorithms, err := hostkeys.Algorithms(relayAddrDefault)
 		if err != nil {
-			return loginResultMsg{false, "Invalid private key: " + err.Error()}
+			return loginResultMsg{false, "Cannot read known hosts: " + err.Error()}
 		}
 		config := &ssh.ClientConfig{
 			User: nickname,
 			Auth: []ssh.AuthMethod{
-				ssh.PublicKeys(signer),
+				ssh.PublicKeys(signers...),
+				// Invite-only relays ask new nicknames for a code
+				ssh.KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+					if len(questions) == 0 {
+						return nil, nil
+					}
+					if invite == "" {
+						return nil, errNeedInvite
+					}
+					answers := make([]string, len(questions))
+					for i := range answers {
+						answers[i] = invite
+					}
+					return answers, nil
+				}),
 			},
-			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-			Timeout:         4 * time.Second,
+			HostKeyCallback:   hostKeyCallback,
+			HostKeyAlgorithms: hostKeyAlgorithms,
+			Timeout:           4 * time.Second,
+		}
+		// The relay explains refusals such as bans in a banner
+		var banner string
+		config.BannerCallback = func(message string) error {
+			banner = strings.TrimSpace(message)
+			return nil
 		}
 		client, err := ssh.Dial("tcp", relayAddrDefault, config)
 		if err != nil {
+			var unknown *hostkeys.UnknownHostError
+			if errors.As(err, &unknown) {
+				return unknownHostMsg{Nickname: nickname, KeyPath: pubkeypath, Invite: invite, Host: unknown.Host, Key: unknown.Key}
+			}
+			if errors.Is(err, errNeedInvite) {
+				return needInviteMsg{Nickname: nickname, KeyPath: pubkeypath}
+			}
+			var changed *hostkeys.ChangedHostError
+			if errors.As(err, &changed) {
+				return loginResultMsg{false, changed.Error()}
+			}
+			if banner != "" {
+				return loginResultMsg{false, banner}
+			}
 			return loginResultMsg{false, "SSH login failed: " + err.Error()}
 		}
 		defer client.Close()
@@ -224,6 +279,16 @@ func tryLoginCmd(nickname, pubkeypath string) tea.Cmd {
 	}
 }
 
+// trustHostCmd pins the relay's host key and retries the login.
+func trustHostCmd(h unknownHostMsg) tea.Cmd {
+	return func() tea.Msg {
+		if err := hostkeys.Trust(h.Host, h.Key); err != nil {
+			return loginResultMsg{false, "Could not save host key: " + err.Error()}
+		}
+		return tryLoginMsg{Nickname: h.Nickname, KeyPath: h.KeyPath, Invite: h.Invite}
+	}
+}
+
 func (m Model) Update(msg tea.Msg) (Model, tea.Cmd) {
 	switch msg := msg.(type) {
 	case sshKeysMsg:
@@ -248,12 +313,30 @@ func (m Model) Update(msg tea.Msg) (Model, tea.Cmd) {
 		m.Step = stepConnecting
 		m.Nickname = msg.Nickname
 		m.SelectedKey = msg.KeyPath
-		return m, tryLoginCmd(msg.Nickname, msg.KeyPath)
+		return m, tryLoginCmd(msg.Nickname, msg.KeyPath, msg.Invite)
+	case needInviteMsg:
+		m.Nickname = msg.Nickname
+		m.SelectedKey = msg.KeyPath
+		m.InviteCode = ""
+		m.Status = ""
+		m.Step = stepEnterInvite
+		m.Focus = focusInvite
+	case unknownHostMsg:
+		m.trustHost = &msg
+		m.Step = stepTrustHost
 	case loginResultMsg:
 		if msg.Success {
 			m.Step = stepDone
 			m.Done = true
 			m.Status = ""
+		} else if m.Focus == focusInvite {
+			m.Step = stepEnterInvite
+			m.Status = "Login failed: " + msg.Err
+		} else if m.Focus == focusNickname {
+			// Let the user pick another nickname, e.g. after the relay
+			// refused this one
+			m.Step = stepEnterNickname
+			m.Status = "Login failed: " + msg.Err
 		} else {
 			// Go back to menu, clear Remembered if that combo failed
 			if m.Step == stepConnecting && m.Focus == focusAutoLogin {
@@ -286,7 +369,7 @@ func (m Model) Update(msg tea.Msg) (Model, tea.Cmd) {
 			case "enter":
 				if m.Focus == focusAutoLogin && m.RememberedNickname != "" {
 					// Try auto-login with remembered combo
-					return m, tryLoginCmd(m.RememberedNickname, m.RememberedKeyPath)
+					return m, tryLoginCmd(m.RememberedNickname, m.RememberedKeyPath, "")
 				} else {
 					m.Step = stepChooseAction
 					m.Focus = focusExisting
@@ -354,18 +437,58 @@ func (m Model) Update(msg tea.Msg) (Model, tea.Cmd) {
 						m.Status = "Nickname required"
 					} else {
 						m.Step = stepConnecting
-						return m, tryLoginCmd(m.Nickname, m.SelectedKey)
+						return m, tryLoginCmd(m.Nickname, m.SelectedKey, "")
 					}
 				case "backspace":
 					if len(m.Nickname) > 0 {
-						m.Nickname = m.Nickname[:len(m.Nickname)-1]
+						_, size := utf8.DecodeLastRuneInString(m.Nickname)
+						m.Nickname = m.Nickname[:len(m.Nickname)-size]
 					}
+				case "esc":
+					m.Status = ""
+					m.Step = stepListKeys
+					m.Focus = focusKeyList
 				default:
 					if msg.Type == tea.KeyRunes {
 						m.Nickname += msg.String()
 					}
 				}
 			}
+		case stepEnterInvite:
+			switch msg.String() {
+			case "enter":
+				if strings.TrimSpace(m.InviteCode) == "" {
+					m.Status = "Invite code required"
+				} else {
+					m.Step = stepConnecting
+					return m, tryLoginCmd(m.Nickname, m.SelectedKey, strings.TrimSpace(m.InviteCode))
+				}
+			case "backspace":
+				if len(m.InviteCode) > 0 {
+					m.InviteCode = m.InviteCode[:len(m.InviteCode)-1]
+				}
+			case "esc":
+				m.Status = ""
+				m.Step = stepEnterNickname
+				m.Focus = focusNickname
+			default:
+				if msg.Type == tea.KeyRunes {
+					m.InviteCode += msg.String()
+				}
+			}
+		case stepTrustHost:
+			switch msg.String() {
+			case "y", "Y":
+				h := *m.trustHost
+				m.trustHost = nil
+				m.Step = stepConnecting
+				return m, trustHostCmd(h)
+			case "n", "N", "esc":
+				m.trustHost = nil
+				m.Step = stepChooseAutoOrNew
+				m.Status = "Login cancelled: the relay's host key was not trusted."
+				return m, m.Init()
+			}
 		case stepConnecting:
 			// Ignore keys
 		case stepDone:
@@ -439,12 +562,26 @@ func (m Model) View() string {
 			entry += "_"
 		}
 		card += focusedStyle.Render(entry) + "\n"
-		card += "\n[Enter] Continue"
+		card += "\n[Enter] Continue  [Esc] Back"
+		if m.Status != "" {
+			card += "\n" + lipgloss.NewStyle().Foreground(lipgloss.Color("210")).Render(m.Status)
+		}
+	case stepEnterInvite:
+		card = title + "\n\n" + fmt.Sprintf("This relay is invite-only. Enter an invite code to register %s:\n\n", m.Nickname)
+		card += focusedStyle.Render(m.InviteCode+"_") + "\n"
+		card += "\n[Enter] Continue  [Esc] Back"
 		if m.Status != "" {
 			card += "\n" + lipgloss.NewStyle().Foreground(lipgloss.Color("210")).Render(m.Status)
 		}
 	case stepConnecting:
 		card = title + "\n\n" + focusedStyle.Render(fmt.Sprintf("Logging in as %s...", m.Nickname))
+	case stepTrustHost:
+		h := m.trustHost
+		card = title + "\n\n" + fmt.Sprintf("First connection to the relay at %s.\n\n", h.Host)
+		card += "Its host key fingerprint is:\n\n"
+		card += focusedStyle.Render(ssh.FingerprintSHA256(h.Key)) + "\n\n"
+		card += normalStyle.Render("Check it with the relay's operator. Once trusted, RoseWire refuses to connect if it changes.") + "\n\n"
+		card += "Trust this relay? [Y]es  [N]o"
 	}
 
 	cardWidth := m.Width / 3
@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"os"
 
 	tea "github.com/charmbracelet/bubbletea"
@@ -53,15 +52,10 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				return m, tea.Quit
 			}
 
-			// Create and connect chat client
+			// Create the chat client; it connects, and reconnects, in the
+			// background and reports its state to the home screen
 			chatClient := home.NewChatClient(m.login.Nickname, m.login.SelectedKey, "127.0.0.1:2222")
-			go func() {
-				err := chatClient.Connect()
-				if err != nil {
-					// Log error; a more robust solution would use a tea.Msg to show in UI
-					log.Printf("Chat connection failed: %v", err)
-				}
-			}()
+			go chatClient.Run()
 
 			// Switch to home UI, passing the connected client
 			m.state = stateHome
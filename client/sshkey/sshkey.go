@@ -0,0 +1,47 @@
+// Package sshkey loads the key a user logs in with. Like OpenSSH, it also
+// offers a certificate sitting next to the key (id_ed25519-cert.pub for
+// id_ed25519) when there is one, for relays that trust a certificate
+// authority.
+package sshkey
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Signers loads the private key for the public key file pubPath. If it has
+// a certificate, that comes first and the plain key second, for relays
+// that do not take certificates.
+func Signers(pubPath string) ([]ssh.Signer, error) {
+	priv := strings.TrimSuffix(pubPath, ".pub")
+	key, err := os.ReadFile(priv)
+	if err != nil {
+		return nil, fmt.Errorf("read key: %w", err)
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("parse key: %w", err)
+	}
+	certData, err := os.ReadFile(priv + "-cert.pub")
+	if os.IsNotExist(err) {
+		return []ssh.Signer{signer}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("read certificate: %w", err)
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(certData)
+	if err != nil {
+		return nil, fmt.Errorf("parse certificate: %w", err)
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s-cert.pub is not a certificate", priv)
+	}
+	certSigner, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		return nil, fmt.Errorf("certificate does not match key: %w", err)
+	}
+	return []ssh.Signer{certSigner, signer}, nil
+}
@@ -124,6 +124,8 @@ class SshFileService {
     void _handleUploadRequest(Map<String, dynamic> payload) async {
         final transferID = payload['transferID'] as String;
         final filename = payload['fileName'] as String;
+        // Non-zero when the requester resumes a download: send from there on
+        final offset = payload['offset'] as int? ?? 0;
 
         try {
             if (_libraryPath == null) {
@@ -138,12 +140,18 @@ class SshFileService {
             }
 
             final fileSize = await file.length();
-            final partSize = (fileSize / _numStreams).ceil();
+            if (offset < 0 || offset > fileSize) {
+                _sendCommand('upload_error', {'transferID': transferID, 'message': "Cannot resume at byte $offset, the file has changed"});
+                return;
+            }
+            // Stream i carries the i-th of _numStreams equal parts of what is
+            // left; the requester splits it the same way
+            final partSize = ((fileSize - offset) / _numStreams).ceil();
             final uploadFutures = <Future>[];
 
             for (int i = 0; i < _numStreams; i++) {
-                final startByte = i * partSize;
-                final endByte = min((i + 1) * partSize, fileSize);
+                final startByte = min(offset + i * partSize, fileSize);
+                final endByte = min(startByte + partSize, fileSize);
                 if (startByte >= endByte) continue;
 
                 uploadFutures.add(() async {
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// A nickname can hold several keys, one per device. Keys are added and
+// removed from a session that is already logged in, so every change is
+// vouched for by a key the account trusts. Someone who has lost every key
+// asks an operator to /recover the account for a new one.
+
+// parseKeyLine reads a public key in authorized_keys form, as found in a
+// .pub file.
+func parseKeyLine(line string) (ssh.PublicKey, error) {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(strings.TrimSpace(line)))
+	if err != nil {
+		return nil, fmt.Errorf("not a public key: %w", err)
+	}
+	return key, nil
+}
+
+// keyInfos describes the keys on c's account.
+func (c *ChatClient) keyInfos() []KeyInfo {
+	var infos []KeyInfo
+	for _, keyStr := range c.hub.users.Keys(c.nickname) {
+		info := KeyInfo{Fingerprint: fingerprintFromStored(keyStr)}
+		if raw, err := base64.StdEncoding.DecodeString(keyStr); err == nil {
+			if key, err := ssh.ParsePublicKey(raw); err == nil {
+				info.Type = key.Type()
+			}
+		}
+		info.Current = info.Fingerprint == c.fingerprint
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// sendKeyList sends the account's keys to the client.
+func (c *ChatClient) sendKeyList() {
+	c.send("key_list", KeyListPayload{Keys: c.keyInfos()})
+}
+
+// addKey authorizes another key for c's nickname.
+func (c *ChatClient) addKey(line string) {
+	key, err := parseKeyLine(line)
+	if err != nil {
+		c.sendSystem("Cannot add key: " + err.Error())
+		return
+	}
+	if err := c.hub.users.AddKey(c.nickname, key); err != nil {
+		c.sendSystem("Cannot add key: " + err.Error())
+		return
+	}
+	fp := ssh.FingerprintSHA256(key)
+	c.log.Info("Added key", "fingerprint", fp)
+	c.sendSystem(fmt.Sprintf("Added key %s. It can now log in as %s.", fp, c.nickname))
+	c.sendKeyList()
+}
+
+// removeKey revokes one of c's keys, other than the one it is using.
+func (c *ChatClient) removeKey(fingerprint string) {
+	if fingerprint == c.fingerprint {
+		c.sendSystem("You are logged in with that key. Log in with another one to remove it.")
+		return
+	}
+	if err := c.hub.users.RemoveKey(c.nickname, fingerprint); err != nil {
+		c.sendSystem("Cannot remove key: " + err.Error())
+		return
+	}
+	c.log.Info("Removed key", "fingerprint", fingerprint)
+	c.sendSystem(fmt.Sprintf("Removed key %s.", fingerprint))
+	c.sendKeyList()
+}
+
+func cmdKeys(c *ChatClient, ctx commandContext) {
+	lines := []string{"Keys that can log in as " + c.nickname + ":"}
+	for _, k := range c.keyInfos() {
+		line := fmt.Sprintf("  %s %s", k.Fingerprint, k.Type)
+		if k.Current {
+			line += " (this session)"
+		}
+		lines = append(lines, line)
+	}
+	c.sendSystemLines(lines)
+}
+
+func cmdAddKey(c *ChatClient, ctx commandContext) {
+	c.addKey(ctx.rest(0))
+}
+
+func cmdDelKey(c *ChatClient, ctx commandContext) {
+	c.removeKey(ctx.Args[0])
+}
+
+// cmdRecover replaces every key on an account with a new one, for users
+// who have lost theirs. Any session using an old key is closed.
+func cmdRecover(c *ChatClient, ctx commandContext) {
+	target := ctx.Args[0]
+	key, err := parseKeyLine(ctx.rest(1))
+	if err != nil {
+		c.sendSystem("Cannot recover account: " + err.Error())
+		return
+	}
+	if err := c.hub.users.ResetKeys(target, key); err != nil {
+		c.sendSystem("Cannot recover account: " + err.Error())
+		return
+	}
+	fp := ssh.FingerprintSHA256(key)
+	logMod.Info("Reset account keys", "by", c.nickname, "target", target, "fingerprint", fp)
+	c.sendSystem(fmt.Sprintf("%s can now log in only with %s.", target, fp))
+	if victim, online := c.hub.client(target); online && victim.fingerprint != fp {
+		victim.disconnect(fmt.Sprintf("The keys on your account were reset by %s.", c.nickname))
+	}
+}
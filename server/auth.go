@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// RegistrationMode decides who may get an account on the relay.
+type RegistrationMode string
+
+const (
+	// registrationOpen lets any key claim a free nickname.
+	registrationOpen RegistrationMode = "open"
+	// registrationInvite asks new nicknames for an invite code from an
+	// operator. Existing accounts log in as before.
+	registrationInvite RegistrationMode = "invite"
+	// registrationAllowlist only lets in keys listed in the allowed keys
+	// file, or operators.
+	registrationAllowlist RegistrationMode = "allowlist"
+)
+
+// ParseRegistrationMode checks a -registration flag value.
+func ParseRegistrationMode(s string) (RegistrationMode, error) {
+	switch m := RegistrationMode(s); m {
+	case registrationOpen, registrationInvite, registrationAllowlist:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown registration mode %q (want %q, %q or %q)", s, registrationOpen, registrationInvite, registrationAllowlist)
+}
+
+// LoadAllowedKeys reads the allowlist, an authorized_keys style file, as a
+// set of fingerprints. A missing file allows nobody but operators.
+func LoadAllowedKeys(path string) (map[string]bool, error) {
+	return loadKeyFingerprints(path, "allowed")
+}
+
+// authenticator decides who may log in, as the SSH server's auth callbacks.
+type authenticator struct {
+	users   *Users
+	bans    *BanList
+	invites *InviteList
+	policy  atomic.Pointer[authPolicy] // replaced on reload
+}
+
+// authPolicy is the part of the authenticator read from config and key
+// files.
+type authPolicy struct {
+	operators map[string]bool
+	allowed   map[string]bool
+	mode      RegistrationMode
+	// See certs.go
+	userCAs   map[string]bool
+	revoked   *Revocations
+	certRoles map[string]string
+}
+
+// loadAuthPolicy reads the files cfg names. cfg must be valid.
+func loadAuthPolicy(cfg Config) (*authPolicy, error) {
+	p := &authPolicy{mode: cfg.Registration}
+	var err error
+	p.certRoles, _ = ParseCertRoles(cfg.CertRoles)
+	if p.operators, err = LoadOperators(cfg.Paths.Operators); err != nil {
+		return nil, fmt.Errorf("operators: %w", err)
+	}
+	if p.allowed, err = LoadAllowedKeys(cfg.Paths.AllowedKeys); err != nil {
+		return nil, fmt.Errorf("allowed keys: %w", err)
+	}
+	if p.userCAs, err = LoadUserCAs(cfg.Paths.UserCAKeys); err != nil {
+		return nil, fmt.Errorf("user CA keys: %w", err)
+	}
+	if p.revoked, err = LoadRevocations(cfg.Paths.RevokedCerts); err != nil {
+		return nil, fmt.Errorf("revoked certificates: %w", err)
+	}
+
+	logAuth.Info("Loaded operator keys", "count", len(p.operators))
+	if len(p.userCAs) > 0 {
+		logAuth.Info("Accepting user certificates", "ca_keys", len(p.userCAs))
+	}
+	if p.mode == registrationAllowlist {
+		logAuth.Info("Registration", "mode", p.mode, "allowed_keys", len(p.allowed))
+	} else {
+		logAuth.Info("Registration", "mode", p.mode)
+	}
+	return p, nil
+}
+
+// refuse fails authentication with a message the client shows the user.
+func refuse(meta ssh.ConnMetadata, fingerprint string, err error, message string) error {
+	logAuth.Info("Rejected login", "conn", connID(meta), "nick", meta.User(), "fingerprint", fingerprint, "remote", meta.RemoteAddr().String(), "reason", message)
+	// The banner reaches the client even though auth fails
+	return &ssh.BannerError{Err: err, Message: message + "\n"}
+}
+
+// publicKey is the PublicKeyCallback. A new nickname on an invite-only
+// relay only gets partway: the client must then answer a keyboard-
+// interactive prompt with an invite code. Certificates are vouched for by
+// their CA, so registration modes do not apply to them.
+func (a *authenticator) publicKey(meta ssh.ConnMetadata, pubKey ssh.PublicKey) (*ssh.Permissions, error) {
+	nick := meta.User()
+	if nick == "" {
+		return nil, fmt.Errorf("nickname missing")
+	}
+	if cert, ok := pubKey.(*ssh.Certificate); ok {
+		return a.certificate(meta, cert)
+	}
+	fingerprint := ssh.FingerprintSHA256(pubKey)
+	if ban, banned := a.bans.Check(nick, fingerprint); banned {
+		return nil, refuse(meta, fingerprint, errors.New(ban.describe()), "You are "+ban.describe())
+	}
+	p := a.policy.Load()
+	if p.mode == registrationAllowlist && !p.allowed[fingerprint] && !p.operators[fingerprint] {
+		return nil, refuse(meta, fingerprint, errors.New("key not allowed"),
+			"This relay is private and your key is not on its allowlist. Ask an operator to add "+fingerprint+".")
+	}
+	registered, err := a.users.Authorize(nick, pubKey)
+	if err != nil {
+		return nil, a.nickRefusal(meta, fingerprint, err)
+	}
+	if !registered {
+		if p.mode == registrationInvite && !p.operators[fingerprint] {
+			return nil, &ssh.PartialSuccessError{Next: ssh.ServerAuthCallbacks{
+				KeyboardInteractiveCallback: func(meta ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+					return a.redeemInvite(meta, challenge, pubKey)
+				},
+			}}
+		}
+		if err := a.users.Register(nick, pubKey); err != nil {
+			return nil, a.nickRefusal(meta, fingerprint, err)
+		}
+		logAuth.Info("Registered nickname", "conn", connID(meta), "nick", nick, "fingerprint", fingerprint)
+	}
+	return a.permissions(nick, fingerprint), nil
+}
+
+// redeemInvite asks a new user for an invite code and registers their
+// nickname with it.
+func (a *authenticator) redeemInvite(meta ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge, pubKey ssh.PublicKey) (*ssh.Permissions, error) {
+	nick := meta.User()
+	fingerprint := ssh.FingerprintSHA256(pubKey)
+	answers, err := challenge("RoseWire", "This relay is invite-only. Enter the invite code an operator gave you to register "+nick+".",
+		[]string{"Invite code: "}, []bool{true})
+	if err != nil {
+		return nil, err
+	}
+	if len(answers) != 1 || answers[0] == "" {
+		return nil, refuse(meta, fingerprint, errBadInvite, "This relay is invite-only; registering needs an invite code.")
+	}
+	inv, err := a.invites.Redeem(answers[0], func() error {
+		return a.users.Register(nick, pubKey)
+	})
+	if err != nil {
+		if errors.Is(err, errBadInvite) {
+			return nil, refuse(meta, fingerprint, err, err.Error())
+		}
+		return nil, a.nickRefusal(meta, fingerprint, err)
+	}
+	logAuth.Info("Registered nickname with an invite", "conn", connID(meta), "nick", nick, "fingerprint", fingerprint, "invited_by", inv.By)
+	return a.permissions(nick, fingerprint), nil
+}
+
+// nickRefusal shows the user why their nickname was refused, or hides a
+// store error behind a plain failure.
+func (a *authenticator) nickRefusal(meta ssh.ConnMetadata, fingerprint string, err error) error {
+	var nickErr *NickError
+	if !errors.As(err, &nickErr) {
+		logAuth.Error("Failed to check login", "conn", connID(meta), "nick", meta.User(), "err", err)
+		return err
+	}
+	return refuse(meta, fingerprint, err, nickErr.Reason)
+}
+
+// permissions carries who the user is into the session handlers.
+func (a *authenticator) permissions(nick, fingerprint string) *ssh.Permissions {
+	extensions := map[string]string{
+		"nickname":    nick,
+		"fingerprint": fingerprint,
+	}
+	if rec, _ := a.users.Lookup(nick); a.policy.Load().operators[fingerprint] || rec.HasRole(roleOperator) {
+		extensions["role"] = roleOperator
+	}
+	return &ssh.Permissions{Extensions: extensions}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Users can log in with an OpenSSH user certificate signed by one of the
+// CA keys in the user CA file. The nickname must be one of the
+// certificate's principals, and the certificate must be within its
+// validity window and not revoked. Nothing about the key is stored: the CA
+// vouches for it every time.
+
+// defaultCertRoles maps the certificate extension an operator's
+// certificate carries, as in ssh-keygen -O extension:operator@rosewire.
+const defaultCertRoles = "operator@rosewire=" + roleOperator
+
+// ParseCertRoles reads a -cert-roles flag value, a comma-separated list of
+// extension=role, into a map from extension to role.
+func ParseCertRoles(s string) (map[string]string, error) {
+	roles := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		ext, role, ok := strings.Cut(pair, "=")
+		if !ok || ext == "" {
+			return nil, fmt.Errorf("bad certificate role mapping %q (want extension=role)", pair)
+		}
+		if role != roleOperator {
+			return nil, fmt.Errorf("unknown role %q in certificate role mapping", role)
+		}
+		roles[ext] = role
+	}
+	return roles, nil
+}
+
+// LoadUserCAs reads the CA keys trusted to sign user certificates, an
+// authorized_keys style file, as a set of fingerprints. A missing file
+// means certificates are not accepted.
+func LoadUserCAs(path string) (map[string]bool, error) {
+	return loadKeyFingerprints(path, "user CA")
+}
+
+// Revocations lists certificates that must no longer be accepted even
+// though they have not expired. The file has one entry per line:
+//
+//	serial 42                    a certificate serial number
+//	id alice@laptop              a certificate key ID
+//	key SHA256:...               the fingerprint of a certified key
+type Revocations struct {
+	serials map[uint64]bool
+	ids     map[string]bool
+	keys    map[string]bool
+}
+
+// LoadRevocations reads the revocation list. A missing file revokes
+// nothing.
+func LoadRevocations(path string) (*Revocations, error) {
+	r := &Revocations{
+		serials: make(map[uint64]bool),
+		ids:     make(map[string]bool),
+		keys:    make(map[string]bool),
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return r, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kind, value, _ := strings.Cut(line, " ")
+		value = strings.TrimSpace(value)
+		switch kind {
+		case "serial":
+			serial, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: bad serial %q", path, n, value)
+			}
+			r.serials[serial] = true
+		case "id":
+			r.ids[value] = true
+		case "key":
+			r.keys[value] = true
+		default:
+			return nil, fmt.Errorf("%s:%d: want \"serial\", \"id\" or \"key\", not %q", path, n, kind)
+		}
+	}
+	return r, scanner.Err()
+}
+
+// Revoked reports whether cert is on the list.
+func (r *Revocations) Revoked(cert *ssh.Certificate) bool {
+	return r.serials[cert.Serial] || r.ids[cert.KeyId] || r.keys[ssh.FingerprintSHA256(cert.Key)]
+}
+
+// certificate authenticates a login with a user certificate.
+func (a *authenticator) certificate(meta ssh.ConnMetadata, cert *ssh.Certificate) (*ssh.Permissions, error) {
+	nick := meta.User()
+	fingerprint := ssh.FingerprintSHA256(cert.Key)
+	p := a.policy.Load()
+	if len(p.userCAs) == 0 {
+		// The client may offer the plain key next
+		return nil, errors.New("certificates not accepted")
+	}
+	if ban, banned := a.bans.Check(nick, fingerprint); banned {
+		return nil, refuse(meta, fingerprint, errors.New(ban.describe()), "You are "+ban.describe())
+	}
+	if len(cert.ValidPrincipals) == 0 {
+		// It would let its holder pick any nickname
+		return nil, refuse(meta, fingerprint, errors.New("no principals"), "Your certificate names no principals, so it cannot be used here.")
+	}
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return p.userCAs[ssh.FingerprintSHA256(auth)]
+		},
+		IsRevoked: p.revoked.Revoked,
+	}
+	if _, err := checker.Authenticate(meta, cert); err != nil {
+		return nil, refuse(meta, fingerprint, err, "Your certificate was not accepted: "+strings.TrimPrefix(err.Error(), "ssh: ")+".")
+	}
+	if err := a.users.Certify(nick); err != nil {
+		return nil, a.nickRefusal(meta, fingerprint, err)
+	}
+	logAuth.Info("Certificate login", "conn", connID(meta), "nick", nick, "key_id", cert.KeyId, "serial", cert.Serial, "remote", meta.RemoteAddr().String())
+
+	perms := a.permissions(nick, fingerprint)
+	for ext, role := range p.certRoles {
+		if _, ok := cert.Extensions[ext]; ok {
+			perms.Extensions["role"] = role
+		}
+	}
+	// Lets the SSH server enforce source-address
+	perms.CriticalOptions = cert.CriticalOptions
+	return perms, nil
+}
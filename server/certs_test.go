@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// testConnMeta is the ssh.ConnMetadata of a login as user.
+type testConnMeta struct {
+	user string
+}
+
+func (m testConnMeta) User() string          { return m.user }
+func (m testConnMeta) SessionID() []byte     { return []byte("test-session") }
+func (m testConnMeta) ClientVersion() []byte { return []byte("SSH-2.0-test") }
+func (m testConnMeta) ServerVersion() []byte { return []byte("SSH-2.0-rosewire") }
+func (m testConnMeta) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50000}
+}
+func (m testConnMeta) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2222}
+}
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// newTestAuthenticator returns an authenticator with policy and an empty
+// user store of its own.
+func newTestAuthenticator(t *testing.T, policy *authPolicy) *authenticator {
+	t.Helper()
+	dir := t.TempDir()
+	store, err := OpenBoltUserStore(filepath.Join(dir, "users.db"), filepath.Join(dir, "nicks.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	nickPolicy, err := LoadNickPolicy(filepath.Join(dir, "reserved_nicks"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bans, err := LoadBanList(filepath.Join(dir, "bans.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &authenticator{users: NewUsers(store, nickPolicy), bans: bans}
+	a.policy.Store(policy)
+	return a
+}
+
+func TestAuthenticatorCertificate(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestSigner(t)
+	otherCA := newTestSigner(t)
+	revokedKey := newTestSigner(t)
+
+	revoked, err := LoadRevocations(writeFile(t, dir, "revoked_certs",
+		"# lost laptops",
+		"serial 13",
+		"id ana@stolen",
+		"key "+ssh.FingerprintSHA256(revokedKey.PublicKey()),
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := &authPolicy{
+		userCAs:   map[string]bool{ssh.FingerprintSHA256(ca.PublicKey()): true},
+		revoked:   revoked,
+		certRoles: map[string]string{"operator@rosewire": roleOperator},
+	}
+
+	now := time.Now()
+	tests := []struct {
+		name     string
+		user     string
+		edit     func(cert *ssh.Certificate)
+		signer   ssh.Signer // the CA; nil for the trusted one
+		wantErr  bool
+		wantRole string
+	}{
+		{name: "valid", user: "ana"},
+		{name: "second principal", user: "anita"},
+		{name: "operator extension", user: "ana", wantRole: roleOperator, edit: func(cert *ssh.Certificate) {
+			cert.Extensions["operator@rosewire"] = ""
+		}},
+		{name: "other extension", user: "ana", edit: func(cert *ssh.Certificate) {
+			cert.Extensions["permit-pty"] = ""
+		}},
+		{name: "principal does not match", user: "bob", wantErr: true},
+		{name: "no principals", user: "ana", wantErr: true, edit: func(cert *ssh.Certificate) {
+			cert.ValidPrincipals = nil
+		}},
+		{name: "expired", user: "ana", wantErr: true, edit: func(cert *ssh.Certificate) {
+			cert.ValidAfter = uint64(now.Add(-2 * time.Hour).Unix())
+			cert.ValidBefore = uint64(now.Add(-time.Hour).Unix())
+		}},
+		{name: "not yet valid", user: "ana", wantErr: true, edit: func(cert *ssh.Certificate) {
+			cert.ValidAfter = uint64(now.Add(time.Hour).Unix())
+		}},
+		{name: "revoked serial", user: "ana", wantErr: true, edit: func(cert *ssh.Certificate) {
+			cert.Serial = 13
+		}},
+		{name: "revoked key ID", user: "ana", wantErr: true, edit: func(cert *ssh.Certificate) {
+			cert.KeyId = "ana@stolen"
+		}},
+		{name: "revoked key", user: "ana", wantErr: true, edit: func(cert *ssh.Certificate) {
+			cert.Key = revokedKey.PublicKey()
+		}},
+		{name: "untrusted CA", user: "ana", signer: otherCA, wantErr: true},
+		{name: "host certificate", user: "ana", wantErr: true, edit: func(cert *ssh.Certificate) {
+			cert.CertType = ssh.HostCert
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cert := &ssh.Certificate{
+				Key:             newTestSigner(t).PublicKey(),
+				Serial:          7,
+				CertType:        ssh.UserCert,
+				KeyId:           "ana@laptop",
+				ValidPrincipals: []string{"ana", "anita"},
+				ValidAfter:      uint64(now.Add(-time.Hour).Unix()),
+				ValidBefore:     uint64(now.Add(time.Hour).Unix()),
+				Permissions:     ssh.Permissions{Extensions: map[string]string{}},
+			}
+			if tt.edit != nil {
+				tt.edit(cert)
+			}
+			signer := tt.signer
+			if signer == nil {
+				signer = ca
+			}
+			if err := cert.SignCert(rand.Reader, signer); err != nil {
+				t.Fatal(err)
+			}
+
+			a := newTestAuthenticator(t, policy)
+			perms, err := a.certificate(testConnMeta{user: tt.user}, cert)
+			if tt.wantErr {
+				var banner *ssh.BannerError
+				if !errors.As(err, &banner) {
+					t.Fatalf("certificate = %v, want a refusal the user sees", err)
+				}
+				if a.users.Has(tt.user) {
+					t.Errorf("refused certificate registered %s", tt.user)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("certificate = %v, want success", err)
+			}
+			if got := perms.Extensions["nickname"]; got != tt.user {
+				t.Errorf("nickname = %q, want %q", got, tt.user)
+			}
+			if got := perms.Extensions["role"]; got != tt.wantRole {
+				t.Errorf("role = %q, want %q", got, tt.wantRole)
+			}
+			if !a.users.Has(tt.user) {
+				t.Errorf("%s not registered", tt.user)
+			}
+		})
+	}
+}
+
+func TestAuthenticatorCertificateNoCAs(t *testing.T) {
+	a := newTestAuthenticator(t, &authPolicy{})
+	cert := &ssh.Certificate{Key: newTestSigner(t).PublicKey(), CertType: ssh.UserCert, ValidPrincipals: []string{"ana"}}
+	_, err := a.certificate(testConnMeta{user: "ana"}, cert)
+	var banner *ssh.BannerError
+	if err == nil || errors.As(err, &banner) {
+		t.Errorf("certificate = %v, want a quiet refusal so the client can offer its plain key", err)
+	}
+}
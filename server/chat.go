@@ -6,9 +6,10 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/crypto/ssh"
@@ -16,37 +17,86 @@ import (
 
 // TransferInfo now represents the server's state for an active transfer.
 type TransferInfo struct {
-	ID       string
-	FileName string
-	Size     int64
-	FromUser string
-	ToUser   string
+	ID          string
+	FileName    string
+	Size        int64
+	FromUser    string
+	ToUser      string
+	FromSession uint64 // the sessions asked to send and to receive
+	ToSession   uint64
+	Paired      bool // a data stream has found its peer
 }
 
 type ChatHub struct {
 	mu             sync.Mutex
 	clients        map[string]*ChatClient
 	fileRegistry   *FileRegistry
+	users          *Users
+	mailbox        *Mailbox
+	history        *ChatHistory
+	bans           *BanList
+	invites        *InviteList
+	mutes          map[string]time.Time // nickname -> until, zero for indefinitely
+	rateStats      *RateLimitStats
+	settings       atomic.Pointer[Config] // replaced on reload
+	deliveryStats  DeliveryStats
+	rooms          map[string]*Room
 	transfers      map[string]*TransferInfo // Keyed by unique transfer ID
 	totalTransfers int                      // <-- Add this field for total transfer count
+	lastMessageID  atomic.Uint64
+	lastSession    atomic.Uint64
+	shuttingDown   atomic.Bool
 }
 
 type ChatClient struct {
+	session      uint64 // tells apart logins with the same nickname
 	nickname     string
+	fingerprint  string
+	operator     bool
+	conn         ssh.Conn
 	channel      ssh.Channel
-	outgoing     chan []byte // Changed to byte slice for JSON
+	controlOut   chan []byte // see delivery.go
+	chatOut      chan []byte
+	chatDrops    atomic.Int32 // chat lane messages missed in a row
+	lastHeard    atomic.Int64 // UnixNano of the last message from the client
 	done         chan struct{}
 	hub          *ChatHub
 	fileRegistry *FileRegistry
 	once         sync.Once
+	joinedAt     time.Time
+	flood        *floodGuard
+	log          *slog.Logger
+	ignoring     map[string]bool // nicknames whose chat we drop, guarded by hub.mu
+	// Presence, guarded by hub.mu
+	lastActive    time.Time
+	status        string
+	statusMessage string
 }
 
-func NewChatHub(registry *FileRegistry) *ChatHub {
-	return &ChatHub{
+func NewChatHub(registry *FileRegistry, users *Users, mailbox *Mailbox, history *ChatHistory, bans *BanList, invites *InviteList, cfg Config) *ChatHub {
+	hub := &ChatHub{
 		clients:      make(map[string]*ChatClient),
 		fileRegistry: registry,
-		transfers:    make(map[string]*TransferInfo), // Initialize the new transfers map
+		users:        users,
+		mailbox:      mailbox,
+		history:      history,
+		bans:         bans,
+		invites:      invites,
+		mutes:        make(map[string]time.Time),
+		rateStats:    NewRateLimitStats(),
+		rooms: map[string]*Room{
+			lobbyRoom: {Name: lobbyRoom, members: make(map[string]*ChatClient)},
+		},
+		transfers: make(map[string]*TransferInfo), // Initialize the new transfers map
 	}
+	hub.settings.Store(&cfg)
+	return hub
+}
+
+// config returns the current settings. Sessions read what they need as
+// they go, so a reload reaches them without a reconnect.
+func (hub *ChatHub) config() *Config {
+	return hub.settings.Load()
 }
 
 // Generates a new unique ID for a transfer.
@@ -58,30 +108,74 @@ func generateTransferID() (string, error) {
 	return hex.EncodeToString(bytes), nil
 }
 
-// Join now returns the client it creates.
-func (hub *ChatHub) Join(nickname string, channel ssh.Channel) *ChatClient {
+// Join returns the client it creates, or nil if the login was turned away
+// because the nickname is already online.
+func (hub *ChatHub) Join(conn *ssh.ServerConn, channel ssh.Channel) *ChatClient {
+	now := time.Now()
+	nickname := conn.Permissions.Extensions["nickname"]
+	cfg := hub.config()
+	session := hub.lastSession.Add(1)
 	client := &ChatClient{
+		session:      session,
 		nickname:     nickname,
+		fingerprint:  conn.Permissions.Extensions["fingerprint"],
+		operator:     conn.Permissions.Extensions["role"] == roleOperator,
+		conn:         conn,
 		channel:      channel,
-		outgoing:     make(chan []byte, 16),
+		controlOut:   make(chan []byte, cfg.Limits.ControlBuffer),
+		chatOut:      make(chan []byte, cfg.Limits.ChatBuffer),
 		done:         make(chan struct{}),
 		hub:          hub,
 		fileRegistry: hub.fileRegistry,
+		joinedAt:     now,
+		flood:        newFloodGuard(),
+		log:          logChat.With("conn", connID(conn), "nick", nickname, "session", session),
+		ignoring:     make(map[string]bool),
+		lastActive:   now,
+		status:       statusOnline,
 	}
 	hub.mu.Lock()
+	old, loggedIn := hub.clients[nickname]
+	if loggedIn && cfg.DuplicateLogin == duplicateReject {
+		hub.mu.Unlock()
+		client.log.Info("Rejected second login")
+		line, _ := json.Marshal(OutboundMessage{Type: "system_broadcast", Payload: hub.newChatPayload(now, "", "", "You are already logged in from another session.", true)})
+		channel.Write(append(line, '\n'))
+		channel.Close()
+		return nil
+	}
 	hub.clients[nickname] = client
+	hub.rooms[lobbyRoom].members[nickname] = client
 	hub.mu.Unlock()
+	hub.users.Seen(nickname)
+	if loggedIn {
+		client.log.Info("Logged in again, replacing the old session", "replaces", old.session)
+		go old.supersede(client)
+	}
 
+	client.heard()
 	go client.readLoop()
 	go client.writeLoop()
+	go client.pingLoop()
 
-	// Broadcast join message
-	joinMsg := ChatBroadcastPayload{
-		Timestamp: time.Now().Format("15:04"),
-		Text:      fmt.Sprintf("%s joined the chat.", nickname),
-		IsSystem:  true,
+	// Broadcast join message, unless they never looked gone
+	if !loggedIn {
+		joinMsg := hub.newChatPayload(time.Now(), "", "", fmt.Sprintf("%s joined the chat.", nickname), true)
+		hub.broadcast("system_broadcast", joinMsg, "")
+	}
+
+	// Give the newcomer the current peer list and tell everyone else about them
+	client.send("presence_list", PresenceListPayload{Users: hub.PresenceList(nickname)})
+	client.send("room_list", RoomListPayload{Rooms: hub.RoomList()})
+	client.sendCommandList()
+	client.sendHistory(lobbyRoom, time.Now(), historyBacklog)
+	client.sendMOTD()
+	hub.broadcastPresence("join", client)
+
+	// Hand over any private messages that arrived while they were away
+	for _, pm := range hub.mailbox.Take(nickname) {
+		client.send("private_message", pm)
 	}
-	hub.broadcast("system_broadcast", joinMsg, "")
 	return client
 }
 
@@ -89,14 +183,14 @@ func (c *ChatClient) Done() <-chan struct{} {
 	return c.done
 }
 
-// broadcast sends a structured message to clients.
+// broadcast sends a structured message to clients on the chat lane.
 func (hub *ChatHub) broadcast(msgType string, payload interface{}, from string) {
 	hub.mu.Lock()
 	defer hub.mu.Unlock()
 
 	msg, err := json.Marshal(OutboundMessage{Type: msgType, Payload: payload})
 	if err != nil {
-		log.Printf("Error marshalling broadcast message: %v", err)
+		logChat.Error("Failed to marshal broadcast", "type", msgType, "err", err)
 		return
 	}
 
@@ -104,52 +198,42 @@ func (hub *ChatHub) broadcast(msgType string, payload interface{}, from string)
 		if nick == from {
 			continue
 		}
-		select {
-		case client.outgoing <- msg:
-		default:
-		}
+		client.deliverChat(msg)
 	}
 }
 
-// unicast sends a structured message to a single client.
-func (hub *ChatHub) unicast(msgType string, payload interface{}, to string) bool {
+// unicast sends a structured message to a single client on the control
+// lane. It returns an error if the message could not be queued.
+func (hub *ChatHub) unicast(msgType string, payload interface{}, to string) error {
 	hub.mu.Lock()
-	defer hub.mu.Unlock()
 	client, ok := hub.clients[to]
+	hub.mu.Unlock()
 	if !ok {
-		log.Printf("unicast: target client '%s' not found for message type '%s'", to, msgType)
-		return false
+		logChat.Debug("Unicast target not online", "to", to, "type", msgType)
+		return errClientGone
 	}
 
 	msg, err := json.Marshal(OutboundMessage{Type: msgType, Payload: payload})
 	if err != nil {
-		log.Printf("Error marshalling unicast message: %v", err)
-		return false
+		logChat.Error("Failed to marshal unicast", "type", msgType, "err", err)
+		return err
 	}
 
-	select {
-	case client.outgoing <- msg:
-		log.Printf("unicast: sent message type '%s' to '%s'", msgType, to)
-		return true
-	default:
-		log.Printf("unicast: outgoing channel full for '%s', dropped message type '%s'", to, msgType)
-		return false
+	if err := client.deliverControl(msg); err != nil {
+		client.log.Warn("Could not deliver unicast", "type", msgType, "err", err)
+		return err
 	}
-}
-
-func (hub *ChatHub) part(nickname string) {
-	hub.mu.Lock()
-	defer hub.mu.Unlock()
-	delete(hub.clients, nickname)
+	client.log.Debug("Sent unicast", "type", msgType)
+	return nil
 }
 
 func (c *ChatClient) send(msgType string, payload interface{}) {
 	msg, err := json.Marshal(OutboundMessage{Type: msgType, Payload: payload})
 	if err != nil {
-		log.Printf("Error marshalling message for %s: %v", c.nickname, err)
+		c.log.Error("Failed to marshal message", "type", msgType, "err", err)
 		return
 	}
-	c.outgoing <- msg
+	c.deliverControl(msg)
 }
 
 func (c *ChatClient) readLoop() {
@@ -162,10 +246,22 @@ func (c *ChatClient) readLoop() {
 			continue
 		}
 		if err := json.Unmarshal(line, &msg); err != nil {
-			log.Printf("Error unmarshalling message from %s: %v", c.nickname, err)
+			c.log.Warn("Failed to unmarshal message", "err", err)
+			continue
+		}
+		c.heard()
+		if !c.allowMessage(msg.Type) {
+			c.rateLimited(msg)
 			continue
 		}
-		log.Printf("readLoop: received message type '%s' from %s", msg.Type, c.nickname)
+		if isKeepalive(msg.Type) {
+			if msg.Type == "ping" {
+				c.send("pong", msg.Payload)
+			}
+			continue
+		}
+		c.log.Debug("Received message", "type", msg.Type)
+		c.touch()
 		c.handleMessage(msg)
 	}
 }
@@ -176,6 +272,7 @@ func (c *ChatClient) handleMessage(msg InboundMessage) {
 		var p SharePayload
 		if err := json.Unmarshal(msg.Payload, &p); err == nil {
 			c.fileRegistry.UpdateUserFiles(c.nickname, p.Files)
+			c.hub.broadcastPresence("update", c)
 		}
 
 	case "search":
@@ -190,11 +287,11 @@ func (c *ChatClient) handleMessage(msg InboundMessage) {
 		c.send("search_results", SearchResultsPayload{Results: results})
 
 	case "get_stats":
-		c.hub.mu.Lock()
 		var users []map[string]string
-		for nick := range c.hub.clients {
-			users = append(users, map[string]string{"nickname": nick, "status": "Online"})
+		for _, p := range c.hub.PresenceList(c.nickname) {
+			users = append(users, map[string]string{"nickname": p.Nickname, "status": statusLabel(p.Status), "statusMessage": p.StatusMessage})
 		}
+		c.hub.mu.Lock()
 		activeTransfers := len(c.hub.transfers)
 		totalTransfers := c.hub.totalTransfers
 		c.hub.mu.Unlock()
@@ -208,36 +305,125 @@ func (c *ChatClient) handleMessage(msg InboundMessage) {
 		}
 		c.send("network_stats", stats)
 
+	case "set_status":
+		var p SetStatusPayload
+		if err := json.Unmarshal(msg.Payload, &p); err == nil {
+			c.setStatus(p.Status, p.Message)
+		}
+
+	case "get_presence":
+		c.send("presence_list", PresenceListPayload{Users: c.hub.PresenceList(c.nickname)})
+
 	case "get_file":
 		var p GetFilePayload
 		if err := json.Unmarshal(msg.Payload, &p); err == nil {
-			log.Printf("handleMessage: '%s' requested file '%s' from peer '%s'", c.nickname, p.FileName, p.Peer)
-			c.initiateFileTransfer(p.FileName, p.Peer)
+			c.initiateFileTransfer(p.FileName, p.Peer, p.Offset)
 		}
 
 	case "chat_message":
 		var p ChatMessagePayload
 		if err := json.Unmarshal(msg.Payload, &p); err == nil {
-			broadcastPayload := ChatBroadcastPayload{
-				Timestamp: time.Now().Format("15:04"),
-				Nickname:  c.nickname,
-				Text:      p.Text,
-				IsSystem:  false,
+			room := lobbyRoom
+			if p.Room != "" {
+				var err error
+				if room, err = normalizeRoomName(p.Room); err != nil {
+					c.sendSystem("Cannot send message: " + err.Error())
+					return
+				}
+			}
+			text := p.Text
+			if strings.HasPrefix(text, "/") {
+				// "//" escapes a message that really starts with a slash
+				if !strings.HasPrefix(text, "//") {
+					c.runCommand(room, text)
+					return
+				}
+				text = text[1:]
+			}
+			c.say(room, text, false)
+		}
+
+	case "chat_history":
+		var p ChatHistoryRequestPayload
+		if err := json.Unmarshal(msg.Payload, &p); err == nil {
+			room, err := normalizeRoomName(p.Room)
+			if err != nil || !c.hub.inRoom(room, c) {
+				c.sendSystem(fmt.Sprintf("You are not in #%s.", p.Room))
+				return
 			}
-			c.hub.broadcast("chat_broadcast", broadcastPayload, "")
+			before := time.Now()
+			if p.Before != "" {
+				if before, err = time.Parse(time.RFC3339Nano, p.Before); err != nil {
+					c.sendSystem("Bad history timestamp.")
+					return
+				}
+			}
+			c.sendHistory(room, before, p.Limit)
+		}
+
+	case "join_room":
+		var p RoomPayload
+		if err := json.Unmarshal(msg.Payload, &p); err == nil {
+			c.joinRoom(p.Room)
+		}
+
+	case "part_room":
+		var p RoomPayload
+		if err := json.Unmarshal(msg.Payload, &p); err == nil {
+			c.partRoom(p.Room)
+		}
+
+	case "list_rooms":
+		c.send("room_list", RoomListPayload{Rooms: c.hub.RoomList()})
+
+	case "set_topic":
+		var p SetTopicPayload
+		if err := json.Unmarshal(msg.Payload, &p); err == nil {
+			c.setTopic(p.Room, p.Topic)
+		}
+
+	case "list_keys":
+		c.sendKeyList()
+
+	case "add_key":
+		var p AddKeyPayload
+		if err := json.Unmarshal(msg.Payload, &p); err == nil {
+			c.addKey(p.PublicKey)
+		}
+
+	case "remove_key":
+		var p RemoveKeyPayload
+		if err := json.Unmarshal(msg.Payload, &p); err == nil {
+			c.removeKey(p.Fingerprint)
+		}
+
+	case "set_ignore_list":
+		var p IgnoreListPayload
+		if err := json.Unmarshal(msg.Payload, &p); err == nil {
+			c.setIgnoreList(p.Nicknames)
+		}
+
+	case "private_message":
+		var p PrivateMessagePayload
+		if err := json.Unmarshal(msg.Payload, &p); err == nil {
+			if c.hub.isMuted(c.nickname) {
+				c.sendSystem("You are muted and cannot talk right now.")
+				return
+			}
+			c.sendPrivateMessage(p.To, p.Text)
 		}
 
 	case "upload_data":
 		var p UploadDataPayload
 		if err := json.Unmarshal(msg.Payload, &p); err == nil {
-			log.Printf("handleMessage: got 'upload_data' from '%s' for transfer %s (data size: %d)", c.nickname, p.TransferID, len(p.Data))
+			c.transferLog(p.TransferID).Debug("Relaying upload data", "bytes", len(p.Data))
 			c.relayTransferMessage("upload_data", p, p.TransferID)
 		}
 
 	case "upload_done":
 		var p UploadDonePayload
 		if err := json.Unmarshal(msg.Payload, &p); err == nil {
-			log.Printf("handleMessage: got 'upload_done' from '%s' for transfer %s", c.nickname, p.TransferID)
+			c.transferLog(p.TransferID).Info("Upload finished")
 			c.relayTransferMessage("upload_done", p, p.TransferID)
 			c.hub.mu.Lock()
 			delete(c.hub.transfers, p.TransferID)
@@ -248,49 +434,151 @@ func (c *ChatClient) handleMessage(msg InboundMessage) {
 	case "upload_error":
 		var p UploadErrorPayload
 		if err := json.Unmarshal(msg.Payload, &p); err == nil {
-			log.Printf("handleMessage: got 'upload_error' from '%s' for transfer %s: %s", c.nickname, p.TransferID, p.Message)
-			c.relayTransferMessage("transfer_error", TransferErrorPayload(p), p.TransferID)
+			c.transferLog(p.TransferID).Info("Upload failed", "reason", p.Message)
+			c.relayTransferMessage("transfer_error", TransferErrorPayload{TransferID: p.TransferID, Message: p.Message}, p.TransferID)
 			c.hub.mu.Lock()
 			delete(c.hub.transfers, p.TransferID)
 			c.hub.mu.Unlock()
 		}
 
 	default:
-		log.Printf("Unknown message type '%s' from %s", msg.Type, c.nickname)
+		c.log.Warn("Unknown message type", "type", msg.Type)
 	}
 }
 
-func (c *ChatClient) initiateFileTransfer(filename, peer string) {
+// sendPrivateMessage routes text to a single user, storing it for later if
+// they are not connected. The sender gets the message echoed back.
+func (c *ChatClient) sendPrivateMessage(to, text string) {
+	to = strings.TrimSpace(to)
+	if strings.TrimSpace(text) == "" {
+		return
+	}
+	if to == c.nickname {
+		c.sendSystem("You cannot send a private message to yourself.")
+		return
+	}
+	if !c.hub.users.Has(to) {
+		c.sendSystem(fmt.Sprintf("No such user '%s'.", to))
+		return
+	}
+
+	pm := PrivateMessageDeliveryPayload{
+		ID:        c.hub.nextMessageID(),
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		From:      c.nickname,
+		To:        to,
+		Text:      text,
+	}
+	c.hub.mu.Lock()
+	recipient, online := c.hub.clients[to]
+	ignored := online && recipient.ignoring[c.nickname]
+	c.hub.mu.Unlock()
+	if ignored {
+		// Pretend it went through so ignoring someone is not revealed
+		c.send("private_message", pm)
+		return
+	}
+	if c.hub.unicast("private_message", pm, to) != nil {
+		if !c.hub.config().Features.OfflineMessages {
+			c.sendSystem(fmt.Sprintf("%s is not online.", to))
+			return
+		}
+		pm.Offline = true
+		if err := c.hub.mailbox.Store(pm); err != nil {
+			c.log.Warn("Could not store private message", "to", to, "err", err)
+			c.sendSystem(fmt.Sprintf("Could not deliver message to %s: %v", to, err))
+			return
+		}
+	}
+	c.send("private_message", pm)
+}
+
+// sendMOTD shows the message of the day, if there is one.
+func (c *ChatClient) sendMOTD() {
+	if motd := strings.TrimSpace(c.hub.config().MOTD); motd != "" {
+		c.sendSystemLines(strings.Split(motd, "\n"))
+	}
+}
+
+// sendSystem sends a system notice to this client only.
+func (c *ChatClient) sendSystem(text string) {
+	c.send("system_broadcast", c.hub.newChatPayload(time.Now(), "", "", text, true))
+}
+
+// nextMessageID returns a new message ID. IDs are seeded from the clock in
+// microseconds so they keep increasing across relay restarts.
+func (hub *ChatHub) nextMessageID() uint64 {
+	for {
+		last := hub.lastMessageID.Load()
+		next := uint64(time.Now().UnixMicro())
+		if next <= last {
+			next = last + 1
+		}
+		if hub.lastMessageID.CompareAndSwap(last, next) {
+			return next
+		}
+	}
+}
+
+// newChatPayload stamps a chat or system message with a fresh ID and a UTC
+// timestamp. An empty room means a network-wide notice.
+func (hub *ChatHub) newChatPayload(at time.Time, room, nickname, text string, isSystem bool) ChatBroadcastPayload {
+	return ChatBroadcastPayload{
+		ID:        hub.nextMessageID(),
+		Timestamp: at.UTC().Format(time.RFC3339),
+		Room:      room,
+		Nickname:  nickname,
+		Text:      text,
+		IsSystem:  isSystem,
+	}
+}
+
+// initiateFileTransfer asks peer to send filename to c, starting at offset
+// so that an interrupted download can be resumed.
+func (c *ChatClient) initiateFileTransfer(filename, peer string, offset int64) {
 	if peer == c.nickname {
-		c.send("transfer_error", TransferErrorPayload{Message: "You cannot download your own file."})
+		c.send("transfer_error", TransferErrorPayload{FileName: filename, Peer: peer, Message: "You cannot download your own file."})
+		return
+	}
+	if c.hub.shuttingDown.Load() {
+		c.send("transfer_error", TransferErrorPayload{FileName: filename, Peer: peer, Message: "The relay is shutting down; try again once it is back."})
 		return
 	}
 
 	fileInfo, found := c.fileRegistry.FindFile(filename, peer)
 	if !found {
-		c.send("transfer_error", TransferErrorPayload{Message: fmt.Sprintf("File not found or peer '%s' does not own it.", peer)})
+		c.send("transfer_error", TransferErrorPayload{FileName: filename, Peer: peer, Message: fmt.Sprintf("File not found or peer '%s' does not own it.", peer)})
+		return
+	}
+	if offset < 0 || (fileInfo.Size > 0 && offset > fileInfo.Size) {
+		c.send("transfer_error", TransferErrorPayload{FileName: filename, Peer: peer, Message: fmt.Sprintf("Cannot resume '%s' at byte %d.", filename, offset)})
 		return
 	}
 
 	transferID, err := generateTransferID()
 	if err != nil {
-		log.Printf("Failed to generate transfer ID: %v", err)
-		c.send("transfer_error", TransferErrorPayload{Message: "Server error creating transfer."})
+		c.log.Error("Failed to generate transfer ID", "err", err)
+		c.send("transfer_error", TransferErrorPayload{FileName: filename, Peer: peer, Message: "Server error creating transfer."})
 		return
 	}
 
 	transfer := &TransferInfo{
-		ID:       transferID,
-		FileName: filename,
-		Size:     fileInfo.Size,
-		FromUser: peer,
-		ToUser:   c.nickname,
+		ID:        transferID,
+		FileName:  filename,
+		Size:      fileInfo.Size,
+		FromUser:  peer,
+		ToUser:    c.nickname,
+		ToSession: c.session,
 	}
 	c.hub.mu.Lock()
+	if uploader, ok := c.hub.clients[peer]; ok {
+		transfer.FromSession = uploader.session
+	}
 	c.hub.transfers[transferID] = transfer
 	c.hub.mu.Unlock()
+	time.AfterFunc(dataStreamPairTimeout, func() { c.hub.expireTransfer(transferID) })
 
-	log.Printf("Transfer %s initiated: %s wants '%s' from %s", transferID, c.nickname, filename, peer)
+	c.transferLog(transferID).Info("Transfer requested", private("file", filename), "from", peer, "offset", offset)
 
 	// Tell the downloader the transfer is starting
 	c.send("transfer_start", TransferStartPayload{
@@ -298,14 +586,28 @@ func (c *ChatClient) initiateFileTransfer(filename, peer string) {
 		FileName:   filename,
 		Size:       fileInfo.Size,
 		FromUser:   peer,
+		Offset:     offset,
 	})
 
 	// Tell the uploader to start sending the file
-	ok := c.hub.unicast("upload_request", UploadRequestPayload{
+	err = c.hub.unicast("upload_request", UploadRequestPayload{
 		TransferID: transferID,
 		FileName:   filename,
+		Requester:  c.nickname,
+		Offset:     offset,
 	}, peer)
-	log.Printf("initiateFileTransfer: sent 'upload_request' to '%s' for transfer %s (ok=%v)", peer, transferID, ok)
+	if err != nil {
+		c.transferLog(transferID).Warn("Could not reach the uploader", "from", peer, "err", err)
+		c.hub.mu.Lock()
+		delete(c.hub.transfers, transferID)
+		c.hub.mu.Unlock()
+		c.send("transfer_error", TransferErrorPayload{TransferID: transferID, Message: fmt.Sprintf("Could not reach %s: %v", peer, err)})
+	}
+}
+
+// transferLog logs about transfer id on c's behalf.
+func (c *ChatClient) transferLog(id string) *slog.Logger {
+	return logTransfer.With("nick", c.nickname, "session", c.session, "transfer", id)
 }
 
 func (c *ChatClient) relayTransferMessage(msgType string, payload interface{}, transferID string) {
@@ -314,28 +616,88 @@ func (c *ChatClient) relayTransferMessage(msgType string, payload interface{}, t
 	c.hub.mu.Unlock()
 
 	if !ok {
-		log.Printf("SECURITY: Received data for unknown transfer ID '%s' from %s", transferID, c.nickname)
+		c.transferLog(transferID).Warn("Transfer message for an unknown transfer", "type", msgType)
 		return
 	}
 	if transfer.FromUser != c.nickname {
-		log.Printf("SECURITY: Mismatched user for transfer ID '%s'. Expected %s, got %s", transferID, transfer.FromUser, c.nickname)
+		c.transferLog(transferID).Warn("Transfer message from someone other than the uploader", "type", msgType, "uploader", transfer.FromUser)
 		return
 	}
 
-	okSend := c.hub.unicast(msgType, payload, transfer.ToUser)
-	log.Printf("relayTransferMessage: relayed '%s' for transfer %s from '%s' to '%s' (ok=%v)", msgType, transferID, c.nickname, transfer.ToUser, okSend)
+	err := c.hub.unicast(msgType, payload, transfer.ToUser)
+	if err != nil {
+		c.transferLog(transferID).Warn("Could not relay to the downloader", "type", msgType, "to", transfer.ToUser, "err", err)
+		// Stop the uploader rather than let it send into the void
+		c.hub.mu.Lock()
+		delete(c.hub.transfers, transferID)
+		c.hub.mu.Unlock()
+		c.send("transfer_error", TransferErrorPayload{TransferID: transferID, Message: fmt.Sprintf("Could not deliver to %s: %v", transfer.ToUser, err)})
+	}
+}
+
+// transferPaired notes that a data stream of transfer id found its peer.
+func (hub *ChatHub) transferPaired(id string) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if t, ok := hub.transfers[id]; ok {
+		t.Paired = true
+	}
+}
+
+// expireTransfer drops transfer id if none of its data streams paired in
+// time: the uploader never started sending.
+func (hub *ChatHub) expireTransfer(id string) {
+	hub.mu.Lock()
+	t, ok := hub.transfers[id]
+	stale := ok && !t.Paired
+	if stale {
+		delete(hub.transfers, id)
+	}
+	hub.mu.Unlock()
+	if !stale {
+		return
+	}
+	logTransfer.Info("Uploader never started sending, dropping transfer", "transfer", id, "from", t.FromUser, "to", t.ToUser)
+	hub.unicast("transfer_error", TransferErrorPayload{
+		TransferID: id,
+		FileName:   t.FileName,
+		Peer:       t.FromUser,
+		Message:    fmt.Sprintf("%s did not start sending %s.", t.FromUser, t.FileName),
+	}, t.ToUser)
+}
+
+// dropTransfers forgets the transfers c was asked to send or receive. Its
+// data streams go with its connection.
+func (hub *ChatHub) dropTransfers(c *ChatClient) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	for id, t := range hub.transfers {
+		if (t.FromUser == c.nickname && t.FromSession == c.session) || (t.ToUser == c.nickname && t.ToSession == c.session) {
+			delete(hub.transfers, id)
+		}
+	}
 }
 
 func (c *ChatClient) writeLoop() {
 	for {
+		// Control traffic always goes first
+		var msg []byte
 		select {
-		case msg := <-c.outgoing:
-			// Ensure message ends with a newline for the client scanner
-			if !strings.HasSuffix(string(msg), "\n") {
-				msg = append(msg, '\n')
+		case msg = <-c.controlOut:
+		default:
+			select {
+			case msg = <-c.controlOut:
+			case msg = <-c.chatOut:
+			case <-c.done:
+				return
 			}
-			c.channel.Write(msg)
-		case <-c.done:
+		}
+		// Ensure message ends with a newline for the client scanner
+		if !strings.HasSuffix(string(msg), "\n") {
+			msg = append(msg, '\n')
+		}
+		if _, err := c.channel.Write(msg); err != nil {
+			c.Close()
 			return
 		}
 	}
@@ -343,17 +705,32 @@ func (c *ChatClient) writeLoop() {
 
 func (c *ChatClient) Close() {
 	c.once.Do(func() {
-		c.fileRegistry.RemoveUser(c.nickname)
-		c.hub.part(c.nickname)
+		// A session replaced by a newer login leaves the nickname's files
+		// and presence to its successor
+		current := c.hub.part(c)
+		c.hub.dropTransfers(c)
+		if current {
+			c.fileRegistry.RemoveUser(c.nickname)
+			c.hub.users.Seen(c.nickname)
+		}
+		c.hub.leaveAllRooms(c)
 		close(c.done)
 		c.channel.Close()
-		log.Printf("%s left chat", c.nickname)
+		c.log.Info("Left chat")
+		if !current {
+			return
+		}
 
-		leaveMsg := ChatBroadcastPayload{
-			Timestamp: time.Now().Format("15:04"),
-			Text:      fmt.Sprintf("%s left the chat.", c.nickname),
-			IsSystem:  true,
+		// Invisible users already looked gone to everyone else
+		c.hub.mu.Lock()
+		invisible := c.status == statusInvisible
+		c.hub.mu.Unlock()
+		if invisible {
+			return
 		}
+
+		leaveMsg := c.hub.newChatPayload(time.Now(), "", "", fmt.Sprintf("%s left the chat.", c.nickname), true)
 		c.hub.broadcast("system_broadcast", leaveMsg, "")
+		c.hub.broadcastPresence("leave", c)
 	})
 }
\ No newline at end of file
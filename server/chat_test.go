@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestTransferCleanup(t *testing.T) {
+	hub := newTestHub(t, DefaultConfig())
+	ana, bob := newTestClient(hub, "ana"), newTestClient(hub, "bob")
+	ana.session, bob.session = 1, 2
+	hub.clients["ana"], hub.clients["bob"] = ana, bob
+	hub.transfers = map[string]*TransferInfo{
+		"waiting":  {ID: "waiting", FileName: "a.txt", FromUser: "bob", FromSession: 2, ToUser: "ana", ToSession: 1},
+		"sending":  {ID: "sending", FileName: "b.txt", FromUser: "bob", FromSession: 2, ToUser: "ana", ToSession: 1, Paired: true},
+		"answered": {ID: "answered", FileName: "c.txt", FromUser: "bob", FromSession: 2, ToUser: "ana", ToSession: 1},
+		"offline":  {ID: "offline", FileName: "d.txt", FromUser: "cid", ToUser: "ana", ToSession: 1},
+		"old":      {ID: "old", FileName: "e.txt", FromUser: "bob", FromSession: 1, ToUser: "ana", ToSession: 1},
+	}
+	if n := hub.pendingTransfers(); n != 3 {
+		t.Errorf("pendingTransfers = %d, want 3 (waiting, answered, old)", n)
+	}
+	hub.transferPaired("answered")
+	if n := hub.pendingTransfers(); n != 2 {
+		t.Errorf("pendingTransfers after a pair = %d, want 2", n)
+	}
+
+	// Paired transfers outlive the pairing timeout; unpaired ones do not
+	hub.expireTransfer("sending")
+	hub.expireTransfer("waiting")
+	if _, ok := hub.transfers["sending"]; !ok {
+		t.Error("expired a paired transfer")
+	}
+	if _, ok := hub.transfers["waiting"]; ok {
+		t.Error("unpaired transfer not expired")
+	}
+	msgs := sent(t, ana)
+	if len(msgs) != 1 || msgs[0].Type != "transfer_error" {
+		t.Fatalf("downloader got %+v, want one transfer_error", msgs)
+	}
+	var p TransferErrorPayload
+	data, _ := json.Marshal(msgs[0].Payload)
+	json.Unmarshal(data, &p)
+	if p.TransferID != "waiting" || p.FileName != "a.txt" || p.Peer != "bob" {
+		t.Errorf("transfer_error = %+v, want waiting, a.txt from bob", p)
+	}
+
+	// When bob's session leaves, what it was sending goes, but not what
+	// an older session of bob's was
+	hub.dropTransfers(bob)
+	for id, want := range map[string]bool{"sending": false, "answered": false, "offline": true, "old": true} {
+		if _, ok := hub.transfers[id]; ok != want {
+			t.Errorf("after bob left, %s kept = %v, want %v", id, ok, want)
+		}
+	}
+	hub.dropTransfers(ana)
+	if len(hub.transfers) != 0 {
+		t.Errorf("after ana left, transfers %v remain", hub.transfers)
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// permission is who may run a command.
+type permission int
+
+const (
+	permAnyone permission = iota
+	permOperator
+)
+
+// command is a slash command typed into chat.
+type command struct {
+	Name    string // without the leading '/'
+	Args    string // argument syntax shown in usage and /help
+	Help    string
+	MinArgs int
+	Perm    permission
+	Run     func(c *ChatClient, ctx commandContext)
+}
+
+// commandContext is one invocation of a command.
+type commandContext struct {
+	Room string   // room the command was typed in, already normalized
+	Args []string // whitespace-separated arguments
+	raw  string   // everything after the command name
+}
+
+// rest returns the text after the first n arguments, spacing intact.
+func (ctx commandContext) rest(n int) string {
+	s := ctx.raw
+	for i := 0; i < n; i++ {
+		s = strings.TrimLeft(s, " \t")
+		idx := strings.IndexAny(s, " \t")
+		if idx < 0 {
+			return ""
+		}
+		s = s[idx:]
+	}
+	return strings.TrimSpace(s)
+}
+
+// commands is the registry, keyed by name. It is filled in init because
+// /help reads it.
+var commands map[string]*command
+
+func init() {
+	commands = make(map[string]*command)
+	for _, cmd := range []*command{
+		{Name: "help", Args: "[command]", Help: "List commands, or explain one.", Run: cmdHelp},
+		{Name: "me", Args: "<action>", Help: "Describe what you are doing.", MinArgs: 1, Run: cmdMe},
+		{Name: "msg", Args: "<nickname> <text>", Help: "Send a private message.", MinArgs: 2, Run: cmdMsg},
+		{Name: "join", Args: "<room>", Help: "Join a room, creating it if needed.", MinArgs: 1, Run: cmdJoin},
+		{Name: "part", Args: "[room]", Help: "Leave a room (default: this one).", Run: cmdPart},
+		{Name: "rooms", Help: "List rooms.", Run: cmdRooms},
+		{Name: "topic", Args: "<topic>", Help: "Set the topic of this room.", MinArgs: 1, Run: cmdTopic},
+		{Name: "whois", Args: "<nickname>", Help: "Show what is known about a user.", MinArgs: 1, Run: cmdWhois},
+		{Name: "away", Args: "[message]", Help: "Mark yourself away.", Run: statusCommand(statusAway)},
+		{Name: "busy", Args: "[message]", Help: "Mark yourself busy.", Run: statusCommand(statusBusy)},
+		{Name: "invisible", Help: "Hide from the user list.", Run: statusCommand(statusInvisible)},
+		{Name: "back", Help: "Mark yourself online again.", Run: statusCommand(statusOnline)},
+		{Name: "ignore", Args: "[nickname]", Help: "Stop seeing someone's messages, or list who you ignore.", Run: cmdIgnore},
+		{Name: "unignore", Args: "<nickname>", Help: "See someone's messages again.", MinArgs: 1, Run: cmdUnignore},
+		{Name: "keys", Help: "List the keys that can log in as you.", Run: cmdKeys},
+		{Name: "addkey", Args: "<public key>", Help: "Let another key log in as you, e.g. a second device.", MinArgs: 2, Run: cmdAddKey},
+		{Name: "delkey", Args: "<fingerprint>", Help: "Stop a key from logging in as you.", MinArgs: 1, Run: cmdDelKey},
+
+		{Name: "kick", Args: "<nickname> [reason]", Help: "Disconnect a user.", MinArgs: 1, Perm: permOperator, Run: cmdKick},
+		{Name: "ban", Args: "<nickname> [duration] [reason]", Help: "Ban a nickname and its key, e.g. for 7d.", MinArgs: 1, Perm: permOperator, Run: cmdBan},
+		{Name: "unban", Args: "<nickname>", Help: "Lift bans on a nickname.", MinArgs: 1, Perm: permOperator, Run: cmdUnban},
+		{Name: "mute", Args: "<nickname> [duration] [reason]", Help: "Stop a user from talking.", MinArgs: 1, Perm: permOperator, Run: cmdMute},
+		{Name: "unmute", Args: "<nickname>", Help: "Let a muted user talk again.", MinArgs: 1, Perm: permOperator, Run: cmdUnmute},
+		{Name: "invite", Args: "[duration]", Help: "Create a single-use invite code, valid 7d unless given.", Perm: permOperator, Run: cmdInvite},
+		{Name: "invites", Help: "List unused invite codes.", Perm: permOperator, Run: cmdInvites},
+		{Name: "uninvite", Args: "<code>", Help: "Revoke an invite code.", MinArgs: 1, Perm: permOperator, Run: cmdUninvite},
+		{Name: "recover", Args: "<nickname> <public key>", Help: "Replace every key on an account, for a user who lost theirs.", MinArgs: 3, Perm: permOperator, Run: cmdRecover},
+	} {
+		commands[cmd.Name] = cmd
+	}
+}
+
+// usage is the command's syntax line.
+func (cmd *command) usage() string {
+	if cmd.Args == "" {
+		return "/" + cmd.Name
+	}
+	return "/" + cmd.Name + " " + cmd.Args
+}
+
+// allowed reports whether c may run cmd.
+func (cmd *command) allowed(c *ChatClient) bool {
+	return cmd.Perm == permAnyone || c.operator
+}
+
+// availableCommands lists the commands c may run, sorted by name.
+func availableCommands(c *ChatClient) []*command {
+	var list []*command
+	for _, cmd := range commands {
+		if cmd.allowed(c) {
+			list = append(list, cmd)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// sendCommandList tells the client which commands it can use, for completion.
+func (c *ChatClient) sendCommandList() {
+	list := availableCommands(c)
+	payload := CommandListPayload{Commands: make([]CommandInfo, 0, len(list))}
+	for _, cmd := range list {
+		payload.Commands = append(payload.Commands, CommandInfo{Name: cmd.Name, Args: cmd.Args, Help: cmd.Help})
+	}
+	c.send("command_list", payload)
+}
+
+// runCommand parses and runs a line starting with '/', typed in room.
+func (c *ChatClient) runCommand(room, line string) {
+	name, raw, _ := strings.Cut(strings.TrimPrefix(line, "/"), " ")
+	name = strings.ToLower(name)
+	cmd, ok := commands[name]
+	if !ok {
+		c.sendSystem(fmt.Sprintf("Unknown command /%s. Type /help for a list.", name))
+		return
+	}
+	if !cmd.allowed(c) {
+		c.sendSystem(fmt.Sprintf("Permission denied: /%s is for operators.", name))
+		return
+	}
+	ctx := commandContext{Room: room, Args: strings.Fields(raw), raw: raw}
+	if len(ctx.Args) < cmd.MinArgs {
+		c.sendSystem("Usage: " + cmd.usage())
+		return
+	}
+	cmd.Run(c, ctx)
+}
+
+func cmdHelp(c *ChatClient, ctx commandContext) {
+	if len(ctx.Args) > 0 {
+		cmd, ok := commands[strings.ToLower(strings.TrimPrefix(ctx.Args[0], "/"))]
+		if !ok || !cmd.allowed(c) {
+			c.sendSystem(fmt.Sprintf("No such command /%s.", strings.TrimPrefix(ctx.Args[0], "/")))
+			return
+		}
+		c.sendSystem(fmt.Sprintf("%s - %s", cmd.usage(), cmd.Help))
+		return
+	}
+	lines := []string{"Commands (start a message with // to send a literal slash):"}
+	for _, cmd := range availableCommands(c) {
+		lines = append(lines, fmt.Sprintf("  %s - %s", cmd.usage(), cmd.Help))
+	}
+	c.sendSystemLines(lines)
+}
+
+func cmdMe(c *ChatClient, ctx commandContext) {
+	c.say(ctx.Room, ctx.rest(0), true)
+}
+
+func cmdMsg(c *ChatClient, ctx commandContext) {
+	if c.hub.isMuted(c.nickname) {
+		c.sendSystem("You are muted and cannot talk right now.")
+		return
+	}
+	c.sendPrivateMessage(ctx.Args[0], ctx.rest(1))
+}
+
+func cmdJoin(c *ChatClient, ctx commandContext) {
+	c.joinRoom(ctx.Args[0])
+}
+
+func cmdPart(c *ChatClient, ctx commandContext) {
+	room := ctx.Room
+	if len(ctx.Args) > 0 {
+		room = ctx.Args[0]
+	}
+	c.partRoom(room)
+}
+
+func cmdRooms(c *ChatClient, ctx commandContext) {
+	c.send("room_list", RoomListPayload{Rooms: c.hub.RoomList()})
+}
+
+func cmdTopic(c *ChatClient, ctx commandContext) {
+	c.setTopic(ctx.Room, ctx.rest(0))
+}
+
+func cmdWhois(c *ChatClient, ctx commandContext) {
+	nick := ctx.Args[0]
+	c.hub.mu.Lock()
+	target, online := c.hub.clients[nick]
+	var info PresenceInfo
+	var rooms []string
+	var operator bool
+	if online {
+		online = target == c || target.status != statusInvisible
+	}
+	if online {
+		info = c.hub.presenceOf(target)
+		operator = target.operator
+		for name, r := range c.hub.rooms {
+			if r.members[nick] == target {
+				rooms = append(rooms, "#"+name)
+			}
+		}
+	}
+	c.hub.mu.Unlock()
+
+	if !online {
+		if rec, ok := c.hub.users.Lookup(nick); ok {
+			msg := fmt.Sprintf("%s is registered but not online.", nick)
+			if !rec.LastSeen.IsZero() {
+				msg += " Last seen " + rec.LastSeen.UTC().Format(time.RFC3339) + "."
+			}
+			c.sendSystem(msg)
+		} else {
+			c.sendSystem(fmt.Sprintf("No such user '%s'.", nick))
+		}
+		return
+	}
+	sort.Strings(rooms)
+	status := statusLabel(info.Status)
+	if info.StatusMessage != "" {
+		status += " (" + info.StatusMessage + ")"
+	}
+	lines := []string{
+		fmt.Sprintf("%s is %s", nick, status),
+		fmt.Sprintf("  online since %s, last active %s", info.OnlineSince, info.LastActive),
+		fmt.Sprintf("  sharing %d files", info.SharedFiles),
+		fmt.Sprintf("  in %s", strings.Join(rooms, " ")),
+	}
+	if operator {
+		lines = append(lines, "  is a relay operator")
+	}
+	c.sendSystemLines(lines)
+}
+
+// statusCommand makes a command that sets the caller's status.
+func statusCommand(status string) func(c *ChatClient, ctx commandContext) {
+	return func(c *ChatClient, ctx commandContext) {
+		c.setStatus(status, ctx.rest(0))
+	}
+}
+
+// defaultMaxIgnored caps how many nicknames one client may ignore.
+const defaultMaxIgnored = 200
+
+func cmdIgnore(c *ChatClient, ctx commandContext) {
+	if len(ctx.Args) == 0 {
+		c.hub.mu.Lock()
+		names := make([]string, 0, len(c.ignoring))
+		for nick := range c.ignoring {
+			names = append(names, nick)
+		}
+		c.hub.mu.Unlock()
+		if len(names) == 0 {
+			c.sendSystem("You are not ignoring anyone.")
+			return
+		}
+		sort.Strings(names)
+		c.sendSystem("Ignoring: " + strings.Join(names, ", "))
+		return
+	}
+	nick := ctx.Args[0]
+	if nick == c.nickname {
+		c.sendSystem("You cannot ignore yourself.")
+		return
+	}
+	if !c.hub.ignorable(nick) {
+		c.sendSystem(fmt.Sprintf("%q is not a nickname anyone can have.", nick))
+		return
+	}
+	max := c.hub.config().Limits.MaxIgnored
+	c.hub.mu.Lock()
+	full := len(c.ignoring) >= max && !c.ignoring[nick]
+	if !full {
+		c.ignoring[nick] = true
+	}
+	c.hub.mu.Unlock()
+	if full {
+		c.sendSystem(fmt.Sprintf("You are already ignoring %d people, the most the relay allows.", max))
+		return
+	}
+	c.sendSystem(fmt.Sprintf("Ignoring %s for this session.", nick))
+}
+
+// setIgnoreList replaces c's ignore list with the one its client keeps.
+// Names nobody can have are skipped, and the list is cut at
+// Limits.MaxIgnored.
+func (c *ChatClient) setIgnoreList(nicks []string) {
+	max := c.hub.config().Limits.MaxIgnored
+	ignoring := make(map[string]bool, min(len(nicks), max))
+	for _, nick := range nicks {
+		if len(ignoring) == max {
+			c.sendSystem(fmt.Sprintf("Only the first %d people on your ignore list are ignored by the relay.", max))
+			break
+		}
+		if nick != c.nickname && c.hub.ignorable(nick) {
+			ignoring[nick] = true
+		}
+	}
+	c.hub.mu.Lock()
+	c.ignoring = ignoring
+	c.hub.mu.Unlock()
+}
+
+// ignorable reports whether nick can be on an ignore list: the policy would
+// let it register, or it already is registered.
+func (hub *ChatHub) ignorable(nick string) bool {
+	return hub.users.policy.Load().Check(nick) == nil || hub.users.Has(nick)
+}
+
+func cmdUnignore(c *ChatClient, ctx commandContext) {
+	nick := ctx.Args[0]
+	c.hub.mu.Lock()
+	_, was := c.ignoring[nick]
+	delete(c.ignoring, nick)
+	c.hub.mu.Unlock()
+	if !was {
+		c.sendSystem(fmt.Sprintf("You were not ignoring %s.", nick))
+		return
+	}
+	c.sendSystem(fmt.Sprintf("No longer ignoring %s.", nick))
+}
+
+// sendSystemLines sends a multi-line notice one line at a time, since
+// clients show each system message as a single log line.
+func (c *ChatClient) sendSystemLines(lines []string) {
+	for _, line := range lines {
+		c.sendSystem(line)
+	}
+}
+
+// say posts text to room as c, or as an action for /me.
+func (c *ChatClient) say(room, text string, action bool) {
+	if c.hub.isMuted(c.nickname) {
+		c.sendSystem("You are muted and cannot talk right now.")
+		return
+	}
+	if !c.hub.inRoom(room, c) {
+		c.sendSystem(fmt.Sprintf("You are not in #%s.", room))
+		return
+	}
+	now := time.Now()
+	payload := c.hub.newChatPayload(now, room, c.nickname, text, false)
+	payload.IsAction = action
+	c.hub.broadcastRoom(room, "chat_broadcast", payload, "")
+	rec := historyRecord{ID: payload.ID, Time: now.UTC(), Nickname: c.nickname, Text: text, Action: action}
+	if err := c.hub.history.Append(room, rec); err != nil {
+		logStore.Error("Failed to save chat history", "room", room, "err", err)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// newTestHub returns a hub with cfg and an empty user store.
+func newTestHub(t *testing.T, cfg Config) *ChatHub {
+	t.Helper()
+	users := newTestAuthenticator(t, &authPolicy{}).users
+	return NewChatHub(nil, users, nil, nil, nil, nil, cfg)
+}
+
+// newTestClient returns a client of hub without a connection; what the
+// relay sends it waits in controlOut.
+func newTestClient(hub *ChatHub, nick string) *ChatClient {
+	return &ChatClient{
+		nickname:   nick,
+		hub:        hub,
+		controlOut: make(chan []byte, 64),
+		chatOut:    make(chan []byte, 64),
+		done:       make(chan struct{}),
+		flood:      newFloodGuard(),
+		ignoring:   make(map[string]bool),
+		log:        logChat.With("nick", nick),
+	}
+}
+
+// sent drains the messages queued for c.
+func sent(t *testing.T, c *ChatClient) []OutboundMessage {
+	t.Helper()
+	var msgs []OutboundMessage
+	for {
+		select {
+		case data := <-c.controlOut:
+			var msg OutboundMessage
+			if err := json.Unmarshal(data, &msg); err != nil {
+				t.Fatal(err)
+			}
+			msgs = append(msgs, msg)
+		default:
+			return msgs
+		}
+	}
+}
+
+func TestSetIgnoreList(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Limits.MaxIgnored = 3
+	tests := []struct {
+		name       string
+		nicks      []string
+		want       []string
+		wantNotice bool
+	}{
+		{name: "empty"},
+		{name: "valid", nicks: []string{"bob", "cid"}, want: []string{"bob", "cid"}},
+		{name: "self skipped", nicks: []string{"ana", "bob"}, want: []string{"bob"}},
+		{name: "invalid skipped", nicks: []string{"bob", "no spaces", "", "admin", "x"}, want: []string{"bob"}},
+		{name: "registered before the rules", nicks: []string{"bob", "root"}, want: []string{"bob", "root"}},
+		{name: "duplicates", nicks: []string{"bob", "bob", "bob", "bob"}, want: []string{"bob"}},
+		{name: "capped", nicks: []string{"bob", "cid", "dee", "eve", "fay"}, want: []string{"bob", "cid", "dee"}, wantNotice: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub := newTestHub(t, cfg)
+			// Reserved now, but registered before it was
+			hub.users.store.Update("root", func(rec *UserRecord, exists bool) error { return nil })
+			c := newTestClient(hub, "ana")
+			c.setIgnoreList(tt.nicks)
+
+			var got []string
+			for nick := range c.ignoring {
+				got = append(got, nick)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ignoring %v, want %v", got, tt.want)
+			}
+			if notice := len(sent(t, c)) > 0; notice != tt.wantNotice {
+				t.Errorf("notice sent = %v, want %v", notice, tt.wantNotice)
+			}
+		})
+	}
+}
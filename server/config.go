@@ -0,0 +1,361 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultConfigFile is read when it exists and no other file is named.
+const defaultConfigFile = "rosewire.yaml"
+
+// Config is everything an operator can tune. Settings come from, in
+// increasing precedence: the defaults, the YAML config file, ROSEWIRE_*
+// environment variables and command-line flags. Each setting has a flag;
+// its environment variable is the flag name in upper case with "-" as
+// "_", e.g. ROSEWIRE_STATUS_LISTEN for -status-listen.
+type Config struct {
+	Listen           string           `yaml:"listen"`
+	StatusListen     string           `yaml:"status_listen"`
+	MOTD             string           `yaml:"motd"`
+	Registration     RegistrationMode `yaml:"registration"`
+	DuplicateLogin   DuplicatePolicy  `yaml:"duplicate_login"`
+	CertRoles        string           `yaml:"cert_roles"`
+	UserStoreBackend string           `yaml:"user_store_backend"`
+	ShutdownTimeout  time.Duration    `yaml:"shutdown_timeout"`
+	Paths            PathsConfig      `yaml:"paths"`
+	Limits           LimitsConfig     `yaml:"limits"`
+	Keepalive        KeepaliveConfig  `yaml:"keepalive"`
+	Features         Features         `yaml:"features"`
+	Log              LogConfig        `yaml:"log"` // see logging.go
+}
+
+// PathsConfig says where the relay keeps its files. Relative paths are
+// relative to the working directory.
+type PathsConfig struct {
+	HostKeys      []string `yaml:"host_keys"` // see hostkeys.go
+	UserStore     string   `yaml:"user_store"`
+	LegacyNickDB  string   `yaml:"legacy_nick_db"` // imported into the user store once
+	Mailbox       string   `yaml:"mailbox"`
+	History       string   `yaml:"history"`
+	Operators     string   `yaml:"operators"` // authorized_keys format
+	Bans          string   `yaml:"bans"`
+	ReservedNicks string   `yaml:"reserved_nicks"`
+	AllowedKeys   string   `yaml:"allowed_keys"` // for registration: allowlist
+	Invites       string   `yaml:"invites"`
+	UserCAKeys    string   `yaml:"user_ca_keys"`  // see certs.go
+	RevokedCerts  string   `yaml:"revoked_certs"` // see certs.go
+}
+
+// LimitsConfig bounds what one client can cost the relay.
+type LimitsConfig struct {
+	DeliveryConfig     `yaml:",inline"`
+	MaxOfflineMessages int         `yaml:"max_offline_messages"`
+	MaxIgnored         int         `yaml:"max_ignored"`
+	Flood              FloodConfig `yaml:"flood"` // see ratelimit.go
+}
+
+// Features turns optional parts of the relay on and off.
+type Features struct {
+	// StatusPage serves the dashboard on StatusListen.
+	StatusPage bool `yaml:"status_page"`
+	// OfflineMessages keeps private messages for users who are away.
+	OfflineMessages bool `yaml:"offline_messages"`
+	// ChatHistory records room chat and replays it to people joining.
+	ChatHistory bool `yaml:"chat_history"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Listen:           "0.0.0.0:2222",
+		StatusListen:     "127.0.0.1:8080", // set to "0.0.0.0:8080" for public access
+		Registration:     registrationOpen,
+		DuplicateLogin:   duplicateReplace,
+		CertRoles:        defaultCertRoles,
+		UserStoreBackend: "bolt",
+		ShutdownTimeout:  defaultShutdownTimeout,
+		Paths: PathsConfig{
+			HostKeys:      []string{"server_ed25519"},
+			UserStore:     "users.db",
+			LegacyNickDB:  "nicks.db",
+			Mailbox:       "mailbox.json",
+			History:       "history",
+			Operators:     "operators",
+			Bans:          "bans.json",
+			ReservedNicks: "reserved_nicks",
+			AllowedKeys:   "allowed_keys",
+			Invites:       "invites.json",
+			UserCAKeys:    "user_ca_keys",
+			RevokedCerts:  "revoked_certs",
+		},
+		Limits: LimitsConfig{
+			DeliveryConfig:     DefaultDeliveryConfig(),
+			MaxOfflineMessages: defaultMaxOfflineMessages,
+			MaxIgnored:         defaultMaxIgnored,
+			Flood:              DefaultFloodConfig(),
+		},
+		Keepalive: DefaultKeepaliveConfig(),
+		Features: Features{
+			StatusPage:      true,
+			OfflineMessages: true,
+			ChatHistory:     true,
+		},
+		Log: DefaultLogConfig(),
+	}
+}
+
+// textFlag binds a flag to a string-typed setting such as
+// RegistrationMode. Values are checked by Validate, not here.
+type textFlag[T ~string] struct{ p *T }
+
+func (f textFlag[T]) String() string {
+	if f.p == nil {
+		return ""
+	}
+	return string(*f.p)
+}
+
+func (f textFlag[T]) Set(s string) error {
+	*f.p = T(s)
+	return nil
+}
+
+// listFlag binds a flag to a list setting. Values are comma-separated and
+// the flag may be repeated; the first use replaces the default.
+type listFlag struct {
+	p   *[]string
+	set bool
+}
+
+func (f *listFlag) String() string {
+	if f.p == nil {
+		return ""
+	}
+	return strings.Join(*f.p, ",")
+}
+
+func (f *listFlag) Set(s string) error {
+	if !f.set {
+		*f.p, f.set = nil, true
+	}
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*f.p = append(*f.p, v)
+		}
+	}
+	return nil
+}
+
+// bindFlags defines a flag for every setting in cfg, defaulting to its
+// current value.
+func bindFlags(fs *flag.FlagSet, cfg *Config) {
+	fs.StringVar(&cfg.Listen, "listen", cfg.Listen, "address for SSH connections")
+	fs.StringVar(&cfg.StatusListen, "status-listen", cfg.StatusListen, "address for the status dashboard")
+	fs.StringVar(&cfg.MOTD, "motd", cfg.MOTD, "message of the day shown to users as they log in")
+	fs.Var(textFlag[RegistrationMode]{&cfg.Registration}, "registration", "who may register: \"open\" to anyone, \"invite\" with an operator's invite code, \"allowlist\" only keys in the allowed keys file")
+	fs.Var(textFlag[DuplicatePolicy]{&cfg.DuplicateLogin}, "duplicate-login", "when a nickname logs in twice: \"replace\" closes the old session, \"reject\" refuses the new one")
+	fs.StringVar(&cfg.CertRoles, "cert-roles", cfg.CertRoles, "comma-separated extension=role pairs granting roles to user certificates carrying the extension")
+	fs.StringVar(&cfg.UserStoreBackend, "user-store-backend", cfg.UserStoreBackend, "user store backend")
+	fs.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", cfg.ShutdownTimeout, "how long transfers in progress may run on once the relay is asked to stop")
+
+	p := &cfg.Paths
+	fs.Var(&listFlag{p: &p.HostKeys}, "host-key", "SSH host private key, created if missing; repeat or separate with commas for several key types")
+	fs.StringVar(&p.UserStore, "user-store", p.UserStore, "user store location")
+	fs.StringVar(&p.LegacyNickDB, "legacy-nick-db", p.LegacyNickDB, "old nickname file to import into the user store")
+	fs.StringVar(&p.Mailbox, "mailbox", p.Mailbox, "offline private messages file")
+	fs.StringVar(&p.History, "history-dir", p.History, "chat history directory")
+	fs.StringVar(&p.Operators, "operators", p.Operators, "operator keys, authorized_keys format")
+	fs.StringVar(&p.Bans, "bans", p.Bans, "ban list file")
+	fs.StringVar(&p.ReservedNicks, "reserved-nicks", p.ReservedNicks, "extra reserved nicknames, one per line")
+	fs.StringVar(&p.AllowedKeys, "allowed-keys", p.AllowedKeys, "keys allowed to log in with -registration allowlist")
+	fs.StringVar(&p.Invites, "invites", p.Invites, "unused invite codes file")
+	fs.StringVar(&p.UserCAKeys, "user-ca-keys", p.UserCAKeys, "CA keys trusted to sign user certificates")
+	fs.StringVar(&p.RevokedCerts, "revoked-certs", p.RevokedCerts, "revoked user certificates")
+
+	l := &cfg.Limits
+	fs.IntVar(&l.ControlBuffer, "control-buffer", l.ControlBuffer, "per-client queue size for replies, private messages and transfers")
+	fs.IntVar(&l.ChatBuffer, "chat-buffer", l.ChatBuffer, "per-client queue size for room chat and notices")
+	fs.DurationVar(&l.SendTimeout, "send-timeout", l.SendTimeout, "how long to wait on a full control queue before dropping the client")
+	fs.IntVar(&l.MaxChatDrops, "max-chat-drops", l.MaxChatDrops, "chat messages a client may miss in a row before it is dropped")
+	fs.IntVar(&l.MaxOfflineMessages, "max-offline-messages", l.MaxOfflineMessages, "private messages kept for one user while they are away")
+	fs.IntVar(&l.MaxIgnored, "max-ignored", l.MaxIgnored, "nicknames one client may ignore")
+	fs.Var(rateLimitsFlag{&l.Flood.Rates}, "rate-limits", "comma-separated type=rate/burst overrides of the per-client message rate limits, e.g. get_file=0.2/10 (rate in messages per second)")
+	fs.DurationVar(&l.Flood.StrikeWindow, "flood-strike-window", l.Flood.StrikeWindow, "forget a client's rate limit strikes after this long without one")
+	fs.IntVar(&l.Flood.WarnAfter, "flood-warn-after", l.Flood.WarnAfter, "rate limit strikes before a client is warned")
+	fs.IntVar(&l.Flood.MuteAfter, "flood-mute-after", l.Flood.MuteAfter, "rate limit strikes before a client is muted")
+	fs.IntVar(&l.Flood.KickAfter, "flood-kick-after", l.Flood.KickAfter, "rate limit strikes before a client is disconnected")
+	fs.DurationVar(&l.Flood.MuteFor, "flood-mute-for", l.Flood.MuteFor, "how long flood protection mutes a client")
+
+	k := &cfg.Keepalive
+	fs.DurationVar(&k.PingInterval, "ping-interval", k.PingInterval, "how often to ping chat clients (0 disables)")
+	fs.DurationVar(&k.PingTimeout, "ping-timeout", k.PingTimeout, "disconnect chat clients silent for this long")
+	fs.DurationVar(&k.SSHInterval, "ssh-keepalive-interval", k.SSHInterval, "how often to send SSH keepalives (0 disables)")
+	fs.DurationVar(&k.SSHTimeout, "ssh-keepalive-timeout", k.SSHTimeout, "close connections that do not answer an SSH keepalive within this time")
+
+	f := &cfg.Features
+	fs.BoolVar(&f.StatusPage, "status-page", f.StatusPage, "serve the status dashboard")
+	fs.BoolVar(&f.OfflineMessages, "offline-messages", f.OfflineMessages, "keep private messages for users who are away")
+	fs.BoolVar(&f.ChatHistory, "chat-history", f.ChatHistory, "record room chat and replay it to people joining")
+
+	lg := &cfg.Log
+	fs.StringVar(&lg.Level, "log-level", lg.Level, "log level: debug, info, warn or error")
+	fs.Var(levelsFlag{&lg.Levels}, "log-levels", "comma-separated subsystem=level overrides, e.g. transfer=debug,chat=warn (subsystems: "+strings.Join(logSubsystems(), ", ")+")")
+	fs.StringVar(&lg.Format, "log-format", lg.Format, "log format: \"text\" or \"json\"")
+	fs.BoolVar(&lg.Redact, "log-redact", lg.Redact, "replace file names and search queries in logs with a hash")
+}
+
+// envName is the environment variable that sets a flag.
+func envName(flagName string) string {
+	return "ROSEWIRE_" + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// LoadConfig builds the configuration from the config file, environment
+// and args, and validates it. printConfig is set by -print-config.
+func LoadConfig(args []string) (cfg Config, printConfig bool, err error) {
+	// Flags win over the file, but name it, so look for -config first
+	scan := flag.NewFlagSet("rosewire-server", flag.ContinueOnError)
+	scan.SetOutput(io.Discard)
+	scratch := DefaultConfig()
+	bindFlags(scan, &scratch)
+	path := scan.String("config", "", "")
+	scan.Bool("print-config", false, "")
+	scan.Parse(args) // errors are reported by the real parse below
+
+	cfg = DefaultConfig()
+	configPath, explicit := *path, *path != ""
+	if !explicit {
+		configPath, explicit = os.LookupEnv(envName("config"))
+	}
+	if !explicit {
+		configPath = defaultConfigFile
+	}
+	if err := cfg.loadFile(configPath, explicit); err != nil {
+		return cfg, false, err
+	}
+
+	fs := flag.NewFlagSet("rosewire-server", flag.ExitOnError)
+	bindFlags(fs, &cfg)
+	fs.String("config", configPath, "YAML config file (env "+envName("config")+")")
+	fs.BoolVar(&printConfig, "print-config", false, "print the effective configuration as YAML and exit")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage of rosewire-server:\n\nSettings come from the config file, then ROSEWIRE_* environment variables\n(e.g. %s for -status-listen), then flags.\n\n", envName("status-listen"))
+		fs.PrintDefaults()
+	}
+	var envErrs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" || f.Name == "print-config" {
+			return
+		}
+		if v, ok := os.LookupEnv(envName(f.Name)); ok {
+			if err := fs.Set(f.Name, v); err != nil {
+				envErrs = append(envErrs, fmt.Errorf("%s: %w", envName(f.Name), err))
+			}
+		}
+	})
+	if err := errors.Join(envErrs...); err != nil {
+		return cfg, false, err
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		return cfg, false, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	return cfg, printConfig, cfg.Validate()
+}
+
+// loadFile reads YAML settings over cfg. A missing file is only an error
+// if it was asked for.
+func (cfg *Config) loadFile(path string, required bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) && !required {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// Validate reports every problem with the configuration at once.
+func (cfg *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	checkAddr := func(name, addr string) {
+		_, port, err := net.SplitHostPort(addr)
+		check(err == nil && port != "", "%s: %q is not a host:port address", name, addr)
+	}
+	checkAddr("listen", cfg.Listen)
+	if cfg.Features.StatusPage {
+		checkAddr("status_listen", cfg.StatusListen)
+	}
+	if _, err := ParseRegistrationMode(string(cfg.Registration)); err != nil {
+		errs = append(errs, fmt.Errorf("registration: %w", err))
+	}
+	if _, err := ParseDuplicatePolicy(string(cfg.DuplicateLogin)); err != nil {
+		errs = append(errs, fmt.Errorf("duplicate_login: %w", err))
+	}
+	if _, err := ParseCertRoles(cfg.CertRoles); err != nil {
+		errs = append(errs, fmt.Errorf("cert_roles: %w", err))
+	}
+	_, ok := userStoreBackends[cfg.UserStoreBackend]
+	check(ok, "user_store_backend: unknown backend %q", cfg.UserStoreBackend)
+	check(cfg.ShutdownTimeout >= 0, "shutdown_timeout: must not be negative")
+
+	p := cfg.Paths
+	for name, path := range map[string]string{
+		"user_store": p.UserStore, "mailbox": p.Mailbox,
+		"history": p.History, "operators": p.Operators, "bans": p.Bans,
+		"reserved_nicks": p.ReservedNicks, "allowed_keys": p.AllowedKeys,
+		"invites": p.Invites, "user_ca_keys": p.UserCAKeys, "revoked_certs": p.RevokedCerts,
+	} {
+		check(path != "", "paths.%s: must not be empty", name)
+	}
+	check(len(p.HostKeys) > 0, "paths.host_keys: need at least one host key")
+	for _, path := range p.HostKeys {
+		check(path != "", "paths.host_keys: must not contain empty paths")
+	}
+
+	l := cfg.Limits
+	check(l.ControlBuffer > 0, "limits.control_buffer: must be positive")
+	check(l.ChatBuffer > 0, "limits.chat_buffer: must be positive")
+	check(l.SendTimeout > 0, "limits.send_timeout: must be positive")
+	check(l.MaxChatDrops > 0, "limits.max_chat_drops: must be positive")
+	check(l.MaxOfflineMessages > 0, "limits.max_offline_messages: must be positive")
+	check(l.MaxIgnored > 0, "limits.max_ignored: must be positive")
+	errs = append(errs, l.Flood.validate()...)
+
+	k := cfg.Keepalive
+	check(k.PingInterval >= 0, "keepalive.ping_interval: must not be negative")
+	check(k.SSHInterval >= 0, "keepalive.ssh_interval: must not be negative")
+	check(k.PingInterval == 0 || k.PingTimeout > k.PingInterval,
+		"keepalive.ping_timeout: must be longer than ping_interval (%s)", k.PingInterval)
+	check(k.SSHInterval == 0 || k.SSHTimeout > 0, "keepalive.ssh_timeout: must be positive")
+	errs = append(errs, cfg.Log.validate()...)
+	return errors.Join(errs...)
+}
+
+// Print writes cfg as YAML, in the form the config file takes.
+func (cfg Config) Print(w io.Writer) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(cfg); err != nil {
+		return err
+	}
+	return enc.Close()
+}
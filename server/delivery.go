@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// Messages reach a client through one of two queues. The control lane
+// carries everything addressed to one client: replies, private messages and
+// transfer traffic. It is never dropped; a sender waits up to SendTimeout
+// for room and the client is disconnected if it stays full. The chat lane
+// carries fan-out traffic (room chat, notices, presence). It never blocks;
+// when full the message is dropped, and a client that keeps missing
+// messages is disconnected. The writer always drains control first.
+
+// DeliveryConfig sizes the queues and sets how slow consumers are handled.
+type DeliveryConfig struct {
+	ControlBuffer int `yaml:"control_buffer"`
+	ChatBuffer    int `yaml:"chat_buffer"`
+	// SendTimeout is how long a control message may wait for queue space.
+	SendTimeout time.Duration `yaml:"send_timeout"`
+	// MaxChatDrops is how many chat lane messages in a row a client may miss
+	// before it is disconnected.
+	MaxChatDrops int `yaml:"max_chat_drops"`
+}
+
+// DefaultDeliveryConfig is used unless the configuration says otherwise.
+func DefaultDeliveryConfig() DeliveryConfig {
+	return DeliveryConfig{
+		ControlBuffer: 256,
+		ChatBuffer:    128,
+		SendTimeout:   10 * time.Second,
+		MaxChatDrops:  200,
+	}
+}
+
+var (
+	errClientGone   = errors.New("recipient is not connected")
+	errSlowConsumer = errors.New("recipient is not keeping up")
+)
+
+// DeliveryStats counts what the queues had to give up on.
+type DeliveryStats struct {
+	ChatDropped        atomic.Int64
+	ControlTimeouts    atomic.Int64
+	SlowDisconnections atomic.Int64
+}
+
+// deliverControl queues msg on the control lane, waiting for room if the
+// queue is full. Do not call with hub.mu held.
+func (c *ChatClient) deliverControl(msg []byte) error {
+	select {
+	case c.controlOut <- msg:
+		return nil
+	case <-c.done:
+		return errClientGone
+	default:
+	}
+
+	timer := time.NewTimer(c.hub.config().Limits.SendTimeout)
+	defer timer.Stop()
+	select {
+	case c.controlOut <- msg:
+		return nil
+	case <-c.done:
+		return errClientGone
+	case <-timer.C:
+		c.hub.deliveryStats.ControlTimeouts.Add(1)
+		c.dropSlowConsumer("control queue stayed full")
+		return errSlowConsumer
+	}
+}
+
+// deliverChat queues msg on the chat lane without blocking. It is safe to
+// call with hub.mu held.
+func (c *ChatClient) deliverChat(msg []byte) error {
+	select {
+	case c.chatOut <- msg:
+		c.chatDrops.Store(0)
+		return nil
+	case <-c.done:
+		return errClientGone
+	default:
+	}
+	c.hub.deliveryStats.ChatDropped.Add(1)
+	if c.chatDrops.Add(1) == int32(c.hub.config().Limits.MaxChatDrops) {
+		go c.dropSlowConsumer("missed too many chat messages")
+	}
+	return errSlowConsumer
+}
+
+// dropSlowConsumer disconnects a client that cannot keep up. There is no
+// point queueing an explanation it will not read.
+func (c *ChatClient) dropSlowConsumer(why string) {
+	c.hub.deliveryStats.SlowDisconnections.Add(1)
+	c.log.Warn("Disconnecting slow client", "reason", why)
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	c.Close()
+}
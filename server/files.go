@@ -2,7 +2,6 @@
 package main
 
 import (
-	"log"
 	"sort"
 	"strconv"
 	"strings"
@@ -42,10 +41,10 @@ func (r *FileRegistry) UpdateUserFiles(nickname string, fileList []SharedFile) {
 	defer r.mu.Unlock()
 	if len(fileList) > 0 {
 		r.files[nickname] = fileList
-		log.Printf("Updated file list for %s with %d items.", nickname, len(fileList))
+		logFiles.Debug("Updated shared files", "nick", nickname, "files", len(fileList))
 	} else {
 		delete(r.files, nickname)
-		log.Printf("Cleared file list for %s.", nickname)
+		logFiles.Debug("Cleared shared files", "nick", nickname)
 	}
 }
 
@@ -54,7 +53,20 @@ func (r *FileRegistry) RemoveUser(nickname string) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	delete(r.files, nickname)
-	log.Printf("Removed user %s from file registry.", nickname)
+	logFiles.Debug("Removed user from file registry", "nick", nickname)
+}
+
+// CountFiles returns how many files (not directories) a user is sharing.
+func (r *FileRegistry) CountFiles(nickname string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	count := 0
+	for _, file := range r.files[nickname] {
+		if !file.IsDir {
+			count++
+		}
+	}
+	return count
 }
 
 // VerifyFileOwner checks if a specific user is sharing a file with a specific name.
@@ -98,7 +110,7 @@ func (r *FileRegistry) Search(query string) []SearchResult {
 			}
 		}
 	}
-	log.Printf("Search for '%s' returned %d results.", query, len(results))
+	logFiles.Debug("Searched shared files", private("query", query), "results", len(results))
 	return results
 }
 
@@ -146,19 +158,19 @@ func ParseShareCommand(payload string) ([]SharedFile, error) {
 		}
 		fileInfo := strings.SplitN(part, ":", 3)
 		if len(fileInfo) != 3 {
-			log.Printf("Warning: malformed file info part: %s", part)
+			logFiles.Warn("Malformed file info", private("part", part))
 			continue
 		}
 
 		name := fileInfo[0]
 		size, err := strconv.ParseInt(fileInfo[1], 10, 64)
 		if err != nil {
-			log.Printf("Warning: malformed size in file info: %s", part)
+			logFiles.Warn("Malformed size in file info", private("part", part))
 			continue
 		}
 		isDir, err := strconv.ParseBool(fileInfo[2])
 		if err != nil {
-			log.Printf("Warning: malformed isDir flag in file info: %s", part)
+			logFiles.Warn("Malformed isDir flag in file info", private("part", part))
 			continue
 		}
 
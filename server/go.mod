@@ -2,6 +2,11 @@ module rosewire-server
 
 go 1.24.0
 
-require golang.org/x/crypto v0.40.0
+require (
+	go.etcd.io/bbolt v1.4.3
+	golang.org/x/crypto v0.40.0
+	golang.org/x/text v0.27.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require golang.org/x/sys v0.34.0 // indirect
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// historyBacklog is how many messages a client gets when joining a room.
+	historyBacklog = 50
+	// maxHistoryPage caps a single chat_history request.
+	maxHistoryPage = 200
+)
+
+// historyRecord is one chat message as stored on disk.
+type historyRecord struct {
+	ID       uint64    `json:"id"`
+	Time     time.Time `json:"time"`
+	Nickname string    `json:"nickname"`
+	Text     string    `json:"text"`
+	Action   bool      `json:"action,omitempty"`
+}
+
+// ChatHistory persists room chat to one JSON-lines file per room.
+type ChatHistory struct {
+	mu  sync.Mutex
+	dir string
+}
+
+// NewChatHistory stores history under dir, creating it if needed. With an
+// empty dir nothing is kept.
+func NewChatHistory(dir string) (*ChatHistory, error) {
+	if dir == "" {
+		return &ChatHistory{}, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &ChatHistory{dir: dir}, nil
+}
+
+// path returns the history file for a room. Room names are already
+// restricted to safe characters by normalizeRoomName.
+func (h *ChatHistory) path(room string) string {
+	return filepath.Join(h.dir, room+".jsonl")
+}
+
+// Append records a message said in room.
+func (h *ChatHistory) Append(room string, rec historyRecord) error {
+	if h.dir == "" {
+		return nil
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	f, err := os.OpenFile(h.path(room), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+// Before returns up to limit messages from room older than before, oldest
+// first, and whether there are even older ones.
+func (h *ChatHistory) Before(room string, before time.Time, limit int) ([]historyRecord, bool, error) {
+	if h.dir == "" {
+		return nil, false, nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	f, err := os.Open(h.path(room))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	defer f.Close()
+
+	// Messages are appended in order, so read back from the end until
+	// limit+1 match; the extra one tells us whether more remain.
+	var newest []historyRecord
+	err = eachLineBackwards(f, func(line []byte) bool {
+		var rec historyRecord
+		if err := json.Unmarshal(line, &rec); err != nil || !rec.Time.Before(before) {
+			return true
+		}
+		newest = append(newest, rec)
+		return len(newest) <= limit
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	hasMore := len(newest) > limit
+	if hasMore {
+		newest = newest[:limit]
+	}
+	slices.Reverse(newest)
+	return newest, hasMore, nil
+}
+
+const (
+	// historyBlockSize is how much of a history file is read at a time.
+	historyBlockSize = 64 * 1024
+	// maxHistoryLine is the longest line read back; longer ones are
+	// damage and skipped.
+	maxHistoryLine = 1024 * 1024
+)
+
+// eachLineBackwards calls fn with the lines of f, last first, until fn
+// returns false or the start of the file.
+func eachLineBackwards(f *os.File, fn func(line []byte) bool) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	var tail []byte // start of the line the block read last ended in
+	skipping := false
+	for pos := info.Size(); pos > 0; {
+		n := min(historyBlockSize, pos)
+		pos -= n
+		block := make([]byte, n, n+int64(len(tail)))
+		if _, err := f.ReadAt(block, pos); err != nil {
+			return err
+		}
+		data := append(block, tail...)
+		for {
+			i := bytes.LastIndexByte(data, '\n')
+			if i < 0 {
+				break
+			}
+			line := data[i+1:]
+			data = data[:i]
+			if skipping {
+				skipping = false
+				continue
+			}
+			if len(line) > 0 && !fn(line) {
+				return nil
+			}
+		}
+		tail = data
+		if len(tail) > maxHistoryLine {
+			tail, skipping = nil, true
+		}
+	}
+	if len(tail) > 0 && !skipping {
+		fn(tail)
+	}
+	return nil
+}
+
+// sendHistory sends c up to limit messages from room said before the given time.
+func (c *ChatClient) sendHistory(room string, before time.Time, limit int) {
+	if limit <= 0 || limit > maxHistoryPage {
+		limit = maxHistoryPage
+	}
+	records, hasMore, err := c.hub.history.Before(room, before, limit)
+	if err != nil {
+		c.sendSystem("Could not load chat history.")
+		return
+	}
+	payload := ChatHistoryPayload{
+		Room:     room,
+		Messages: make([]ChatBroadcastPayload, 0, len(records)),
+		HasMore:  hasMore,
+	}
+	for _, rec := range records {
+		payload.Messages = append(payload.Messages, ChatBroadcastPayload{
+			ID:        rec.ID,
+			Timestamp: rec.Time.UTC().Format(time.RFC3339),
+			Room:      room,
+			Nickname:  rec.Nickname,
+			Text:      rec.Text,
+			IsAction:  rec.Action,
+		})
+	}
+	if len(records) > 0 {
+		payload.Oldest = records[0].Time.Format(time.RFC3339Nano)
+	}
+	c.send("chat_history", payload)
+}
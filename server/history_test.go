@@ -0,0 +1,143 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChatHistoryBefore(t *testing.T) {
+	h, err := NewChatHistory(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2026, 1, 2, 10, 0, 0, 0, time.UTC)
+	at := func(i int) time.Time { return start.Add(time.Duration(i) * time.Minute) }
+	for i := 1; i <= 5; i++ {
+		if err := h.Append("general", historyRecord{ID: uint64(i), Time: at(i), Nickname: "ana", Text: "hi"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A damaged line is skipped, not fatal
+	f, err := os.OpenFile(h.path("general"), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("{not json\n")
+	f.Close()
+
+	tests := []struct {
+		name     string
+		room     string
+		before   time.Time
+		limit    int
+		wantIDs  []uint64
+		wantMore bool
+	}{
+		{name: "all", room: "general", before: at(10), limit: 10, wantIDs: []uint64{1, 2, 3, 4, 5}},
+		{name: "exactly limit", room: "general", before: at(10), limit: 5, wantIDs: []uint64{1, 2, 3, 4, 5}},
+		{name: "newest page", room: "general", before: at(10), limit: 2, wantIDs: []uint64{4, 5}, wantMore: true},
+		{name: "earlier page", room: "general", before: at(4), limit: 2, wantIDs: []uint64{2, 3}, wantMore: true},
+		{name: "oldest page", room: "general", before: at(3), limit: 2, wantIDs: []uint64{1, 2}},
+		{name: "before is exclusive", room: "general", before: at(1), limit: 5},
+		{name: "unknown room", room: "random", before: at(10), limit: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recs, more, err := h.Before(tt.room, tt.before, tt.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []uint64
+			for _, r := range recs {
+				ids = append(ids, r.ID)
+			}
+			if !reflect.DeepEqual(ids, tt.wantIDs) || more != tt.wantMore {
+				t.Errorf("Before(%s, %d) = %v, %v; want %v, %v", tt.before.Format(time.Kitchen), tt.limit, ids, more, tt.wantIDs, tt.wantMore)
+			}
+		})
+	}
+}
+
+func TestChatHistoryDisabled(t *testing.T) {
+	h, err := NewChatHistory("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Append("general", historyRecord{ID: 1, Time: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	recs, more, err := h.Before("general", time.Now().Add(time.Hour), 10)
+	if len(recs) != 0 || more || err != nil {
+		t.Errorf("Before with history off = %v, %v, %v; want nothing", recs, more, err)
+	}
+}
+
+func TestEachLineBackwards(t *testing.T) {
+	long := strings.Repeat("x", historyBlockSize+10)
+	tooLong := strings.Repeat("y", maxHistoryLine+historyBlockSize)
+	tests := []struct {
+		name    string
+		content string
+		stop    int // lines to take; 0 for all
+		want    []string
+	}{
+		{name: "empty"},
+		{name: "one line", content: "a\n", want: []string{"a"}},
+		{name: "no final newline", content: "a\nb", want: []string{"b", "a"}},
+		{name: "blank lines", content: "\n\na\n\nb\n", want: []string{"b", "a"}},
+		{name: "across blocks", content: "a\n" + long + "\nb\n" + long + "\n", want: []string{long, "b", long, "a"}},
+		{name: "stops early", content: "a\nb\nc\n", stop: 2, want: []string{"c", "b"}},
+		{name: "overlong line skipped", content: "a\n" + tooLong + "\nb\n", want: []string{"b", "a"}},
+		{name: "overlong first line skipped", content: tooLong + "\nb\n", want: []string{"b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "room.jsonl")
+			if err := os.WriteFile(path, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			var got []string
+			err = eachLineBackwards(f, func(line []byte) bool {
+				got = append(got, string(line))
+				return tt.stop == 0 || len(got) < tt.stop
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %d lines %.20q, want %d lines %.20q", len(got), got, len(tt.want), tt.want)
+			}
+		})
+	}
+}
+
+func TestChatHistoryBeforeLargeFile(t *testing.T) {
+	h, err := NewChatHistory(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2026, 1, 2, 10, 0, 0, 0, time.UTC)
+	text := strings.Repeat("long message ", 40)
+	const n = 2000
+	for i := 1; i <= n; i++ {
+		if err := h.Append("general", historyRecord{ID: uint64(i), Time: start.Add(time.Duration(i) * time.Second), Nickname: "ana", Text: text}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recs, more, err := h.Before("general", start.Add(1500*time.Second), 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 300 || recs[0].ID != 1200 || recs[299].ID != 1499 || !more {
+		t.Errorf("Before = %d records from %d to %d, more %v; want 1200 to 1499, more", len(recs), recs[0].ID, recs[len(recs)-1].ID, more)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Host keys are created on first start when missing. The key type follows
+// the file name the way OpenSSH names them: a name containing "rsa" gets an
+// RSA key, "ecdsa" a P-256 ECDSA key, anything else ed25519.
+
+const hostKeyRSABits = 3072
+
+// hostKeyType is the kind of key generated for path.
+func hostKeyType(path string) string {
+	name := strings.ToLower(filepath.Base(path))
+	switch {
+	case strings.Contains(name, "ecdsa"):
+		return "ecdsa"
+	case strings.Contains(name, "rsa"):
+		return "rsa"
+	}
+	return "ed25519"
+}
+
+// LoadHostKeys loads every host key in paths, generating the missing ones,
+// and logs their fingerprints so users can check what their client shows.
+func LoadHostKeys(paths []string) ([]ssh.Signer, error) {
+	var signers []ssh.Signer
+	seen := make(map[string]string) // key type -> path
+	for _, path := range paths {
+		signer, err := ensureHostKey(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		keyType := signer.PublicKey().Type()
+		if other, ok := seen[keyType]; ok {
+			// The SSH server keeps one key per type
+			return nil, fmt.Errorf("%s and %s are both %s keys", other, path, keyType)
+		}
+		seen[keyType] = path
+		logServer.Info("Host key", "path", path, "type", keyType, "fingerprint", ssh.FingerprintSHA256(signer.PublicKey()))
+		signers = append(signers, signer)
+	}
+	return signers, nil
+}
+
+// ensureHostKey loads the host key at path, or creates it if there is none.
+func ensureHostKey(path string) (ssh.Signer, error) {
+	keyBytes, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return generateHostKey(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if info, err := os.Stat(path); err == nil && info.Mode().Perm()&0077 != 0 {
+		logServer.Warn("Host key is readable by other users; run chmod 600 on it", "path", path, "mode", fmt.Sprintf("%04o", info.Mode().Perm()))
+	}
+	return ssh.ParsePrivateKey(keyBytes)
+}
+
+// generateHostKey writes a new private key to path, readable only by the
+// server's user, and its public half to path.pub.
+func generateHostKey(path string) (ssh.Signer, error) {
+	keyType := hostKeyType(path)
+	var key crypto.Signer
+	var err error
+	switch keyType {
+	case "rsa":
+		key, err = rsa.GenerateKey(rand.Reader, hostKeyRSABits)
+	case "ecdsa":
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	default:
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromSigner(key)
+	if err != nil {
+		return nil, err
+	}
+	block, err := ssh.MarshalPrivateKey(key, "rosewire host key")
+	if err != nil {
+		return nil, err
+	}
+
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+	}
+	// O_EXCL so a second server starting at the same time cannot swap
+	// the key under the first
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := pem.Encode(file, block); err != nil {
+		file.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	pub := ssh.MarshalAuthorizedKey(signer.PublicKey())
+	if err := os.WriteFile(path+".pub", pub, 0644); err != nil {
+		logServer.Error("Failed to write public host key", "path", path+".pub", "err", err)
+	}
+	logServer.Info("Generated new host key", "path", path, "type", keyType)
+	return signer, nil
+}
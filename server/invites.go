@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultInviteTTL is how long an invite code lasts unless the operator
+// says otherwise.
+const defaultInviteTTL = 7 * 24 * time.Hour
+
+// Invite lets one new nickname register on an invite-only relay.
+type Invite struct {
+	Code    string    `json:"code"`
+	By      string    `json:"by"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+}
+
+func (inv Invite) expired(now time.Time) bool {
+	return now.After(inv.Expires)
+}
+
+// errBadInvite is all a guesser learns about a code that did not work.
+var errBadInvite = errors.New("That invite code is not valid. It may have expired or been used already.")
+
+// InviteList is the persisted set of unused invite codes.
+type InviteList struct {
+	mu      sync.Mutex
+	path    string
+	invites []Invite
+}
+
+// LoadInviteList reads invites from path. A missing file is an empty list.
+func LoadInviteList(path string) (*InviteList, error) {
+	il := &InviteList{path: path}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return il, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &il.invites); err != nil {
+		return nil, err
+	}
+	return il, nil
+}
+
+// Create makes a new code valid for ttl.
+func (il *InviteList) Create(by string, ttl time.Duration) (Invite, error) {
+	raw := make([]byte, 10)
+	if _, err := rand.Read(raw); err != nil {
+		return Invite{}, err
+	}
+	now := time.Now().UTC()
+	inv := Invite{
+		Code:    base32.StdEncoding.EncodeToString(raw),
+		By:      by,
+		Created: now,
+		Expires: now.Add(ttl),
+	}
+	il.mu.Lock()
+	defer il.mu.Unlock()
+	il.invites = append(il.invites, inv)
+	return inv, il.save()
+}
+
+// Redeem uses up code if it is valid and register, called with the code
+// reserved, succeeds. A failed registration leaves the code usable.
+func (il *InviteList) Redeem(code string, register func() error) (Invite, error) {
+	code = normalizeInviteCode(code)
+	il.mu.Lock()
+	defer il.mu.Unlock()
+	il.prune()
+	for i, inv := range il.invites {
+		if subtle.ConstantTimeCompare([]byte(inv.Code), []byte(code)) != 1 {
+			continue
+		}
+		if err := register(); err != nil {
+			return Invite{}, err
+		}
+		il.invites = append(il.invites[:i:i], il.invites[i+1:]...)
+		if err := il.save(); err != nil {
+			logStore.Error("Failed to save invites", "path", il.path, "err", err)
+		}
+		return inv, nil
+	}
+	return Invite{}, errBadInvite
+}
+
+// Revoke drops an unused code. It reports whether there was one.
+func (il *InviteList) Revoke(code string) (bool, error) {
+	code = normalizeInviteCode(code)
+	il.mu.Lock()
+	defer il.mu.Unlock()
+	for i, inv := range il.invites {
+		if inv.Code == code {
+			il.invites = append(il.invites[:i:i], il.invites[i+1:]...)
+			return true, il.save()
+		}
+	}
+	return false, nil
+}
+
+// Pending returns the codes that can still be used, oldest first.
+func (il *InviteList) Pending() []Invite {
+	il.mu.Lock()
+	defer il.mu.Unlock()
+	il.prune()
+	return append([]Invite(nil), il.invites...)
+}
+
+// prune drops expired codes. Caller must hold il.mu.
+func (il *InviteList) prune() {
+	now := time.Now()
+	kept := il.invites[:0]
+	for _, inv := range il.invites {
+		if !inv.expired(now) {
+			kept = append(kept, inv)
+		}
+	}
+	if len(kept) != len(il.invites) {
+		il.invites = kept
+		if err := il.save(); err != nil {
+			logStore.Error("Failed to save invites", "path", il.path, "err", err)
+		}
+	}
+}
+
+// save writes the list atomically. Caller must hold il.mu.
+func (il *InviteList) save() error {
+	data, err := json.MarshalIndent(il.invites, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := il.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, il.path)
+}
+
+// formatInviteCode groups a code in fours for reading out.
+func formatInviteCode(code string) string {
+	var groups []string
+	for len(code) > 4 {
+		groups = append(groups, code[:4])
+		code = code[4:]
+	}
+	return strings.Join(append(groups, code), "-")
+}
+
+// normalizeInviteCode undoes formatInviteCode and forgives case and
+// stray spaces.
+func normalizeInviteCode(code string) string {
+	code = strings.ToUpper(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+func cmdInvite(c *ChatClient, ctx commandContext) {
+	ttl := defaultInviteTTL
+	if len(ctx.Args) > 0 {
+		d, err := parseModDuration(ctx.Args[0])
+		if err != nil {
+			c.sendSystem(err.Error())
+			return
+		}
+		ttl = d
+	}
+	inv, err := c.hub.invites.Create(c.nickname, ttl)
+	if err != nil {
+		logStore.Error("Failed to save invites", "path", c.hub.invites.path, "err", err)
+		c.sendSystem("Could not create an invite: " + err.Error())
+		return
+	}
+	logMod.Info("Created invite", "by", c.nickname, "expires", inv.Expires)
+	c.sendSystem(fmt.Sprintf("Invite code %s registers one new nickname until %s.",
+		formatInviteCode(inv.Code), inv.Expires.Format("02 Jan 2006 15:04 MST")))
+}
+
+func cmdInvites(c *ChatClient, ctx commandContext) {
+	pending := c.hub.invites.Pending()
+	if len(pending) == 0 {
+		c.sendSystem("No unused invite codes.")
+		return
+	}
+	lines := []string{"Unused invite codes:"}
+	for _, inv := range pending {
+		lines = append(lines, fmt.Sprintf("  %s by %s, expires %s",
+			formatInviteCode(inv.Code), inv.By, inv.Expires.Format("02 Jan 2006 15:04 MST")))
+	}
+	c.sendSystemLines(lines)
+}
+
+func cmdUninvite(c *ChatClient, ctx commandContext) {
+	ok, err := c.hub.invites.Revoke(ctx.Args[0])
+	if err != nil {
+		logStore.Error("Failed to save invites", "path", c.hub.invites.path, "err", err)
+		c.sendSystem("Could not revoke the invite: " + err.Error())
+		return
+	}
+	if !ok {
+		c.sendSystem("No such invite code.")
+		return
+	}
+	logMod.Info("Revoked invite", "by", c.nickname)
+	c.sendSystem("Invite code revoked.")
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInviteListRedeem(t *testing.T) {
+	errTaken := errors.New("nickname taken")
+	tests := []struct {
+		name        string
+		ttl         time.Duration
+		revoke      bool
+		code        func(code string) string // what the user types; nil for the code itself
+		registerErr error
+		wantErr     error
+		wantUsable  bool // the code still works afterwards
+	}{
+		{name: "valid", ttl: time.Hour},
+		{name: "formatted, lower case", ttl: time.Hour, code: func(code string) string {
+			return " " + strings.ToLower(formatInviteCode(code))
+		}},
+		{name: "expired", ttl: -time.Second, wantErr: errBadInvite},
+		{name: "revoked", ttl: time.Hour, revoke: true, wantErr: errBadInvite},
+		{name: "wrong code", ttl: time.Hour, code: func(string) string { return "AAAAAAAAAAAAAAAA" }, wantErr: errBadInvite, wantUsable: true},
+		{name: "registration fails", ttl: time.Hour, registerErr: errTaken, wantErr: errTaken, wantUsable: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "invites.json")
+			il, err := LoadInviteList(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			inv, err := il.Create("ana", tt.ttl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.revoke {
+				if ok, err := il.Revoke(strings.ToLower(inv.Code)); !ok || err != nil {
+					t.Fatalf("Revoke = %v, %v; want true, nil", ok, err)
+				}
+			}
+			typed := inv.Code
+			if tt.code != nil {
+				typed = tt.code(inv.Code)
+			}
+			registered := 0
+			got, err := il.Redeem(typed, func() error {
+				registered++
+				return tt.registerErr
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Redeem = %v, want %v", err, tt.wantErr)
+			}
+			wantCalls := 0
+			if tt.wantErr == nil || tt.registerErr != nil {
+				wantCalls = 1 // only a code that checks out registers
+			}
+			if registered != wantCalls {
+				t.Errorf("register called %d times, want %d", registered, wantCalls)
+			}
+			if err == nil && got.Code != inv.Code {
+				t.Errorf("Redeem returned code %s, want %s", got.Code, inv.Code)
+			}
+
+			// A second attempt, after a restart
+			il, err = LoadInviteList(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = il.Redeem(inv.Code, func() error { return nil })
+			if usable := err == nil; usable != tt.wantUsable {
+				t.Errorf("second Redeem: %v; want usable = %v", err, tt.wantUsable)
+			}
+		})
+	}
+}
+
+func TestInviteListRevokeUnknown(t *testing.T) {
+	il, err := LoadInviteList(filepath.Join(t.TempDir(), "invites.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := il.Revoke("AAAA-BBBB"); ok || err != nil {
+		t.Errorf("Revoke of an unknown code = %v, %v; want false, nil", ok, err)
+	}
+}
+
+func TestInviteListPendingDropsExpired(t *testing.T) {
+	il, err := LoadInviteList(filepath.Join(t.TempDir(), "invites.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keep, _ := il.Create("ana", time.Hour)
+	il.Create("bob", -time.Second)
+	pending := il.Pending()
+	if len(pending) != 1 || pending[0].Code != keep.Code {
+		t.Errorf("Pending = %+v, want only %s", pending, keep.Code)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// KeepaliveConfig controls how dead connections are found. A client that
+// vanishes without closing its TCP connection would otherwise stay online,
+// with its files searchable, until the kernel gives up on the socket.
+type KeepaliveConfig struct {
+	// PingInterval is how often the chat subsystem sends a ping.
+	PingInterval time.Duration `yaml:"ping_interval"`
+	// PingTimeout is how long a client may go without sending anything,
+	// pongs included, before it is disconnected.
+	PingTimeout time.Duration `yaml:"ping_timeout"`
+	// SSHInterval is how often a keepalive@openssh.com request is sent on
+	// each connection, and SSHTimeout how long to wait for its reply.
+	SSHInterval time.Duration `yaml:"ssh_interval"`
+	SSHTimeout  time.Duration `yaml:"ssh_timeout"`
+}
+
+// DefaultKeepaliveConfig is used unless flags say otherwise.
+func DefaultKeepaliveConfig() KeepaliveConfig {
+	return KeepaliveConfig{
+		PingInterval: 30 * time.Second,
+		PingTimeout:  90 * time.Second,
+		SSHInterval:  30 * time.Second,
+		SSHTimeout:   15 * time.Second,
+	}
+}
+
+// isKeepalive reports whether a message type is keepalive traffic, which
+// does not count as user activity.
+func isKeepalive(msgType string) bool {
+	return msgType == "ping" || msgType == "pong"
+}
+
+// heard records that the client sent something.
+func (c *ChatClient) heard() {
+	c.lastHeard.Store(time.Now().UnixNano())
+}
+
+// keepaliveRecheck is how often a connection whose keepalive is off looks
+// whether a reload has turned it on.
+const keepaliveRecheck = 30 * time.Second
+
+// keepaliveTicker ticks every keepalive interval, following the interval
+// as reloads change it.
+type keepaliveTicker struct {
+	*time.Ticker
+	interval time.Duration
+}
+
+func newKeepaliveTicker(interval time.Duration) *keepaliveTicker {
+	t := &keepaliveTicker{interval: interval}
+	t.Ticker = time.NewTicker(t.period())
+	return t
+}
+
+func (t *keepaliveTicker) period() time.Duration {
+	if t.interval <= 0 {
+		return keepaliveRecheck
+	}
+	return t.interval
+}
+
+// update switches to interval, if it changed, and reports whether
+// keepalives are on.
+func (t *keepaliveTicker) update(interval time.Duration) bool {
+	if interval != t.interval {
+		t.interval = interval
+		t.Reset(t.period())
+	}
+	return interval > 0
+}
+
+// pingLoop pings the client and closes it once it has been silent for
+// longer than the ping timeout. It reads the settings on every tick, so a
+// reload applies to clients already connected.
+func (c *ChatClient) pingLoop() {
+	ticker := newKeepaliveTicker(c.hub.config().Keepalive.PingInterval)
+	defer ticker.Stop()
+	var seq uint64
+	for {
+		select {
+		case <-ticker.C:
+			cfg := c.hub.config().Keepalive
+			if !ticker.update(cfg.PingInterval) {
+				continue
+			}
+			silent := time.Since(time.Unix(0, c.lastHeard.Load()))
+			if cfg.PingTimeout > 0 && silent > cfg.PingTimeout {
+				c.log.Info("Client silent too long, disconnecting", "silent", silent.Round(time.Second))
+				if c.conn != nil {
+					c.conn.Close()
+				}
+				c.Close()
+				return
+			}
+			seq++
+			c.send("ping", PingPayload{Seq: seq})
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// sshKeepalive sends keepalive requests on an SSH connection and closes it
+// if one goes unanswered. It returns when the connection is closed.
+// Like pingLoop it asks settings for the current values on every tick.
+func sshKeepalive(conn ssh.Conn, settings func() KeepaliveConfig) {
+	ticker := newKeepaliveTicker(settings().SSHInterval)
+	defer ticker.Stop()
+	closed := make(chan struct{})
+	go func() {
+		conn.Wait()
+		close(closed)
+	}()
+
+	for {
+		select {
+		case <-ticker.C:
+			cfg := settings()
+			if !ticker.update(cfg.SSHInterval) {
+				continue
+			}
+			replied := make(chan error, 1)
+			go func() {
+				// The reply's content does not matter; clients refuse
+				// unknown requests, which still proves they are there
+				_, _, err := conn.SendRequest("keepalive@openssh.com", true, nil)
+				replied <- err
+			}()
+			timer := time.NewTimer(cfg.SSHTimeout)
+			select {
+			case err := <-replied:
+				timer.Stop()
+				if err != nil {
+					conn.Close()
+					return
+				}
+			case <-timer.C:
+				logSSH.Info("No SSH keepalive reply, closing", "conn", connID(conn), "nick", conn.User(), "timeout", cfg.SSHTimeout)
+				conn.Close()
+				return
+			case <-closed:
+				timer.Stop()
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPingLoopFollowsReload(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Keepalive.PingInterval = 10 * time.Millisecond
+	cfg.Keepalive.PingTimeout = time.Hour
+	hub := newTestHub(t, cfg)
+	c := newTestClient(hub, "ana")
+	c.heard()
+	stopped := make(chan struct{})
+	go func() {
+		c.pingLoop()
+		close(stopped)
+	}()
+	defer func() {
+		close(c.done)
+		<-stopped
+	}()
+
+	select {
+	case <-c.controlOut:
+	case <-time.After(time.Second):
+		t.Fatal("no ping")
+	}
+	off := cfg
+	off.Keepalive.PingInterval = 0
+	hub.settings.Store(&off)
+	// The tick that reads the reload may already have pinged
+	time.Sleep(50 * time.Millisecond)
+	sent(t, c)
+	select {
+	case <-c.controlOut:
+		t.Error("pinged after a reload turned pings off")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestKeepaliveTickerUpdate(t *testing.T) {
+	tests := []struct {
+		name       string
+		from, to   time.Duration
+		wantOn     bool
+		wantPeriod time.Duration
+	}{
+		{name: "unchanged", from: time.Minute, to: time.Minute, wantOn: true, wantPeriod: time.Minute},
+		{name: "shorter", from: time.Minute, to: time.Second, wantOn: true, wantPeriod: time.Second},
+		{name: "turned off", from: time.Minute, to: 0, wantPeriod: keepaliveRecheck},
+		{name: "turned on", from: 0, to: time.Second, wantOn: true, wantPeriod: time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ticker := newKeepaliveTicker(tt.from)
+			defer ticker.Stop()
+			if on := ticker.update(tt.to); on != tt.wantOn {
+				t.Errorf("update = %v, want %v", on, tt.wantOn)
+			}
+			if p := ticker.period(); p != tt.wantPeriod {
+				t.Errorf("period = %s, want %s", p, tt.wantPeriod)
+			}
+		})
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SIGTERM or SIGINT stops the relay gently: it stops accepting connections,
+// tells everyone, lets transfers in progress run for up to the shutdown
+// timeout, then disconnects the rest. A second signal cuts the wait short.
+// SIGHUP reloads the configuration and the files it names without dropping
+// anyone.
+
+// defaultShutdownTimeout is how long transfers get to finish on shutdown.
+const defaultShutdownTimeout = 30 * time.Second
+
+// relay is what main starts, as far as stopping and reloading it go.
+type relay struct {
+	cfg      Config
+	hub      *ChatHub
+	auth     *authenticator
+	users    *Users
+	mailbox  *Mailbox
+	bans     *BanList
+	data     *DataStreamManager
+	listener net.Listener
+	status   *http.Server // nil without the status page
+}
+
+// run serves SSH connections until told to stop.
+func (r *relay) run(config *ssh.ServerConfig) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	go r.serve(config)
+	for sig := range signals {
+		if sig == syscall.SIGHUP {
+			r.reload()
+			continue
+		}
+		logServer.Info("Shutting down", "signal", sig.String())
+		r.shutdown(signals)
+		return
+	}
+}
+
+func (r *relay) serve(config *ssh.ServerConfig) {
+	for {
+		nConn, err := r.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logSSH.Error("Failed to accept", "err", err)
+			continue
+		}
+		go handleConn(nConn, config, r.hub, r.data)
+	}
+}
+
+// shutdown drains the relay. State on disk is written as it changes, so
+// once the clients are gone main only has to close the user store.
+func (r *relay) shutdown(signals <-chan os.Signal) {
+	r.listener.Close()
+	if r.status != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		r.status.Shutdown(ctx)
+		cancel()
+	}
+	// Transfers are in flight while their data streams copy, or while
+	// they wait for their first pair
+	inFlight := func() int { return r.hub.pendingTransfers() + r.data.Active() }
+	r.hub.beginShutdown(r.cfg.ShutdownTimeout, inFlight() > 0)
+
+	deadline := time.NewTimer(r.cfg.ShutdownTimeout)
+	defer deadline.Stop()
+	tick := time.NewTicker(250 * time.Millisecond)
+	defer tick.Stop()
+wait:
+	for {
+		n := inFlight()
+		if n == 0 {
+			break
+		}
+		select {
+		case <-tick.C:
+		case <-deadline.C:
+			logServer.Warn("Shutdown timeout reached", "transfers", n)
+			break wait
+		case sig := <-signals:
+			if sig != syscall.SIGHUP {
+				logServer.Warn("Stopping without waiting for transfers", "signal", sig.String(), "transfers", n)
+				break wait
+			}
+			logServer.Info("Ignoring SIGHUP while shutting down")
+		}
+	}
+
+	r.hub.closeAll("The relay has shut down.")
+	for wait := time.Now().Add(2 * time.Second); r.hub.clientCount() > 0 && time.Now().Before(wait); {
+		time.Sleep(50 * time.Millisecond)
+	}
+	logServer.Info("Relay stopped")
+}
+
+// reload rereads the configuration and the files it names. Either all of
+// it takes effect or, if anything is wrong, none of it does. Logins made
+// after the reload see all of it; sessions already running pick up the
+// limits, MOTD and policies they consult as they go.
+func (r *relay) reload() {
+	logServer.Info("Reloading configuration")
+	cfg, _, err := LoadConfig(os.Args[1:])
+	if err != nil {
+		logServer.Error("Reload failed, keeping the current configuration", "err", err)
+		return
+	}
+	cfg = r.keepRestartOnly(cfg)
+	policy, err := loadAuthPolicy(cfg)
+	if err != nil {
+		logServer.Error("Reload failed, keeping the current configuration", "err", err)
+		return
+	}
+	nickPolicy, err := LoadNickPolicy(cfg.Paths.ReservedNicks)
+	if err != nil {
+		logServer.Error("Reload failed, keeping the current configuration", "path", cfg.Paths.ReservedNicks, "err", err)
+		return
+	}
+	bans, err := readBans(cfg.Paths.Bans)
+	if err != nil {
+		logServer.Error("Reload failed, keeping the current configuration", "path", cfg.Paths.Bans, "err", err)
+		return
+	}
+
+	r.auth.policy.Store(policy)
+	r.users.SetPolicy(nickPolicy)
+	r.bans.Replace(bans)
+	r.mailbox.SetLimit(cfg.Limits.MaxOfflineMessages)
+	r.hub.settings.Store(&cfg)
+	applyLogLevels(cfg.Log)
+	r.cfg = cfg
+	r.hub.dropBanned()
+	logServer.Info("Reloaded configuration")
+}
+
+// keepRestartOnly carries over the settings a running relay cannot change,
+// saying which of them would need a restart.
+func (r *relay) keepRestartOnly(next Config) Config {
+	cur := r.cfg
+	changed := map[string]bool{
+		"listen":                next.Listen != cur.Listen,
+		"status_listen":         next.StatusListen != cur.StatusListen,
+		"user_store_backend":    next.UserStoreBackend != cur.UserStoreBackend,
+		"features.status_page":  next.Features.StatusPage != cur.Features.StatusPage,
+		"features.chat_history": next.Features.ChatHistory != cur.Features.ChatHistory,
+		"paths":                 !reflect.DeepEqual(next.Paths, cur.Paths),
+		"log.format":            next.Log.Format != cur.Log.Format,
+	}
+	for name, ok := range changed {
+		if ok {
+			logServer.Warn("Setting changed; restart the relay to apply it", "setting", name)
+		}
+	}
+	next.Listen = cur.Listen
+	next.StatusListen = cur.StatusListen
+	next.UserStoreBackend = cur.UserStoreBackend
+	next.Features.StatusPage = cur.Features.StatusPage
+	next.Features.ChatHistory = cur.Features.ChatHistory
+	next.Paths = cur.Paths
+	next.Log.Format = cur.Log.Format
+	return next
+}
+
+// beginShutdown refuses new transfers and warns everyone, saying how long
+// those in progress have if there are any.
+func (hub *ChatHub) beginShutdown(grace time.Duration, busy bool) {
+	hub.shuttingDown.Store(true)
+	if !busy || grace <= 0 {
+		hub.announce("The relay is shutting down now.")
+		return
+	}
+	hub.announce(fmt.Sprintf("The relay is shutting down. Transfers in progress have up to %s to finish; new ones are refused.", grace))
+}
+
+// pendingTransfers counts transfers whose data streams have yet to pair
+// and whose ends are both still online. Unpaired ones expire after
+// dataStreamPairTimeout.
+func (hub *ChatHub) pendingTransfers() int {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	n := 0
+	for _, t := range hub.transfers {
+		_, from := hub.clients[t.FromUser]
+		_, to := hub.clients[t.ToUser]
+		if from && to && !t.Paired {
+			n++
+		}
+	}
+	return n
+}
+
+func (hub *ChatHub) clientCount() int {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	return len(hub.clients)
+}
+
+// snapshotClients returns the connected clients, for work that must not
+// hold hub.mu.
+func (hub *ChatHub) snapshotClients() []*ChatClient {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	clients := make([]*ChatClient, 0, len(hub.clients))
+	for _, c := range hub.clients {
+		clients = append(clients, c)
+	}
+	return clients
+}
+
+// closeAll disconnects everyone with reason.
+func (hub *ChatHub) closeAll(reason string) {
+	for _, c := range hub.snapshotClients() {
+		c.disconnect(reason)
+	}
+}
+
+// dropBanned disconnects clients a reloaded ban list now covers.
+func (hub *ChatHub) dropBanned() {
+	for _, c := range hub.snapshotClients() {
+		if ban, banned := hub.bans.Check(c.nickname, c.fingerprint); banned {
+			logMod.Info("Disconnecting user banned in the reloaded ban list", "nick", c.nickname, "session", c.session)
+			c.disconnect("You have been " + ban.describe())
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The relay logs through log/slog. Each part of it has its own logger and
+// level, so one can be turned up to debug without drowning in the others.
+// Records carry a "subsystem" field, plus whichever of "conn", "nick",
+// "session" and "transfer" apply.
+
+// LogConfig controls logging.
+type LogConfig struct {
+	// Level is the default level: debug, info, warn or error.
+	Level string `yaml:"level"`
+	// Levels overrides Level per subsystem.
+	Levels map[string]string `yaml:"levels"`
+	// Format is "text" or "json".
+	Format string `yaml:"format"`
+	// Redact replaces file names and search queries with a keyed hash,
+	// so logs do not say who downloaded or searched for what.
+	Redact bool `yaml:"redact"`
+}
+
+func DefaultLogConfig() LogConfig {
+	return LogConfig{Level: "info", Format: "text", Redact: true}
+}
+
+// The loggers, one per subsystem. Until setupLogging runs they write
+// through the standard logger.
+var (
+	logServer   = slog.Default() // startup, shutdown, reload
+	logSSH      = slog.Default() // connections and channels
+	logAuth     = slog.Default() // logins and registration
+	logChat     = slog.Default() // chat sessions and messages
+	logTransfer = slog.Default() // file transfers and data streams
+	logFiles    = slog.Default() // shared file lists and searches
+	logMod      = slog.Default() // operator actions
+	logStore    = slog.Default() // persisted state
+)
+
+var subsystemLoggers = map[string]**slog.Logger{
+	"server":   &logServer,
+	"ssh":      &logSSH,
+	"auth":     &logAuth,
+	"chat":     &logChat,
+	"transfer": &logTransfer,
+	"files":    &logFiles,
+	"mod":      &logMod,
+	"store":    &logStore,
+}
+
+// logLevels holds each subsystem's level once setupLogging has run.
+var logLevels = make(map[string]*slog.LevelVar)
+
+// logSubsystems lists the subsystem names, sorted.
+func logSubsystems() []string {
+	names := make([]string, 0, len(subsystemLoggers))
+	for name := range subsystemLoggers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// setupLogging points every logger at w in the configured format. It runs
+// once, before anything else logs; applyLogLevels changes levels later.
+func setupLogging(cfg LogConfig, w io.Writer) {
+	for name, logger := range subsystemLoggers {
+		level := new(slog.LevelVar)
+		logLevels[name] = level
+		opts := &slog.HandlerOptions{Level: level}
+		var h slog.Handler
+		if cfg.Format == "json" {
+			h = slog.NewJSONHandler(w, opts)
+		} else {
+			h = slog.NewTextHandler(w, opts)
+		}
+		*logger = slog.New(h).With("subsystem", name)
+	}
+	applyLogLevels(cfg)
+	// Whatever still uses the log package, such as net/http, goes to the
+	// server logger
+	slog.SetDefault(logServer)
+}
+
+// applyLogLevels sets each subsystem's level and the redaction switch.
+// cfg must be valid.
+func applyLogLevels(cfg LogConfig) {
+	def, _ := parseLogLevel(cfg.Level)
+	for name, level := range logLevels {
+		l := def
+		if s, ok := cfg.Levels[name]; ok {
+			l, _ = parseLogLevel(s)
+		}
+		level.Set(l)
+	}
+	logRedact.Store(cfg.Redact)
+}
+
+func parseLogLevel(s string) (slog.Level, error) {
+	var l slog.Level
+	err := l.UnmarshalText([]byte(s))
+	return l, err
+}
+
+// validate reports problems with cfg for Config.Validate.
+func (cfg LogConfig) validate() []error {
+	var errs []error
+	if _, err := parseLogLevel(cfg.Level); err != nil {
+		errs = append(errs, fmt.Errorf("log.level: %q is not a level (want debug, info, warn or error)", cfg.Level))
+	}
+	for name, s := range cfg.Levels {
+		if _, ok := subsystemLoggers[name]; !ok {
+			errs = append(errs, fmt.Errorf("log.levels: unknown subsystem %q (want one of %s)", name, strings.Join(logSubsystems(), ", ")))
+		} else if _, err := parseLogLevel(s); err != nil {
+			errs = append(errs, fmt.Errorf("log.levels.%s: %q is not a level", name, s))
+		}
+	}
+	if cfg.Format != "text" && cfg.Format != "json" {
+		errs = append(errs, fmt.Errorf("log.format: unknown format %q (want \"text\" or \"json\")", cfg.Format))
+	}
+	return errs
+}
+
+// levelsFlag binds -log-levels, a comma-separated list of
+// subsystem=level, to LogConfig.Levels.
+type levelsFlag struct{ p *map[string]string }
+
+func (f levelsFlag) String() string {
+	if f.p == nil {
+		return ""
+	}
+	var pairs []string
+	for name, level := range *f.p {
+		pairs = append(pairs, name+"="+level)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (f levelsFlag) Set(s string) error {
+	levels := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, level, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("bad level %q (want subsystem=level)", pair)
+		}
+		levels[name] = level
+	}
+	*f.p = levels
+	return nil
+}
+
+// fatal logs at error level and exits, for startup failures.
+func fatal(msg string, args ...any) {
+	logServer.Error(msg, args...)
+	os.Exit(1)
+}
+
+var (
+	logRedact atomic.Bool
+	redactKey = newRedactKey()
+)
+
+func newRedactKey() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		log.Fatalf("Failed to create log redaction key: %v", err)
+	}
+	return key
+}
+
+// private logs a file name or search query, or with redaction on a hash
+// of it that is the same for the same text until the relay restarts, so
+// lines about one file can still be matched up.
+func private(key, value string) slog.Attr {
+	if !logRedact.Load() {
+		return slog.String(key, value)
+	}
+	mac := hmac.New(sha256.New, redactKey)
+	mac.Write([]byte(value))
+	return slog.String(key, "redacted:"+hex.EncodeToString(mac.Sum(nil)[:6]))
+}
+
+// connID names an SSH connection in logs, from its session ID.
+func connID(meta ssh.ConnMetadata) string {
+	id := meta.SessionID()
+	if len(id) > 4 {
+		id = id[:4]
+	}
+	return hex.EncodeToString(id)
+}
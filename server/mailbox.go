@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+)
+
+// defaultMaxOfflineMessages caps how many private messages wait for one
+// user, unless configured otherwise.
+const defaultMaxOfflineMessages = 100
+
+var errMailboxFull = errors.New("recipient's offline mailbox is full")
+
+// Mailbox holds private messages for users who are not connected, persisted
+// to disk so they survive a relay restart.
+type Mailbox struct {
+	mu      sync.Mutex
+	path    string
+	limit   int
+	pending map[string][]PrivateMessageDeliveryPayload // recipient -> messages
+}
+
+// LoadMailbox reads stored messages from path. A missing file is an empty
+// mailbox. Each user can have up to limit messages waiting.
+func LoadMailbox(path string, limit int) (*Mailbox, error) {
+	mb := &Mailbox{
+		path:    path,
+		limit:   limit,
+		pending: make(map[string][]PrivateMessageDeliveryPayload),
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return mb, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &mb.pending); err != nil {
+		return nil, err
+	}
+	return mb, nil
+}
+
+// SetLimit changes how many messages each user can have waiting. Mailboxes
+// already over it keep what they have.
+func (mb *Mailbox) SetLimit(limit int) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.limit = limit
+}
+
+// Store queues msg for its recipient.
+func (mb *Mailbox) Store(msg PrivateMessageDeliveryPayload) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	queued, ok := mb.pending[msg.To]
+	if len(queued) >= mb.limit {
+		return errMailboxFull
+	}
+	mb.pending[msg.To] = append(queued, msg)
+	if err := mb.save(); err != nil {
+		// Not stored, so do not deliver it either
+		if ok {
+			mb.pending[msg.To] = queued
+		} else {
+			delete(mb.pending, msg.To)
+		}
+		return err
+	}
+	return nil
+}
+
+// Take removes and returns everything waiting for nickname.
+func (mb *Mailbox) Take(nickname string) []PrivateMessageDeliveryPayload {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	msgs, ok := mb.pending[nickname]
+	if !ok {
+		return nil
+	}
+	delete(mb.pending, nickname)
+	if err := mb.save(); err != nil {
+		// Keep them in memory so they are not lost
+		mb.pending[nickname] = msgs
+		return nil
+	}
+	return msgs
+}
+
+// save writes the mailbox atomically. Caller must hold mb.mu.
+func (mb *Mailbox) save() error {
+	data, err := json.Marshal(mb.pending)
+	if err != nil {
+		return err
+	}
+	tmp := mb.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, mb.path)
+}
@@ -1,55 +1,56 @@
 package main
 
 import (
-	"bufio"
-	"encoding/base64"
-	"errors"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/crypto/ssh"
 )
 
-const (
-	serverHost  = "0.0.0.0"
-	serverPort  = 2222
-	hostKeyFile = "server_ed25519"
-	nickDBFile  = "nicks.db"
-)
-
-var (
-	statusHTTPListen = "127.0.0.1:8080" // set to "0.0.0.0:8080" for public access
-)
+// dataStreamPairTimeout is how long a data stream waits for its peer, and
+// a requested transfer for its first pair.
+const dataStreamPairTimeout = 30 * time.Second
 
 // DataStreamManager handles pairing data channels for parallel transfers.
 type DataStreamManager struct {
 	mu      sync.Mutex
 	pending map[string]ssh.Channel // Key: "transferID:streamIndex", Value: the first channel that connected
+	active  atomic.Int32           // paired streams still copying
+	paired  func(transferID string)
 }
 
-// NewDataStreamManager creates a new manager instance.
-func NewDataStreamManager() *DataStreamManager {
+// NewDataStreamManager creates a new manager instance. paired is called
+// whenever two streams of a transfer are piped together.
+func NewDataStreamManager(paired func(transferID string)) *DataStreamManager {
 	return &DataStreamManager{
 		pending: make(map[string]ssh.Channel),
+		paired:  paired,
 	}
 }
 
+// Active returns how many paired streams are still copying.
+func (dsm *DataStreamManager) Active() int {
+	return int(dsm.active.Load())
+}
+
 // pipeStreams bi-directionally copies data between two channels using a deadlock-safe pattern.
-func pipeStreams(c1, c2 ssh.Channel) {
+// done is called once both are closed.
+func pipeStreams(c1, c2 ssh.Channel, done func()) {
 	var once sync.Once
 	// The close function will be called exactly once by the first goroutine to finish.
 	closeFunc := func() {
 		c1.Close()
 		c2.Close()
-		// Removed RemoteAddr as it's not available on ssh.Channel
-		log.Printf("Finished piping streams.")
+		done()
 	}
 
 	// Copy from c1 to c2
@@ -68,6 +69,7 @@ func pipeStreams(c1, c2 ssh.Channel) {
 // Pair finds the peer for the given key and pipes them together.
 // If the peer is not found, it stores newChan and waits.
 func (dsm *DataStreamManager) Pair(key string, newChan ssh.Channel) {
+	logger := streamLog(key)
 	dsm.mu.Lock()
 	peerChan, ok := dsm.pending[key]
 	if ok {
@@ -75,25 +77,33 @@ func (dsm *DataStreamManager) Pair(key string, newChan ssh.Channel) {
 		delete(dsm.pending, key)
 		dsm.mu.Unlock()
 
-		log.Printf("Pairing streams for key %s", key)
-		go pipeStreams(newChan, peerChan)
+		logger.Debug("Pairing data streams")
+		if dsm.paired != nil {
+			id, _, _ := strings.Cut(key, ":")
+			dsm.paired(id)
+		}
+		dsm.active.Add(1)
+		go pipeStreams(newChan, peerChan, func() {
+			dsm.active.Add(-1)
+			logger.Debug("Data streams finished")
+		})
 		return
 	}
 
 	// We are the first. Add to map and wait for peer.
 	dsm.pending[key] = newChan
 	dsm.mu.Unlock()
-	log.Printf("Stream for key %s is pending a peer", key)
+	logger.Debug("Data stream waiting for its peer")
 
 	// Add a timeout to prevent dangling channels.
 	// The newChan.Context() method does not exist, so we rely only on the timer.
 	// If a client disconnects, this entry will leak for 30 seconds before being cleaned up.
 	go func() {
-		<-time.After(30 * time.Second) // 30 second timeout to connect
+		<-time.After(dataStreamPairTimeout)
 		dsm.mu.Lock()
 		// Check if we are still pending after the timeout
 		if ch, stillPending := dsm.pending[key]; stillPending && ch == newChan {
-			log.Printf("Timed out waiting for peer for key %s. Closing channel.", key)
+			logger.Warn("Timed out waiting for the peer data stream")
 			delete(dsm.pending, key)
 			newChan.Close()
 		}
@@ -101,145 +111,134 @@ func (dsm *DataStreamManager) Pair(key string, newChan ssh.Channel) {
 	}()
 }
 
-type NickDB struct {
-	sync.Mutex
-	NickToKey map[string]string // nickname -> base64 public key
+// streamLog logs about the data stream with key "transferID:streamIndex".
+func streamLog(key string) *slog.Logger {
+	id, stream, _ := strings.Cut(key, ":")
+	return logTransfer.With("transfer", id, "stream", stream)
 }
 
-func LoadNickDB(path string) (*NickDB, error) {
-	db := &NickDB{NickToKey: make(map[string]string)}
-	file, err := os.Open(path)
+func main() {
+	cfg, printConfig, err := LoadConfig(os.Args[1:])
 	if err != nil {
-		if os.IsNotExist(err) {
-			return db, nil
+		// Logging is not set up yet, and may be what is wrong
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+	if printConfig {
+		if err := cfg.Print(os.Stdout); err != nil {
+			fatal("Failed to print the configuration", "err", err)
 		}
-		return nil, err
+		return
 	}
-	defer file.Close()
+	paths := cfg.Paths
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		parts := strings.SplitN(scanner.Text(), " ", 2)
-		if len(parts) != 2 {
-			continue
-		}
-		db.NickToKey[parts[0]] = parts[1]
+	setupLogging(cfg.Log, os.Stderr)
+	logServer.Info("Starting RoseWire relay server", "listen", cfg.Listen)
+	hostSigners, err := LoadHostKeys(paths.HostKeys)
+	if err != nil {
+		fatal("Failed to load host keys", "err", err)
 	}
-	return db, scanner.Err()
-}
 
-func (db *NickDB) Save(path string) error {
-	db.Lock()
-	defer db.Unlock()
-	tmp := path + ".tmp"
-	f, err := os.Create(tmp)
+	userStore, err := OpenUserStore(cfg.UserStoreBackend, paths.UserStore, paths.LegacyNickDB)
 	if err != nil {
-		return err
+		fatal("Failed to open user store", "path", paths.UserStore, "err", err)
 	}
-	defer f.Close()
-	for nick, key := range db.NickToKey {
-		fmt.Fprintf(f, "%s %s\n", nick, key)
+	defer userStore.Close()
+	nickPolicy, err := LoadNickPolicy(paths.ReservedNicks)
+	if err != nil {
+		fatal("Failed to load reserved nicknames", "path", paths.ReservedNicks, "err", err)
 	}
-	return os.Rename(tmp, path)
-}
+	users := NewUsers(userStore, nickPolicy)
 
-func (db *NickDB) Register(nick string, pubkey ssh.PublicKey) error {
-	db.Lock()
-	defer db.Unlock()
-	keyStr := base64.StdEncoding.EncodeToString(pubkey.Marshal())
-	if old, ok := db.NickToKey[nick]; ok {
-		if old != keyStr {
-			return errors.New("nickname already taken with different key")
-		}
-	} else {
-		db.NickToKey[nick] = keyStr
+	mailbox, err := LoadMailbox(paths.Mailbox, cfg.Limits.MaxOfflineMessages)
+	if err != nil {
+		fatal("Failed to load mailbox", "path", paths.Mailbox, "err", err)
 	}
-	return nil
-}
 
-func ensureHostKey(path string) (ssh.Signer, error) {
-	keyBytes, err := os.ReadFile(path)
+	historyDir := paths.History
+	if !cfg.Features.ChatHistory {
+		historyDir = ""
+	}
+	history, err := NewChatHistory(historyDir)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Host key %s not found. Generate with:\n\n    ssh-keygen -t ed25519 -f %s\n\n", path, path)
-		return nil, err
+		fatal("Failed to open chat history", "path", historyDir, "err", err)
 	}
-	return ssh.ParsePrivateKey(keyBytes)
-}
 
-func main() {
-	fmt.Printf("Starting RoseWire relay server on %s:%d ...\n", serverHost, serverPort)
-	hostSigner, err := ensureHostKey(hostKeyFile)
+	bans, err := LoadBanList(paths.Bans)
 	if err != nil {
-		log.Fatalf("Failed to load host key: %v", err)
+		fatal("Failed to load ban list", "path", paths.Bans, "err", err)
 	}
-
-	nickDB, err := LoadNickDB(nickDBFile)
+	invites, err := LoadInviteList(paths.Invites)
 	if err != nil {
-		log.Fatalf("Failed to load nick DB: %v", err)
+		fatal("Failed to load invites", "path", paths.Invites, "err", err)
+	}
+	policy, err := loadAuthPolicy(cfg)
+	if err != nil {
+		fatal("Failed to load access lists", "err", err)
 	}
 
 	fileRegistry := NewFileRegistry()
-	chatHub := NewChatHub(fileRegistry)
-	dataManager := NewDataStreamManager()
+	chatHub := NewChatHub(fileRegistry, users, mailbox, history, bans, invites, cfg)
+	dataManager := NewDataStreamManager(chatHub.transferPaired)
 
-	statusSvc := NewStatusService(chatHub, statusHTTPListen)
-	go func() {
-		log.Printf("Status web server listening at http://%s/", statusHTTPListen)
+	var statusServer *http.Server
+	if cfg.Features.StatusPage {
+		statusSvc := NewStatusService(chatHub, cfg.StatusListen)
 		http.Handle("/", statusSvc)
 		http.Handle("/api/status", statusSvc)
-		http.ListenAndServe(statusHTTPListen, nil)
-	}()
+		statusServer = &http.Server{Addr: cfg.StatusListen}
+		go func() {
+			logServer.Info("Status web server listening", "url", "http://"+cfg.StatusListen+"/")
+			if err := statusServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logServer.Error("Status web server stopped", "err", err)
+			}
+		}()
+	}
 
+	auth := &authenticator{
+		users:   users,
+		bans:    bans,
+		invites: invites,
+	}
+	auth.policy.Store(policy)
 	config := &ssh.ServerConfig{
-		PublicKeyCallback: func(meta ssh.ConnMetadata, pubKey ssh.PublicKey) (*ssh.Permissions, error) {
-			nick := meta.User()
-			if nick == "" {
-				return nil, fmt.Errorf("nickname missing")
-			}
-			err := nickDB.Register(nick, pubKey)
-			if err != nil {
-				return nil, err
-			}
-			if err := nickDB.Save(nickDBFile); err != nil {
-				log.Printf("Error saving nick DB: %v", err)
-			}
-			return &ssh.Permissions{
-				Extensions: map[string]string{
-					"nickname": nick,
-				},
-			}, nil
-		},
+		PublicKeyCallback: auth.publicKey,
+	}
+	for _, signer := range hostSigners {
+		config.AddHostKey(signer)
 	}
-	config.AddHostKey(hostSigner)
 
-	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", serverHost, serverPort))
+	listener, err := net.Listen("tcp", cfg.Listen)
 	if err != nil {
-		log.Fatalf("Failed to listen: %v", err)
+		fatal("Failed to listen", "addr", cfg.Listen, "err", err)
 	}
-	defer listener.Close()
-
-	for {
-		nConn, err := listener.Accept()
-		if err != nil {
-			log.Printf("Failed to accept: %v", err)
-			continue
-		}
-		go handleConn(nConn, config, chatHub, dataManager)
+	r := &relay{
+		cfg:      cfg,
+		hub:      chatHub,
+		auth:     auth,
+		users:    users,
+		mailbox:  mailbox,
+		bans:     bans,
+		data:     dataManager,
+		listener: listener,
+		status:   statusServer,
 	}
+	r.run(config)
 }
 
 func handleConn(nConn net.Conn, config *ssh.ServerConfig, chatHub *ChatHub, dataManager *DataStreamManager) {
 	defer nConn.Close()
 	sshConn, chans, reqs, err := ssh.NewServerConn(nConn, config)
 	if err != nil {
-		log.Printf("SSH handshake failed: %v", err)
+		logSSH.Info("SSH handshake failed", "remote", nConn.RemoteAddr().String(), "err", err)
 		return
 	}
 	defer sshConn.Close()
 	nickname := sshConn.Permissions.Extensions["nickname"]
-	log.Printf("User '%s' logged in from %s", nickname, sshConn.RemoteAddr())
+	logger := logSSH.With("conn", connID(sshConn), "nick", nickname)
+	logger.Info("User logged in", "remote", sshConn.RemoteAddr().String())
 
 	go ssh.DiscardRequests(reqs)
+	go sshKeepalive(sshConn, func() KeepaliveConfig { return chatHub.config().Keepalive })
 
 	for newChannel := range chans {
 		if newChannel.ChannelType() != "session" {
@@ -248,10 +247,10 @@ func handleConn(nConn net.Conn, config *ssh.ServerConfig, chatHub *ChatHub, data
 		}
 		channel, requests, err := newChannel.Accept()
 		if err != nil {
-			log.Printf("Could not accept channel: %v", err)
+			logger.Warn("Could not accept channel", "err", err)
 			continue
 		}
-		go handleSessionRequests(channel, requests, nickname, chatHub, dataManager)
+		go handleSessionRequests(channel, requests, sshConn, chatHub, dataManager)
 	}
 }
 
@@ -259,7 +258,9 @@ type execPayload struct {
 	Command string
 }
 
-func handleSessionRequests(channel ssh.Channel, requests <-chan *ssh.Request, nickname string, chatHub *ChatHub, dataManager *DataStreamManager) {
+func handleSessionRequests(channel ssh.Channel, requests <-chan *ssh.Request, sshConn *ssh.ServerConn, chatHub *ChatHub, dataManager *DataStreamManager) {
+	nickname := sshConn.Permissions.Extensions["nickname"]
+	logger := logSSH.With("conn", connID(sshConn), "nick", nickname)
 	for req := range requests {
 		isChatSubsystem := false
 		isDataSubsystem := false
@@ -298,15 +299,16 @@ func handleSessionRequests(channel ssh.Channel, requests <-chan *ssh.Request, ni
 		}
 
 		if isChatSubsystem {
-			log.Printf("User '%s' approved for 'chat' subsystem (type: %s)", nickname, req.Type)
+			logger.Debug("Chat subsystem approved", "request", req.Type)
 			req.Reply(true, nil)
-			client := chatHub.Join(nickname, channel)
-			<-client.Done()
+			if client := chatHub.Join(sshConn, channel); client != nil {
+				<-client.Done()
+			}
 			return
 		}
 
 		if isDataSubsystem {
-			log.Printf("User '%s' approved for data subsystem on key '%s'", nickname, dataKey)
+			streamLog(dataKey).Debug("Data subsystem approved", "conn", connID(sshConn), "nick", nickname)
 			req.Reply(true, nil)
 			dataManager.Pair(dataKey, channel)
 			return
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// roleOperator marks a login whose key is listed in the operators file.
+const roleOperator = "operator"
+
+// Ban keeps a nickname and/or key fingerprint off the relay.
+type Ban struct {
+	Nickname    string    `json:"nickname,omitempty"`
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	Reason      string    `json:"reason,omitempty"`
+	By          string    `json:"by"`
+	Created     time.Time `json:"created"`
+	Expires     time.Time `json:"expires,omitempty"` // zero means permanent
+}
+
+func (b Ban) expired(now time.Time) bool {
+	return !b.Expires.IsZero() && now.After(b.Expires)
+}
+
+// describe explains a ban to the user it applies to.
+func (b Ban) describe() string {
+	msg := "banned from this relay"
+	if b.Reason != "" {
+		msg += ": " + b.Reason
+	}
+	if !b.Expires.IsZero() {
+		msg += fmt.Sprintf(" (until %s)", b.Expires.UTC().Format(time.RFC3339))
+	}
+	return msg
+}
+
+// BanList is the persisted set of bans.
+type BanList struct {
+	mu   sync.Mutex
+	path string
+	bans []Ban
+}
+
+// LoadBanList reads bans from path. A missing file is an empty list.
+func LoadBanList(path string) (*BanList, error) {
+	bans, err := readBans(path)
+	if err != nil {
+		return nil, err
+	}
+	return &BanList{path: path, bans: bans}, nil
+}
+
+func readBans(path string) ([]Ban, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var bans []Ban
+	if err := json.Unmarshal(data, &bans); err != nil {
+		return nil, err
+	}
+	return bans, nil
+}
+
+// Replace swaps in bans read with readBans, picking up edits made to the
+// file while the relay runs.
+func (bl *BanList) Replace(bans []Ban) {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	bl.bans = bans
+}
+
+// Check returns the ban matching nick or fingerprint, if any. Expired bans
+// are dropped as they are found.
+func (bl *BanList) Check(nick, fingerprint string) (Ban, bool) {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	now := time.Now()
+	kept := bl.bans[:0]
+	var found *Ban
+	for _, b := range bl.bans {
+		if b.expired(now) {
+			continue
+		}
+		kept = append(kept, b)
+		if found == nil && ((b.Nickname != "" && b.Nickname == nick) || (b.Fingerprint != "" && b.Fingerprint == fingerprint)) {
+			ban := b
+			found = &ban
+		}
+	}
+	if len(kept) != len(bl.bans) {
+		bl.bans = kept
+		if err := bl.save(); err != nil {
+			logStore.Error("Failed to save ban list", "path", bl.path, "err", err)
+		}
+	}
+	if found == nil {
+		return Ban{}, false
+	}
+	return *found, true
+}
+
+// Add records a ban.
+func (bl *BanList) Add(b Ban) error {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	bl.bans = append(bl.bans, b)
+	return bl.save()
+}
+
+// Remove lifts every ban on nick, and on any fingerprint banned along with
+// it. It returns how many were removed.
+func (bl *BanList) Remove(nick string) (int, error) {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	fingerprints := make(map[string]bool)
+	for _, b := range bl.bans {
+		if b.Nickname == nick && b.Fingerprint != "" {
+			fingerprints[b.Fingerprint] = true
+		}
+	}
+	kept := bl.bans[:0]
+	for _, b := range bl.bans {
+		if b.Nickname == nick || fingerprints[b.Fingerprint] {
+			continue
+		}
+		kept = append(kept, b)
+	}
+	removed := len(bl.bans) - len(kept)
+	bl.bans = kept
+	return removed, bl.save()
+}
+
+// save writes the list atomically. Caller must hold bl.mu.
+func (bl *BanList) save() error {
+	data, err := json.MarshalIndent(bl.bans, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := bl.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, bl.path)
+}
+
+// LoadOperators reads an authorized_keys style file and returns the SHA256
+// fingerprints of the keys in it. A missing file means no operators.
+func LoadOperators(path string) (map[string]bool, error) {
+	return loadKeyFingerprints(path, "operator")
+}
+
+// loadKeyFingerprints reads the fingerprints of the keys in an
+// authorized_keys style file. A missing file is an empty set; what names
+// the keys in warnings.
+func loadKeyFingerprints(path, what string) (map[string]bool, error) {
+	ops := make(map[string]bool)
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ops, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			logServer.Warn("Skipping bad key", "path", path, "list", what, "err", err)
+			continue
+		}
+		ops[ssh.FingerprintSHA256(key)] = true
+	}
+	return ops, scanner.Err()
+}
+
+// fingerprintFromStored turns a stored user key (base64 wire format) into a fingerprint.
+func fingerprintFromStored(keyStr string) string {
+	raw, err := base64.StdEncoding.DecodeString(keyStr)
+	if err != nil {
+		return ""
+	}
+	key, err := ssh.ParsePublicKey(raw)
+	if err != nil {
+		return ""
+	}
+	return ssh.FingerprintSHA256(key)
+}
+
+// parseModDuration accepts Go durations plus a "d" suffix for days.
+// An empty string means no expiry.
+func parseModDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil || days <= 0 {
+			return 0, fmt.Errorf("bad duration %q", s)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("bad duration %q", s)
+	}
+	return d, nil
+}
+
+// looksLikeDuration reports whether a command argument is a duration
+// rather than the start of a reason.
+func looksLikeDuration(s string) bool {
+	_, err := parseModDuration(s)
+	return s != "" && err == nil
+}
+
+// isMuted reports whether nick may not talk right now.
+func (hub *ChatHub) isMuted(nick string) bool {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	until, ok := hub.mutes[nick]
+	if !ok {
+		return false
+	}
+	if !until.IsZero() && time.Now().After(until) {
+		delete(hub.mutes, nick)
+		return false
+	}
+	return true
+}
+
+// client returns the connected client for nick, if any.
+func (hub *ChatHub) client(nick string) (*ChatClient, bool) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	c, ok := hub.clients[nick]
+	return c, ok
+}
+
+// disconnect tells the client why and drops its whole SSH connection.
+func (c *ChatClient) disconnect(reason string) {
+	c.sendSystem(reason)
+	// Give the writer a moment to flush the notice
+	time.AfterFunc(200*time.Millisecond, func() {
+		if c.conn != nil {
+			c.conn.Close()
+		}
+		c.Close()
+	})
+}
+
+// modArgs splits an operator command's arguments after the nickname into
+// an optional leading duration and a reason.
+func modArgs(ctx commandContext) (time.Duration, string) {
+	if len(ctx.Args) > 1 && looksLikeDuration(ctx.Args[1]) {
+		d, _ := parseModDuration(ctx.Args[1])
+		return d, ctx.rest(2)
+	}
+	return 0, ctx.rest(1)
+}
+
+// notSelf refuses moderation commands aimed at the operator running them.
+func (c *ChatClient) notSelf(target, verb string) bool {
+	if target == c.nickname {
+		c.sendSystem("You cannot " + verb + " yourself.")
+		return false
+	}
+	return true
+}
+
+func cmdKick(c *ChatClient, ctx commandContext) {
+	target, reason := ctx.Args[0], ctx.rest(1)
+	if !c.notSelf(target, "kick") {
+		return
+	}
+	victim, ok := c.hub.client(target)
+	if !ok {
+		c.sendSystem(fmt.Sprintf("%s is not online.", target))
+		return
+	}
+	logMod.Info("Kicked user", "by", c.nickname, "target", target, "reason", reason)
+	c.hub.announce(fmt.Sprintf("%s was kicked by %s. %s", target, c.nickname, reason))
+	victim.disconnect(fmt.Sprintf("You were kicked by %s. %s", c.nickname, reason))
+}
+
+func cmdBan(c *ChatClient, ctx commandContext) {
+	target := ctx.Args[0]
+	duration, reason := modArgs(ctx)
+	if !c.notSelf(target, "ban") {
+		return
+	}
+	ban := Ban{Nickname: target, Reason: reason, By: c.nickname, Created: time.Now().UTC()}
+	if duration > 0 {
+		ban.Expires = ban.Created.Add(duration)
+	}
+	// Ban every key on the account, one entry each; /unban lifts them
+	// together since they share the nickname
+	victim, online := c.hub.client(target)
+	fingerprints := make(map[string]bool)
+	if online {
+		fingerprints[victim.fingerprint] = true
+	}
+	for _, keyStr := range c.hub.users.Keys(target) {
+		if fp := fingerprintFromStored(keyStr); fp != "" {
+			fingerprints[fp] = true
+		}
+	}
+	var bans []Ban
+	for fp := range fingerprints {
+		b := ban
+		b.Fingerprint = fp
+		bans = append(bans, b)
+	}
+	if len(bans) == 0 {
+		bans = []Ban{ban}
+	}
+	for _, b := range bans {
+		if err := c.hub.bans.Add(b); err != nil {
+			logStore.Error("Failed to save ban list", "path", c.hub.bans.path, "err", err)
+			c.sendSystem("Could not save the ban: " + err.Error())
+			return
+		}
+	}
+	logMod.Info("Banned user", "by", c.nickname, "target", target, "keys", len(fingerprints), "expires", ban.Expires, "reason", reason)
+	c.hub.announce(fmt.Sprintf("%s was banned by %s. %s", target, c.nickname, reason))
+	if online {
+		victim.disconnect("You have been " + ban.describe())
+	}
+}
+
+func cmdUnban(c *ChatClient, ctx commandContext) {
+	target := ctx.Args[0]
+	n, err := c.hub.bans.Remove(target)
+	if err != nil {
+		c.sendSystem("Could not save the ban list: " + err.Error())
+		return
+	}
+	logMod.Info("Unbanned user", "by", c.nickname, "target", target, "entries", n)
+	c.sendSystem(fmt.Sprintf("Removed %d ban(s) for %s.", n, target))
+}
+
+func cmdMute(c *ChatClient, ctx commandContext) {
+	target := ctx.Args[0]
+	duration, reason := modArgs(ctx)
+	if !c.notSelf(target, "mute") {
+		return
+	}
+	until := time.Time{}
+	if duration > 0 {
+		until = time.Now().Add(duration)
+	}
+	c.hub.mu.Lock()
+	c.hub.mutes[target] = until
+	c.hub.mu.Unlock()
+	logMod.Info("Muted user", "by", c.nickname, "target", target, "until", until, "reason", reason)
+	c.hub.announce(fmt.Sprintf("%s was muted by %s. %s", target, c.nickname, reason))
+}
+
+func cmdUnmute(c *ChatClient, ctx commandContext) {
+	target := ctx.Args[0]
+	c.hub.mu.Lock()
+	delete(c.hub.mutes, target)
+	c.hub.mu.Unlock()
+	logMod.Info("Unmuted user", "by", c.nickname, "target", target)
+	c.hub.announce(fmt.Sprintf("%s was unmuted by %s.", target, c.nickname))
+}
+
+// announce sends a network-wide system notice.
+func (hub *ChatHub) announce(text string) {
+	hub.broadcast("system_broadcast", hub.newChatPayload(time.Now(), "", "", strings.TrimSpace(text), true), "")
+}
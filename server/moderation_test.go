@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseModDuration(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    time.Duration
+		wantErr bool
+	}{
+		{in: "", want: 0},
+		{in: "30m", want: 30 * time.Minute},
+		{in: "12h", want: 12 * time.Hour},
+		{in: "1h30m", want: 90 * time.Minute},
+		{in: "7d", want: 7 * 24 * time.Hour},
+		{in: "1d", want: 24 * time.Hour},
+		{in: "0d", wantErr: true},
+		{in: "-1d", wantErr: true},
+		{in: "1.5d", wantErr: true},
+		{in: "d", wantErr: true},
+		{in: "0s", wantErr: true},
+		{in: "-5m", wantErr: true},
+		{in: "spam", wantErr: true},
+		{in: "10", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseModDuration(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseModDuration(%q) = %v, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseModDuration(%q) = %v, %v; want %v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestLooksLikeDuration(t *testing.T) {
+	for in, want := range map[string]bool{"30m": true, "7d": true, "": false, "spamming": false, "d": false} {
+		if got := looksLikeDuration(in); got != want {
+			t.Errorf("looksLikeDuration(%q) = %v, want %v", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	minNickLen = 2
+	maxNickLen = 24
+)
+
+// defaultReservedNicks can never be registered: they are what the relay
+// and its staff go by, or read like an address to everyone.
+var defaultReservedNicks = []string{
+	"system", "server", "relay", "rosewire", "admin", "administrator",
+	"operator", "op", "mod", "moderator", "root", "staff", "support",
+	"everyone", "all", "here", "nobody", "anonymous", "guest",
+}
+
+// NickPolicy decides which nicknames may be registered. Nicknames are 2-24
+// letters, digits and "-_.", start with a letter or digit, are written in
+// Unicode NFKC form and use a single script, so "pаypal" with a Cyrillic
+// "а" is refused. Reserved names are refused however they are spelled.
+// Accounts registered before a rule existed keep working.
+type NickPolicy struct {
+	reserved map[string]string // skeleton -> reserved name
+}
+
+// LoadNickPolicy builds the policy from the default reserved names plus
+// those listed in path, one per line. A missing file is fine.
+func LoadNickPolicy(path string) (*NickPolicy, error) {
+	p := &NickPolicy{reserved: make(map[string]string)}
+	for _, name := range defaultReservedNicks {
+		p.reserve(name)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return p, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p.reserve(line)
+	}
+	return p, scanner.Err()
+}
+
+func (p *NickPolicy) reserve(name string) {
+	p.reserved[nickSkeleton(name)] = name
+}
+
+// NickError is a nickname refused at login. Its message is shown to the
+// user as is.
+type NickError struct {
+	Nick   string
+	Reason string
+}
+
+func (e *NickError) Error() string {
+	return e.Reason
+}
+
+// Check returns a *NickError explaining why nick may not be registered, or
+// nil if it may.
+func (p *NickPolicy) Check(nick string) error {
+	reason := p.problem(nick)
+	if reason == "" {
+		return nil
+	}
+	return &NickError{Nick: nick, Reason: reason}
+}
+
+func (p *NickPolicy) problem(nick string) string {
+	if !utf8.ValidString(nick) {
+		return "Nicknames must be valid UTF-8."
+	}
+	if n := utf8.RuneCountInString(nick); n < minNickLen || n > maxNickLen {
+		return fmt.Sprintf("Nicknames must be %d to %d characters long.", minNickLen, maxNickLen)
+	}
+	if canon := norm.NFKC.String(nick); canon != nick {
+		return fmt.Sprintf("Nickname %q is not in canonical form; use %q instead.", nick, canon)
+	}
+	for i, r := range nick {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+		case i > 0 && (unicode.Is(unicode.Mn, r) || unicode.Is(unicode.Mc, r)):
+			// Combining marks, which some scripts need
+		case i > 0 && strings.ContainsRune("-_.", r):
+		case unicode.IsSpace(r):
+			return "Nicknames cannot contain spaces."
+		case strings.ContainsRune("-_.", r):
+			return "Nicknames must start with a letter or digit."
+		default:
+			return fmt.Sprintf("Nicknames can only use letters, digits and \"-_.\", not %q.", r)
+		}
+	}
+	if scripts := nickScripts(nick); len(scripts) > 1 {
+		return fmt.Sprintf("Nicknames must not mix writing systems (%s).", strings.Join(scripts, ", "))
+	}
+	if name, ok := p.reserved[nickSkeleton(nick)]; ok {
+		if strings.EqualFold(nick, name) {
+			return fmt.Sprintf("The nickname %q is reserved.", nick)
+		}
+		return fmt.Sprintf("The nickname %q is reserved (it reads as %q).", nick, name)
+	}
+	return ""
+}
+
+// nickScripts lists the scripts nick's letters are written in. Han, kana
+// and Hangul count as one, since Japanese and Korean mix them.
+func nickScripts(nick string) []string {
+	var scripts []string
+	seen := make(map[string]bool)
+	for _, r := range nick {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		script := scriptOf(r)
+		switch script {
+		case "Han", "Hiragana", "Katakana", "Hangul":
+			script = "CJK"
+		}
+		if !seen[script] {
+			seen[script] = true
+			scripts = append(scripts, script)
+		}
+	}
+	return scripts
+}
+
+// nickScriptTables are the scripts nickScripts tells apart. Letters from
+// any other script count as "Other".
+var nickScriptTables = []struct {
+	name  string
+	table *unicode.RangeTable
+}{
+	{"Latin", unicode.Latin},
+	{"Cyrillic", unicode.Cyrillic},
+	{"Greek", unicode.Greek},
+	{"Armenian", unicode.Armenian},
+	{"Georgian", unicode.Georgian},
+	{"Hebrew", unicode.Hebrew},
+	{"Arabic", unicode.Arabic},
+	{"Devanagari", unicode.Devanagari},
+	{"Bengali", unicode.Bengali},
+	{"Thai", unicode.Thai},
+	{"Han", unicode.Han},
+	{"Hiragana", unicode.Hiragana},
+	{"Katakana", unicode.Katakana},
+	{"Hangul", unicode.Hangul},
+}
+
+func scriptOf(r rune) string {
+	for _, s := range nickScriptTables {
+		if unicode.Is(s.table, r) {
+			return s.name
+		}
+	}
+	return "Other"
+}
+
+// confusables maps characters to the Latin ones they are easily mistaken
+// for. Skeletons are lowercased first, so it is keyed by lowercase letters:
+// every i-like letter maps to "l" so that "I" and "l" still meet. It covers
+// the usual suspects, not all of Unicode's confusables.txt.
+var confusables = map[rune]rune{
+	'0': 'o', '1': 'l', 'i': 'l', '|': 'l',
+	// Cyrillic
+	'а': 'a', 'в': 'b', 'е': 'e', 'і': 'l', 'ј': 'j', 'к': 'k', 'м': 'm',
+	'н': 'h', 'һ': 'h', 'о': 'o', 'р': 'p', 'с': 'c', 'т': 't', 'у': 'y',
+	'х': 'x', 'ѕ': 's', 'ԁ': 'd', 'ԛ': 'q', 'ԝ': 'w', 'ӏ': 'l',
+	// Greek
+	'α': 'a', 'β': 'b', 'ε': 'e', 'ζ': 'z', 'η': 'n', 'ι': 'l', 'κ': 'k',
+	'μ': 'u', 'ν': 'v', 'ο': 'o', 'ρ': 'p', 'τ': 't', 'υ': 'u', 'χ': 'x',
+}
+
+// nickSkeleton reduces a nickname to what it looks like, so that names
+// differing only in case, accents or lookalike characters ("Bob", "b0b",
+// "bоb" in Cyrillic) share a skeleton.
+func nickSkeleton(nick string) string {
+	nick = norm.NFKD.String(nick)
+	var b strings.Builder
+	for _, r := range nick {
+		if unicode.Is(unicode.Mn, r) {
+			continue // accents
+		}
+		r = unicode.ToLower(r)
+		if c, ok := confusables[r]; ok {
+			r = c
+		}
+		b.WriteRune(r)
+	}
+	return strings.ReplaceAll(b.String(), "rn", "m")
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNickSkeleton(t *testing.T) {
+	tests := []struct {
+		a, b string
+		same bool
+	}{
+		{"Bob", "bob", true},
+		{"b0b", "bob", true},
+		{"bоb", "bob", true}, // Cyrillic о
+		{"ВОВ", "bob", true}, // Cyrillic capitals
+		{"pαypal", "paypal", true},
+		{"José", "jose", true},
+		{"ﬁsh", "fish", true}, // ligature
+		{"PayPaI", "paypal", true},
+		{"Ian", "ian", true},
+		{"Ian", "lan", true},
+		{"modern", "modem", true},
+		{"Іvan", "ivan", true}, // Cyrillic І
+		{"bob", "rob", false},
+		{"ana", "anna", false},
+		{"Юля", "юля", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.a+"/"+tt.b, func(t *testing.T) {
+			a, b := nickSkeleton(tt.a), nickSkeleton(tt.b)
+			if (a == b) != tt.same {
+				t.Errorf("nickSkeleton(%q) = %q, nickSkeleton(%q) = %q; same = %v, want %v", tt.a, a, tt.b, b, a == b, tt.same)
+			}
+		})
+	}
+}
+
+func TestNickSkeletonIgnoresCase(t *testing.T) {
+	for _, nick := range []string{"Ian", "PayPal", "ВОВА", "ΑΛΦΑ", "Ærin", "İlker"} {
+		if upper, lower := nickSkeleton(strings.ToUpper(nick)), nickSkeleton(strings.ToLower(nick)); upper != lower {
+			t.Errorf("%q: upper case skeleton %q, lower case %q", nick, upper, lower)
+		}
+	}
+}
+
+func TestNickPolicyCheck(t *testing.T) {
+	reserved := writeFile(t, t.TempDir(), "reserved_nicks", "# house bots", "", "  rosebot  ")
+	p, err := LoadNickPolicy(reserved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		nick string
+		want string // part of the reason; empty if allowed
+	}{
+		{"ana", ""},
+		{"Ærin", ""},
+		{"Юля", ""},
+		{"山田たろう", ""},
+		{"ana_b.c-d", ""},
+		{"a", "2 to 24 characters"},
+		{strings.Repeat("a", 25), "2 to 24 characters"},
+		{"\xffab", "valid UTF-8"},
+		{"ﬁsh", "canonical form"},
+		{"ana bob", "spaces"},
+		{"_ana", "start with a letter or digit"},
+		{"ana!", `not '!'`},
+		{"pаypal", "mix writing systems (Latin, Cyrillic)"},
+		{"admin", `"admin" is reserved.`},
+		{"Admin", `"Admin" is reserved.`},
+		{"adm1n", `reads as "admin"`},
+		{"ROOT", `"ROOT" is reserved.`},
+		{"r0sebot", `reads as "rosebot"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.nick, func(t *testing.T) {
+			err := p.Check(tt.nick)
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("Check(%q) = %v, want nil", tt.nick, err)
+				}
+				return
+			}
+			var nickErr *NickError
+			if !errors.As(err, &nickErr) || !strings.Contains(nickErr.Reason, tt.want) {
+				t.Errorf("Check(%q) = %v, want a *NickError containing %q", tt.nick, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadNickPolicyMissingFile(t *testing.T) {
+	p, err := LoadNickPolicy(filepath.Join(t.TempDir(), "missing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Check("admin"); err == nil {
+		t.Error("default reserved names not loaded")
+	}
+}
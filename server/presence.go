@@ -0,0 +1,129 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// idleAfter is how long a client may go without sending anything before
+// it is reported as idle.
+const idleAfter = 5 * time.Minute
+
+// maxStatusMessageLen caps custom status messages, in runes.
+const maxStatusMessageLen = 80
+
+// Presence states a client can choose with set_status.
+const (
+	statusOnline    = "online"
+	statusAway      = "away"
+	statusBusy      = "busy"
+	statusInvisible = "invisible"
+)
+
+func validStatus(s string) bool {
+	switch s {
+	case statusOnline, statusAway, statusBusy, statusInvisible:
+		return true
+	}
+	return false
+}
+
+// statusLabel is the human-readable form of a status, as shown in stats
+// and on the status page.
+func statusLabel(s string) string {
+	if s == "" {
+		return ""
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+// presenceOf builds the presence record for a client. Caller must hold hub.mu.
+func (hub *ChatHub) presenceOf(c *ChatClient) PresenceInfo {
+	return PresenceInfo{
+		Nickname:      c.nickname,
+		Status:        c.status,
+		StatusMessage: c.statusMessage,
+		SharedFiles:   hub.fileRegistry.CountFiles(c.nickname),
+		OnlineSince:   c.joinedAt.UTC().Format(time.RFC3339),
+		LastActive:    c.lastActive.UTC().Format(time.RFC3339),
+		Idle:          time.Since(c.lastActive) >= idleAfter,
+	}
+}
+
+// PresenceList returns the presence of every connected client as seen by
+// viewer, sorted by nickname. Invisible clients are only listed to themselves;
+// pass an empty viewer to hide all of them.
+func (hub *ChatHub) PresenceList(viewer string) []PresenceInfo {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	users := make([]PresenceInfo, 0, len(hub.clients))
+	for nick, c := range hub.clients {
+		if c.status == statusInvisible && nick != viewer {
+			continue
+		}
+		users = append(users, hub.presenceOf(c))
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Nickname < users[j].Nickname
+	})
+	return users
+}
+
+// broadcastPresence pushes a presence change for c to every other client.
+// Invisible clients only ever announce that they left.
+func (hub *ChatHub) broadcastPresence(event string, c *ChatClient) {
+	hub.mu.Lock()
+	if c.status == statusInvisible && event != "leave" {
+		hub.mu.Unlock()
+		return
+	}
+	info := hub.presenceOf(c)
+	hub.mu.Unlock()
+	hub.broadcast("presence_update", PresenceUpdatePayload{Event: event, User: info}, c.nickname)
+}
+
+// touch records activity from the client. If the client had gone idle,
+// the others are told it is back.
+func (c *ChatClient) touch() {
+	c.hub.mu.Lock()
+	wasIdle := time.Since(c.lastActive) >= idleAfter
+	c.lastActive = time.Now()
+	c.hub.mu.Unlock()
+	if wasIdle {
+		c.hub.broadcastPresence("update", c)
+	}
+}
+
+// setStatus changes the client's presence state and tells everyone. Going
+// invisible looks like leaving to the others, and coming back looks like
+// joining.
+func (c *ChatClient) setStatus(status, message string) {
+	if !validStatus(status) {
+		c.sendSystem("Unknown status '" + status + "'. Use online, away, busy or invisible.")
+		return
+	}
+	message = strings.TrimSpace(message)
+	if utf8.RuneCountInString(message) > maxStatusMessageLen {
+		message = string([]rune(message)[:maxStatusMessageLen])
+	}
+
+	c.hub.mu.Lock()
+	wasInvisible := c.status == statusInvisible
+	c.status = status
+	c.statusMessage = message
+	self := c.hub.presenceOf(c)
+	c.hub.mu.Unlock()
+
+	switch {
+	case status == statusInvisible && !wasInvisible:
+		c.hub.broadcastPresence("leave", c)
+	case status != statusInvisible && wasInvisible:
+		c.hub.broadcastPresence("join", c)
+	default:
+		c.hub.broadcastPresence("update", c)
+	}
+	// Confirm the change back to the client itself
+	c.send("presence_update", PresenceUpdatePayload{Event: "update", User: self})
+}
@@ -29,10 +29,53 @@ type SearchPayload struct {
 type GetFilePayload struct {
 	FileName string `json:"fileName"`
 	Peer     string `json:"peer"`
+	Offset   int64  `json:"offset,omitempty"` // resume an interrupted download from this byte
 }
 
 type ChatMessagePayload struct {
 	Text string `json:"text"`
+	Room string `json:"room,omitempty"` // defaults to the lobby
+}
+
+type RoomPayload struct {
+	Room string `json:"room"`
+}
+
+type ChatHistoryRequestPayload struct {
+	Room   string `json:"room"`
+	Before string `json:"before,omitempty"` // RFC 3339; empty means now
+	Limit  int    `json:"limit,omitempty"`
+}
+
+type SetTopicPayload struct {
+	Room  string `json:"room"`
+	Topic string `json:"topic"`
+}
+
+type PrivateMessagePayload struct {
+	To   string `json:"to"`
+	Text string `json:"text"`
+}
+
+// IgnoreListPayload replaces the set of users whose messages are not
+// routed to the sender.
+type IgnoreListPayload struct {
+	Nicknames []string `json:"nicknames"`
+}
+
+// AddKeyPayload authorizes another key for the sender's nickname.
+type AddKeyPayload struct {
+	PublicKey string `json:"publicKey"` // authorized_keys form, as in a .pub file
+}
+
+// RemoveKeyPayload revokes one of the sender's keys.
+type RemoveKeyPayload struct {
+	Fingerprint string `json:"fingerprint"` // SHA256:...
+}
+
+type SetStatusPayload struct {
+	Status  string `json:"status"` // "online", "away", "busy" or "invisible"
+	Message string `json:"message"`
 }
 
 type UploadDataPayload struct {
@@ -64,10 +107,59 @@ type NetworkStatsPayload struct {
 }
 
 type ChatBroadcastPayload struct {
-	Timestamp string `json:"timestamp"`
+	ID        uint64 `json:"id"`
+	Timestamp string `json:"timestamp"`      // RFC 3339, UTC
+	Room      string `json:"room,omitempty"` // empty for network-wide notices
 	Nickname  string `json:"nickname"`
 	Text      string `json:"text"`
 	IsSystem  bool   `json:"isSystem"`
+	IsAction  bool   `json:"isAction,omitempty"` // sent with /me
+}
+
+// PrivateMessageDeliveryPayload is sent to both the recipient and, as an
+// echo, the sender of a private message.
+type PrivateMessageDeliveryPayload struct {
+	ID        uint64 `json:"id"`
+	Timestamp string `json:"timestamp"` // RFC 3339, UTC
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Text      string `json:"text"`
+	Offline   bool   `json:"offline"` // stored while the recipient was away
+}
+
+// ChatHistoryPayload carries earlier messages from a room, oldest first.
+// Oldest is the cursor to pass as Before to page further back.
+type ChatHistoryPayload struct {
+	Room     string                 `json:"room"`
+	Messages []ChatBroadcastPayload `json:"messages"`
+	Oldest   string                 `json:"oldest,omitempty"`
+	HasMore  bool                   `json:"hasMore"`
+}
+
+type RoomInfo struct {
+	Name    string `json:"name"`
+	Topic   string `json:"topic"`
+	Members int    `json:"members"`
+}
+
+type RoomListPayload struct {
+	Rooms []RoomInfo `json:"rooms"`
+}
+
+type RoomJoinedPayload struct {
+	Room    string   `json:"room"`
+	Topic   string   `json:"topic"`
+	Members []string `json:"members"`
+}
+
+type RoomPartedPayload struct {
+	Room string `json:"room"`
+}
+
+type RoomTopicPayload struct {
+	Room  string `json:"room"`
+	Topic string `json:"topic"`
+	SetBy string `json:"setBy"`
 }
 
 type TransferStartPayload struct {
@@ -75,14 +167,71 @@ type TransferStartPayload struct {
 	FileName   string `json:"fileName"`
 	Size       int64  `json:"size"`
 	FromUser   string `json:"fromUser"`
+	Offset     int64  `json:"offset"` // the first byte that will be sent
 }
 
 type UploadRequestPayload struct {
 	TransferID string `json:"transferID"`
 	FileName   string `json:"fileName"`
+	Requester  string `json:"requester"`
+	Offset     int64  `json:"offset"` // start uploading from this byte
 }
 
+// TransferErrorPayload reports a failed transfer. A get_file that never
+// became a transfer has no TransferID; FileName and Peer say which it was.
 type TransferErrorPayload struct {
 	TransferID string `json:"transferID"`
+	FileName   string `json:"fileName,omitempty"`
+	Peer       string `json:"peer,omitempty"`
 	Message    string `json:"message"`
-}
\ No newline at end of file
+	RetryAfter int    `json:"retryAfter,omitempty"` // seconds; the get_file was rate limited and may be sent again then
+}
+
+// PresenceInfo describes a single connected user for peer lists.
+type PresenceInfo struct {
+	Nickname      string `json:"nickname"`
+	Status        string `json:"status"`
+	StatusMessage string `json:"statusMessage"`
+	SharedFiles   int    `json:"sharedFiles"`
+	OnlineSince   string `json:"onlineSince"` // RFC 3339
+	LastActive    string `json:"lastActive"`  // RFC 3339
+	Idle          bool   `json:"idle"`
+}
+
+type PresenceListPayload struct {
+	Users []PresenceInfo `json:"users"`
+}
+
+type PresenceUpdatePayload struct {
+	Event string       `json:"event"` // "join", "leave" or "update"
+	User  PresenceInfo `json:"user"`
+}
+
+// PingPayload is sent both ways as "ping" and echoed back as "pong".
+type PingPayload struct {
+	Seq uint64 `json:"seq"`
+}
+
+// CommandInfo describes one slash command for help and completion.
+type CommandInfo struct {
+	Name string `json:"name"`
+	Args string `json:"args,omitempty"`
+	Help string `json:"help"`
+}
+
+// CommandListPayload lists the slash commands a client may use.
+type CommandListPayload struct {
+	Commands []CommandInfo `json:"commands"`
+}
+
+// KeyInfo describes one key on an account.
+type KeyInfo struct {
+	Fingerprint string `json:"fingerprint"`
+	Type        string `json:"type"`
+	Current     bool   `json:"current"` // the key this session logged in with
+}
+
+// KeyListPayload answers list_keys, add_key and remove_key.
+type KeyListPayload struct {
+	Keys []KeyInfo `json:"keys"`
+}
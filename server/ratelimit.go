@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit is a token bucket setting: Rate tokens per second, holding at
+// most Burst.
+type RateLimit struct {
+	Rate  float64 `yaml:"rate"`
+	Burst float64 `yaml:"burst"`
+}
+
+// FloodConfig sets the rate limits and how the relay escalates against
+// clients that keep hitting them. Each limited message is a strike;
+// strikes are forgotten after StrikeWindow without one.
+type FloodConfig struct {
+	// Rates throttles these message types. Anything not listed, notably
+	// the upload_* transfer messages, is never limited. The file and
+	// -rate-limits override single types, keeping the others.
+	Rates        map[string]RateLimit `yaml:"rates"`
+	StrikeWindow time.Duration        `yaml:"strike_window"`
+	WarnAfter    int                  `yaml:"warn_after"` // strikes
+	MuteAfter    int                  `yaml:"mute_after"`
+	KickAfter    int                  `yaml:"kick_after"`
+	MuteFor      time.Duration        `yaml:"mute_for"`
+}
+
+// DefaultFloodConfig is used unless the configuration says otherwise.
+// get_file allows a burst of 10 so a client coming back from a dropped
+// connection can resume several downloads at once; it paces the rest.
+func DefaultFloodConfig() FloodConfig {
+	return FloodConfig{
+		Rates: map[string]RateLimit{
+			"chat_message":    {Rate: 1, Burst: 5},
+			"private_message": {Rate: 1, Burst: 5},
+			"search":          {Rate: 0.5, Burst: 3},
+			"get_file":        {Rate: 0.2, Burst: 10},
+			"get_stats":       {Rate: 1, Burst: 5},
+			"get_presence":    {Rate: 1, Burst: 5},
+			"share":           {Rate: 0.1, Burst: 3},
+			"set_status":      {Rate: 0.5, Burst: 3},
+			"join_room":       {Rate: 0.5, Burst: 5},
+			"set_topic":       {Rate: 0.2, Burst: 2},
+			"set_ignore_list": {Rate: 0.5, Burst: 5},
+			"list_keys":       {Rate: 0.5, Burst: 3},
+			"add_key":         {Rate: 0.1, Burst: 3},
+			"remove_key":      {Rate: 0.1, Burst: 3},
+			"chat_history":    {Rate: 1, Burst: 5},
+			"ping":            {Rate: 1, Burst: 5},
+		},
+		StrikeWindow: time.Minute,
+		WarnAfter:    3,
+		MuteAfter:    10,
+		KickAfter:    25,
+		MuteFor:      2 * time.Minute,
+	}
+}
+
+// validate reports problems with cfg for Config.Validate.
+func (cfg FloodConfig) validate() []error {
+	var errs []error
+	types := make([]string, 0, len(cfg.Rates))
+	for t := range cfg.Rates {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	for _, t := range types {
+		if l := cfg.Rates[t]; l.Rate <= 0 || l.Burst < 1 {
+			errs = append(errs, fmt.Errorf("limits.flood.rates.%s: need a positive rate and a burst of at least 1", t))
+		}
+	}
+	if cfg.StrikeWindow <= 0 {
+		errs = append(errs, errors.New("limits.flood.strike_window: must be positive"))
+	}
+	if cfg.WarnAfter <= 0 || cfg.MuteAfter <= cfg.WarnAfter || cfg.KickAfter <= cfg.MuteAfter {
+		errs = append(errs, errors.New("limits.flood: need 0 < warn_after < mute_after < kick_after"))
+	}
+	if cfg.MuteFor <= 0 {
+		errs = append(errs, errors.New("limits.flood.mute_for: must be positive"))
+	}
+	return errs
+}
+
+// rateLimitsFlag binds -rate-limits, a comma-separated list of
+// type=rate/burst, to FloodConfig.Rates. Types it leaves out keep their
+// limits.
+type rateLimitsFlag struct{ p *map[string]RateLimit }
+
+func (f rateLimitsFlag) String() string {
+	if f.p == nil {
+		return ""
+	}
+	var pairs []string
+	for t, l := range *f.p {
+		pairs = append(pairs, fmt.Sprintf("%s=%g/%g", t, l.Rate, l.Burst))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (f rateLimitsFlag) Set(s string) error {
+	rates := make(map[string]RateLimit, len(*f.p))
+	for t, l := range *f.p {
+		rates[t] = l
+	}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		t, limit, ok := strings.Cut(pair, "=")
+		rate, burst, ok2 := strings.Cut(limit, "/")
+		if !ok || !ok2 {
+			return fmt.Errorf("bad rate limit %q (want type=rate/burst)", pair)
+		}
+		var l RateLimit
+		var err error
+		if l.Rate, err = strconv.ParseFloat(rate, 64); err != nil {
+			return fmt.Errorf("bad rate in %q", pair)
+		}
+		if l.Burst, err = strconv.ParseFloat(burst, 64); err != nil {
+			return fmt.Errorf("bad burst in %q", pair)
+		}
+		rates[t] = l
+	}
+	*f.p = rates
+	return nil
+}
+
+// tokenBucket is one rate limit in use.
+type tokenBucket struct {
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+// allow takes a token if one is available.
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.tokens += now.Sub(b.last).Seconds() * b.limit.Rate
+	if b.tokens > b.limit.Burst {
+		b.tokens = b.limit.Burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// wait is how long until the next token, as of the last call to allow.
+func (b *tokenBucket) wait() time.Duration {
+	if b.tokens >= 1 || b.limit.Rate <= 0 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.limit.Rate * float64(time.Second))
+}
+
+// floodGuard holds one connection's buckets and strike count. It is only
+// used from that connection's readLoop.
+type floodGuard struct {
+	buckets    map[string]*tokenBucket
+	strikes    int
+	lastStrike time.Time
+}
+
+func newFloodGuard() *floodGuard {
+	return &floodGuard{buckets: make(map[string]*tokenBucket)}
+}
+
+// floodAction is what a strike leads to.
+type floodAction int
+
+const (
+	floodNone floodAction = iota
+	floodWarn
+	floodMute
+	floodKick
+)
+
+// strike counts a limited message and says what to do about it.
+func (g *floodGuard) strike(now time.Time, cfg FloodConfig) floodAction {
+	if now.Sub(g.lastStrike) > cfg.StrikeWindow {
+		g.strikes = 0
+	}
+	g.strikes++
+	g.lastStrike = now
+	switch g.strikes {
+	case cfg.WarnAfter:
+		return floodWarn
+	case cfg.MuteAfter:
+		return floodMute
+	case cfg.KickAfter:
+		return floodKick
+	}
+	return floodNone
+}
+
+// floodMute mutes nick until then, unless an operator's mute already
+// lasts as long. It reports whether it did.
+func (hub *ChatHub) floodMute(nick string, until time.Time) bool {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if cur, muted := hub.mutes[nick]; muted && (cur.IsZero() || !cur.Before(until)) {
+		return false
+	}
+	hub.mutes[nick] = until
+	return true
+}
+
+// RateLimitStats counts how often limits fired, for the status page.
+type RateLimitStats struct {
+	mu           sync.Mutex
+	Dropped      map[string]int // by message type
+	Warned       int
+	Muted        int
+	Disconnected int
+}
+
+func NewRateLimitStats() *RateLimitStats {
+	return &RateLimitStats{Dropped: make(map[string]int)}
+}
+
+// Snapshot copies the counters.
+func (s *RateLimitStats) Snapshot() RateLimitSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snap := RateLimitSnapshot{
+		Dropped:      make(map[string]int, len(s.Dropped)),
+		Warned:       s.Warned,
+		Muted:        s.Muted,
+		Disconnected: s.Disconnected,
+	}
+	for t, n := range s.Dropped {
+		snap.Dropped[t] = n
+		snap.TotalDropped += n
+	}
+	return snap
+}
+
+// RateLimitSnapshot is a copy of RateLimitStats safe to hand out.
+type RateLimitSnapshot struct {
+	Dropped      map[string]int `json:"dropped"`
+	TotalDropped int            `json:"total_dropped"`
+	Warned       int            `json:"warned"`
+	Muted        int            `json:"muted"`
+	Disconnected int            `json:"disconnected"`
+}
+
+// allowMessage applies the rate limit for msgType and escalates against
+// clients that keep hitting it. It reports whether to handle the message.
+// Limits are looked up on each message, so a reload applies at once.
+func (c *ChatClient) allowMessage(msgType string) bool {
+	cfg := c.hub.config().Limits.Flood
+	limit, limited := cfg.Rates[msgType]
+	if !limited {
+		return true
+	}
+	now := time.Now()
+	b, ok := c.flood.buckets[msgType]
+	if !ok {
+		b = &tokenBucket{tokens: limit.Burst, last: now}
+		c.flood.buckets[msgType] = b
+	}
+	b.limit = limit
+	if b.allow(now) {
+		return true
+	}
+
+	stats := c.hub.rateStats
+	stats.mu.Lock()
+	stats.Dropped[msgType]++
+	stats.mu.Unlock()
+
+	switch c.flood.strike(now, cfg) {
+	case floodWarn:
+		stats.mu.Lock()
+		stats.Warned++
+		stats.mu.Unlock()
+		c.log.Info("Rate limit: warned", "type", msgType)
+		c.sendSystem("You are sending too fast; some messages were dropped. Slow down.")
+	case floodMute:
+		stats.mu.Lock()
+		stats.Muted++
+		stats.mu.Unlock()
+		if !c.hub.floodMute(c.nickname, now.Add(cfg.MuteFor)) {
+			c.log.Info("Rate limit: already muted for longer")
+			break
+		}
+		c.log.Info("Rate limit: muted", "for", cfg.MuteFor)
+		c.sendSystem(fmt.Sprintf("Flood protection: you are muted for %v.", cfg.MuteFor))
+	case floodKick:
+		stats.mu.Lock()
+		stats.Disconnected++
+		stats.mu.Unlock()
+		c.log.Info("Rate limit: disconnecting")
+		c.disconnect("Flood protection: disconnected for sending too many messages.")
+	}
+	return false
+}
+
+// rateLimited answers a message allowMessage dropped, where the client
+// would otherwise wait for a reply that never comes: a get_file gets a
+// transfer_error naming the file and peer, saying when to ask again.
+func (c *ChatClient) rateLimited(msg InboundMessage) {
+	if msg.Type != "get_file" {
+		return
+	}
+	var p GetFilePayload
+	if err := json.Unmarshal(msg.Payload, &p); err != nil {
+		return
+	}
+	retry := int(math.Ceil(c.flood.buckets[msg.Type].wait().Seconds()))
+	c.send("transfer_error", TransferErrorPayload{
+		FileName:   p.FileName,
+		Peer:       p.Peer,
+		Message:    "You are requesting downloads too fast; try again in a moment.",
+		RetryAfter: max(retry, 1),
+	})
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketAllow(t *testing.T) {
+	start := time.Date(2026, 1, 2, 10, 0, 0, 0, time.UTC)
+	type step struct {
+		after time.Duration // since start
+		want  bool
+	}
+	tests := []struct {
+		name  string
+		limit RateLimit
+		steps []step
+	}{
+		{
+			name:  "burst then refused",
+			limit: RateLimit{Rate: 1, Burst: 3},
+			steps: []step{{0, true}, {0, true}, {0, true}, {0, false}},
+		},
+		{
+			name:  "refills at rate",
+			limit: RateLimit{Rate: 1, Burst: 1},
+			steps: []step{{0, true}, {500 * time.Millisecond, false}, {time.Second, true}, {time.Second, false}},
+		},
+		{
+			name:  "slow rate",
+			limit: RateLimit{Rate: 0.2, Burst: 1},
+			steps: []step{{0, true}, {4 * time.Second, false}, {5 * time.Second, true}},
+		},
+		{
+			name:  "refill capped at burst",
+			limit: RateLimit{Rate: 10, Burst: 2},
+			steps: []step{{0, true}, {0, true}, {time.Hour, true}, {time.Hour, true}, {time.Hour, false}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &tokenBucket{limit: tt.limit, tokens: tt.limit.Burst, last: start}
+			for i, s := range tt.steps {
+				if got := b.allow(start.Add(s.after)); got != s.want {
+					t.Fatalf("step %d at +%v: allow = %v, want %v", i, s.after, got, s.want)
+				}
+			}
+		})
+	}
+}
+
+func TestFloodGuardStrike(t *testing.T) {
+	cfg := FloodConfig{StrikeWindow: time.Minute, WarnAfter: 2, MuteAfter: 4, KickAfter: 6}
+	start := time.Date(2026, 1, 2, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		gaps []time.Duration // before each strike
+		want []floodAction
+	}{
+		{
+			name: "escalates",
+			gaps: []time.Duration{0, time.Second, time.Second, time.Second, time.Second, time.Second, time.Second},
+			want: []floodAction{floodNone, floodWarn, floodNone, floodMute, floodNone, floodKick, floodNone},
+		},
+		{
+			name: "quiet window resets",
+			gaps: []time.Duration{0, time.Second, 2 * time.Minute, time.Second},
+			want: []floodAction{floodNone, floodWarn, floodNone, floodWarn},
+		},
+		{
+			name: "window is from the last strike",
+			gaps: []time.Duration{0, 50 * time.Second, 50 * time.Second, 50 * time.Second},
+			want: []floodAction{floodNone, floodWarn, floodNone, floodMute},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newFloodGuard()
+			now := start
+			for i, gap := range tt.gaps {
+				now = now.Add(gap)
+				if got := g.strike(now, cfg); got != tt.want[i] {
+					t.Fatalf("strike %d: got %v, want %v", i+1, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestFloodMute(t *testing.T) {
+	now := time.Date(2026, 1, 2, 10, 0, 0, 0, time.UTC)
+	until := now.Add(2 * time.Minute)
+	tests := []struct {
+		name     string
+		existing *time.Time
+		wantSet  bool
+		want     time.Time
+	}{
+		{name: "not muted", wantSet: true, want: until},
+		{name: "indefinite operator mute kept", existing: &time.Time{}, want: time.Time{}},
+		{name: "longer mute kept", existing: ptr(now.Add(time.Hour)), want: now.Add(time.Hour)},
+		{name: "same length kept", existing: ptr(until), want: until},
+		{name: "shorter mute extended", existing: ptr(now.Add(time.Minute)), wantSet: true, want: until},
+		{name: "expired mute replaced", existing: ptr(now.Add(-time.Minute)), wantSet: true, want: until},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub := &ChatHub{mutes: make(map[string]time.Time)}
+			if tt.existing != nil {
+				hub.mutes["ana"] = *tt.existing
+			}
+			if got := hub.floodMute("ana", until); got != tt.wantSet {
+				t.Errorf("floodMute = %v, want %v", got, tt.wantSet)
+			}
+			if got := hub.mutes["ana"]; !got.Equal(tt.want) {
+				t.Errorf("mute until %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimitsFlag(t *testing.T) {
+	rates := map[string]RateLimit{"search": {Rate: 0.5, Burst: 3}, "get_file": {Rate: 0.2, Burst: 10}}
+	f := rateLimitsFlag{&rates}
+	if err := f.Set("get_file=1/4, chat_message=2/8"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := f.String(), "chat_message=2/8,get_file=1/4,search=0.5/3"; got != want {
+		t.Errorf("after Set: %q, want %q", got, want)
+	}
+	for _, bad := range []string{"search", "search=1", "search=x/3", "search=1/y"} {
+		if err := f.Set(bad); err == nil {
+			t.Errorf("Set(%q) succeeded, want an error", bad)
+		}
+	}
+}
+
+func ptr[T any](v T) *T { return &v }
+
+func TestRateLimitedGetFile(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Limits.Flood.Rates = map[string]RateLimit{"get_file": {Rate: 0.2, Burst: 1}, "search": {Rate: 0.2, Burst: 1}}
+	hub := newTestHub(t, cfg)
+	c := newTestClient(hub, "ana")
+	tests := []struct {
+		name      string
+		msg       InboundMessage
+		wantReply bool
+	}{
+		{name: "get_file", msg: InboundMessage{Type: "get_file", Payload: json.RawMessage(`{"fileName":"a.txt","peer":"bob","offset":10}`)}, wantReply: true},
+		{name: "other types", msg: InboundMessage{Type: "search", Payload: json.RawMessage(`{"query":"a"}`)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !c.allowMessage(tt.msg.Type) {
+				t.Fatal("first message dropped")
+			}
+			if c.allowMessage(tt.msg.Type) {
+				t.Fatal("second message allowed")
+			}
+			c.rateLimited(tt.msg)
+			msgs := sent(t, c)
+			if !tt.wantReply {
+				if len(msgs) != 0 {
+					t.Errorf("got %+v, want no reply", msgs)
+				}
+				return
+			}
+			if len(msgs) != 1 || msgs[0].Type != "transfer_error" {
+				t.Fatalf("got %+v, want one transfer_error", msgs)
+			}
+			var p TransferErrorPayload
+			data, _ := json.Marshal(msgs[0].Payload)
+			json.Unmarshal(data, &p)
+			if p.TransferID != "" || p.FileName != "a.txt" || p.Peer != "bob" || p.RetryAfter != 5 {
+				t.Errorf("transfer_error = %+v, want a.txt from bob, retry after 5s", p)
+			}
+		})
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// lobbyRoom is the room every client joins on connect. It always exists.
+const lobbyRoom = "lobby"
+
+const (
+	maxRoomNameLen  = 32
+	maxRoomTopicLen = 120
+)
+
+// Room is a named chat room. Members are keyed by nickname.
+type Room struct {
+	Name    string
+	Topic   string
+	members map[string]*ChatClient
+}
+
+// normalizeRoomName lowercases a room name and strips a leading '#'.
+// It returns an error if the name is empty, too long or has characters
+// other than letters, digits, '-' and '_'.
+func normalizeRoomName(name string) (string, error) {
+	name = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(name), "#"))
+	if name == "" {
+		return "", fmt.Errorf("room name missing")
+	}
+	if len(name) > maxRoomNameLen {
+		return "", fmt.Errorf("room name longer than %d characters", maxRoomNameLen)
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return "", fmt.Errorf("room names may only contain letters, digits, '-' and '_'")
+		}
+	}
+	return name, nil
+}
+
+// roomInfo summarizes a room. Caller must hold hub.mu.
+func (r *Room) info() RoomInfo {
+	return RoomInfo{Name: r.Name, Topic: r.Topic, Members: len(r.members)}
+}
+
+// memberNames lists the room's members, sorted. Caller must hold hub.mu.
+func (r *Room) memberNames() []string {
+	names := make([]string, 0, len(r.members))
+	for nick := range r.members {
+		names = append(names, nick)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// RoomList returns every room, sorted by name.
+func (hub *ChatHub) RoomList() []RoomInfo {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	rooms := make([]RoomInfo, 0, len(hub.rooms))
+	for _, r := range hub.rooms {
+		rooms = append(rooms, r.info())
+	}
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].Name < rooms[j].Name
+	})
+	return rooms
+}
+
+// broadcastRoom sends a message to every member of a room except from.
+func (hub *ChatHub) broadcastRoom(room, msgType string, payload interface{}, from string) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	r, ok := hub.rooms[room]
+	if !ok {
+		return
+	}
+
+	msg, err := json.Marshal(OutboundMessage{Type: msgType, Payload: payload})
+	if err != nil {
+		logChat.Error("Failed to marshal room message", "room", room, "type", msgType, "err", err)
+		return
+	}
+
+	sender := ""
+	if chat, ok := payload.(ChatBroadcastPayload); ok {
+		sender = chat.Nickname
+	}
+	for nick, client := range r.members {
+		if nick == from || client.ignoring[sender] {
+			continue
+		}
+		client.deliverChat(msg)
+	}
+}
+
+// inRoom reports whether the client is a member of room.
+func (hub *ChatHub) inRoom(room string, c *ChatClient) bool {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	r, ok := hub.rooms[room]
+	return ok && r.members[c.nickname] == c
+}
+
+// joinRoom adds the client to a room, creating it if needed, and announces
+// the arrival to the other members.
+func (c *ChatClient) joinRoom(name string) {
+	room, err := normalizeRoomName(name)
+	if err != nil {
+		c.sendSystem("Cannot join room: " + err.Error())
+		return
+	}
+
+	c.hub.mu.Lock()
+	r, ok := c.hub.rooms[room]
+	if !ok {
+		r = &Room{Name: room, members: make(map[string]*ChatClient)}
+		c.hub.rooms[room] = r
+		c.log.Info("Created room", "room", room)
+	}
+	_, already := r.members[c.nickname]
+	r.members[c.nickname] = c
+	joined := RoomJoinedPayload{Room: r.Name, Topic: r.Topic, Members: r.memberNames()}
+	c.hub.mu.Unlock()
+
+	c.send("room_joined", joined)
+	c.sendHistory(room, time.Now(), historyBacklog)
+	if !already {
+		joinMsg := c.hub.newChatPayload(time.Now(), room, "", fmt.Sprintf("%s joined #%s.", c.nickname, room), true)
+		c.hub.broadcastRoom(room, "system_broadcast", joinMsg, c.nickname)
+	}
+}
+
+// partRoom removes the client from a room. Empty rooms other than the
+// lobby are deleted.
+func (c *ChatClient) partRoom(name string) {
+	room, err := normalizeRoomName(name)
+	if err != nil {
+		c.sendSystem("Cannot leave room: " + err.Error())
+		return
+	}
+	if room == lobbyRoom {
+		c.sendSystem("You cannot leave the lobby.")
+		return
+	}
+	if !c.hub.leaveRoom(room, c) {
+		c.sendSystem(fmt.Sprintf("You are not in #%s.", room))
+		return
+	}
+	c.send("room_parted", RoomPartedPayload{Room: room})
+}
+
+// leaveRoom takes the client out of room and tells the remaining members.
+// It reports whether the client was a member.
+func (hub *ChatHub) leaveRoom(room string, c *ChatClient) bool {
+	hub.mu.Lock()
+	r, ok := hub.rooms[room]
+	if !ok || r.members[c.nickname] != c {
+		hub.mu.Unlock()
+		return false
+	}
+	delete(r.members, c.nickname)
+	if len(r.members) == 0 && room != lobbyRoom {
+		delete(hub.rooms, room)
+		logChat.Info("Room closed", "room", room)
+	}
+	hub.mu.Unlock()
+
+	leaveMsg := hub.newChatPayload(time.Now(), room, "", fmt.Sprintf("%s left #%s.", c.nickname, room), true)
+	hub.broadcastRoom(room, "system_broadcast", leaveMsg, "")
+	return true
+}
+
+// leaveAllRooms removes the client from every room it is in, on disconnect.
+func (hub *ChatHub) leaveAllRooms(c *ChatClient) {
+	hub.mu.Lock()
+	var rooms []string
+	for name, r := range hub.rooms {
+		if r.members[c.nickname] == c {
+			rooms = append(rooms, name)
+		}
+	}
+	hub.mu.Unlock()
+	for _, room := range rooms {
+		if room == lobbyRoom {
+			// The lobby hears the global "left the chat" notice instead
+			hub.mu.Lock()
+			if hub.rooms[lobbyRoom].members[c.nickname] == c {
+				delete(hub.rooms[lobbyRoom].members, c.nickname)
+			}
+			hub.mu.Unlock()
+			continue
+		}
+		hub.leaveRoom(room, c)
+	}
+}
+
+// setTopic changes a room's topic and tells its members.
+func (c *ChatClient) setTopic(name, topic string) {
+	room, err := normalizeRoomName(name)
+	if err != nil {
+		c.sendSystem("Cannot set topic: " + err.Error())
+		return
+	}
+	if !c.hub.inRoom(room, c) {
+		c.sendSystem(fmt.Sprintf("You are not in #%s.", room))
+		return
+	}
+	topic = strings.TrimSpace(topic)
+	if utf8.RuneCountInString(topic) > maxRoomTopicLen {
+		topic = string([]rune(topic)[:maxRoomTopicLen])
+	}
+
+	c.hub.mu.Lock()
+	if r, ok := c.hub.rooms[room]; ok {
+		r.Topic = topic
+	}
+	c.hub.mu.Unlock()
+
+	c.hub.broadcastRoom(room, "room_topic", RoomTopicPayload{Room: room, Topic: topic, SetBy: c.nickname}, "")
+}
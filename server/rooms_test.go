@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeRoomName(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "general", want: "general"},
+		{in: "#General", want: "general"},
+		{in: "  #dev-ops_2 ", want: "dev-ops_2"},
+		{in: "LOBBY", want: "lobby"},
+		{in: strings.Repeat("a", maxRoomNameLen), want: strings.Repeat("a", maxRoomNameLen)},
+		{in: "", wantErr: true},
+		{in: "#", wantErr: true},
+		{in: "   ", wantErr: true},
+		{in: strings.Repeat("a", maxRoomNameLen+1), wantErr: true},
+		{in: "two words", wantErr: true},
+		{in: "dev/ops", wantErr: true},
+		{in: "##general", wantErr: true},
+		{in: "café", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := normalizeRoomName(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("normalizeRoomName(%q) = %q, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("normalizeRoomName(%q) = %q, %v; want %q", tt.in, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// DuplicatePolicy decides what happens when a nickname that is already
+// online logs in again, usually a client reconnecting before the relay has
+// noticed its old connection is dead.
+type DuplicatePolicy string
+
+const (
+	// duplicateReplace closes the old session and lets the new one in.
+	duplicateReplace DuplicatePolicy = "replace"
+	// duplicateReject turns the new session away while the old one lives.
+	duplicateReject DuplicatePolicy = "reject"
+)
+
+// ParseDuplicatePolicy checks a -duplicate-login flag value.
+func ParseDuplicatePolicy(s string) (DuplicatePolicy, error) {
+	switch p := DuplicatePolicy(s); p {
+	case duplicateReplace, duplicateReject:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown duplicate login policy %q (want %q or %q)", s, duplicateReplace, duplicateReject)
+}
+
+// isCurrent reports whether c is still the live session for its nickname.
+// Call with hub.mu held.
+func (hub *ChatHub) isCurrent(c *ChatClient) bool {
+	cur, ok := hub.clients[c.nickname]
+	return ok && cur.session == c.session
+}
+
+// part removes c from the client list unless a newer session for the same
+// nickname has taken its place. It reports whether c was the live session.
+func (hub *ChatHub) part(c *ChatClient) bool {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if !hub.isCurrent(c) {
+		return false
+	}
+	delete(hub.clients, c.nickname)
+	return true
+}
+
+// supersede closes a session that a new login for the same nickname has
+// replaced. Its cleanup leaves the new session's state alone.
+func (c *ChatClient) supersede(by *ChatClient) {
+	c.sendSystem("You logged in from another session; this one is closing.")
+	time.AfterFunc(200*time.Millisecond, func() {
+		// Both sessions may share one SSH connection
+		if c.conn != nil && c.conn != by.conn {
+			c.conn.Close()
+		}
+		c.Close()
+	})
+}
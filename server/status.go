@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"os"
 	"time"
+	"unicode/utf8"
 )
 
 // ServerStatus contains health and network info for the web status page.
@@ -20,6 +21,25 @@ type ServerStatus struct {
 	TransfersInFlight int      `json:"transfers_in_flight"`
 	TotalTransfers    int      `json:"total_transfers"`
 	RelayServers      int      `json:"relay_servers"`
+
+	Presence   []UserPresence    `json:"presence"`
+	RateLimits RateLimitSnapshot `json:"rate_limits"`
+	Delivery   DeliverySnapshot  `json:"delivery"`
+}
+
+// DeliverySnapshot reports messages the relay could not deliver.
+type DeliverySnapshot struct {
+	ChatDropped        int64 `json:"chat_dropped"`
+	ControlTimeouts    int64 `json:"control_timeouts"`
+	SlowDisconnections int64 `json:"slow_disconnections"`
+}
+
+// UserPresence is one row of the status page's user list.
+type UserPresence struct {
+	Nickname string `json:"nickname"`
+	Status   string `json:"status"`
+	Message  string `json:"message,omitempty"`
+	Idle     bool   `json:"idle"`
 }
 
 // StatusService serves the status page.
@@ -31,7 +51,8 @@ type StatusService struct {
 }
 
 func NewStatusService(hub *ChatHub, listenOn string) *StatusService {
-	tmpl := template.Must(template.New("status").Parse(statusPageHTML))
+	funcs := template.FuncMap{"statusLabel": statusLabel, "initial": initial}
+	tmpl := template.Must(template.New("status").Funcs(funcs).Parse(statusPageHTML))
 	return &StatusService{
 		Hub:       hub,
 		StartedAt: time.Now(),
@@ -40,50 +61,50 @@ func NewStatusService(hub *ChatHub, listenOn string) *StatusService {
 	}
 }
 
+// initial is the first letter of a nickname, for its avatar.
+func initial(nick string) string {
+	r, _ := utf8.DecodeRuneInString(nick)
+	if r == utf8.RuneError {
+		return ""
+	}
+	return string(r)
+}
+
 func (s *StatusService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path == "/api/status" {
 		s.apiStatus(w, r)
 		return
 	}
-	hostname, _ := os.Hostname()
-	users := []string{}
-	filesShared := 0
-	s.Hub.mu.Lock()
-	for nick := range s.Hub.clients {
-		users = append(users, nick)
-	}
-	for _, files := range s.Hub.fileRegistry.files {
-		filesShared += len(files)
-	}
-	transfers := len(s.Hub.transfers)
-	totalTransfers := s.Hub.totalTransfers // Add this field to ChatHub struct
-	s.Hub.mu.Unlock()
-
-	status := ServerStatus{
-		Hostname:          hostname,
-		Addr:              s.ListenOn,
-		StartTime:         s.StartedAt.Format(time.RFC3339),
-		UptimeSeconds:     int64(time.Since(s.StartedAt).Seconds()),
-		TotalUsers:        len(users),
-		Users:             users,
-		FilesShared:       filesShared,
-		TransfersInFlight: transfers,
-		TotalTransfers:    totalTransfers,
-		RelayServers:      1, // if you add multi-server later you can make this dynamic
-	}
+	status := s.collect()
 
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	_ = s.tmpl.Execute(w, status)
 }
 
 func (s *StatusService) apiStatus(w http.ResponseWriter, r *http.Request) {
+	status := s.collect()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// collect snapshots the hub for both the HTML page and the JSON API.
+// Invisible users are left out.
+func (s *StatusService) collect() ServerStatus {
 	hostname, _ := os.Hostname()
 	users := []string{}
+	presence := []UserPresence{}
+	for _, p := range s.Hub.PresenceList("") {
+		users = append(users, p.Nickname)
+		presence = append(presence, UserPresence{
+			Nickname: p.Nickname,
+			Status:   p.Status,
+			Message:  p.StatusMessage,
+			Idle:     p.Idle,
+		})
+	}
 	filesShared := 0
 	s.Hub.mu.Lock()
-	for nick := range s.Hub.clients {
-		users = append(users, nick)
-	}
 	for _, files := range s.Hub.fileRegistry.files {
 		filesShared += len(files)
 	}
@@ -91,7 +112,7 @@ func (s *StatusService) apiStatus(w http.ResponseWriter, r *http.Request) {
 	totalTransfers := s.Hub.totalTransfers
 	s.Hub.mu.Unlock()
 
-	status := ServerStatus{
+	return ServerStatus{
 		Hostname:          hostname,
 		Addr:              s.ListenOn,
 		StartTime:         s.StartedAt.Format(time.RFC3339),
@@ -101,11 +122,15 @@ func (s *StatusService) apiStatus(w http.ResponseWriter, r *http.Request) {
 		FilesShared:       filesShared,
 		TransfersInFlight: transfers,
 		TotalTransfers:    totalTransfers,
-		RelayServers:      1,
+		RelayServers:      1, // if you add multi-server later you can make this dynamic
+		Presence:          presence,
+		RateLimits:        s.Hub.rateStats.Snapshot(),
+		Delivery: DeliverySnapshot{
+			ChatDropped:        s.Hub.deliveryStats.ChatDropped.Load(),
+			ControlTimeouts:    s.Hub.deliveryStats.ControlTimeouts.Load(),
+			SlowDisconnections: s.Hub.deliveryStats.SlowDisconnections.Load(),
+		},
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(status)
 }
 
 const statusPageHTML = `
@@ -241,6 +266,11 @@ const statusPageHTML = `
     color: #ffe7ff;
     gap: 14px;
   }
+  .usermessage {
+    color: #caa9ec;
+    font-size: 0.96rem;
+    font-style: italic;
+  }
   .useritem:last-child {
     border-bottom: none;
   }
@@ -267,6 +297,9 @@ const statusPageHTML = `
     font-weight: 600;
     letter-spacing: 1px;
   }
+  .userstatus.away { background: #d98b1c; }
+  .userstatus.busy { background: #d1364f; }
+  .userstatus.idle { background: #5c5476; }
   .footer {
     text-align: right;
     color: #9787b8;
@@ -335,14 +368,26 @@ const statusPageHTML = `
         <span class="count">{{.TotalTransfers}}</span>
         <span class="desc">Total Transfers</span>
       </div>
+      <div class="stat">
+        <span class="icon material-icons-outlined">speed</span>
+        <span class="count">{{.RateLimits.TotalDropped}}</span>
+        <span class="desc">Messages Throttled</span>
+      </div>
     </div>
     <div class="section-title users-section">Users on the Network</div>
     <ul class="userlist">
-      {{- range .Users }}
+      {{- range .Presence }}
       <li class="useritem">
-        <span class="useravatar">{{ index . 0 }}</span>
-        <span>{{ . }}</span>
-        <span class="userstatus">Online</span>
+        <span class="useravatar">{{ initial .Nickname }}</span>
+        <span>{{ .Nickname }}</span>
+        {{- if .Message }}
+        <span class="usermessage">{{ .Message }}</span>
+        {{- end }}
+        {{- if and .Idle (eq .Status "online") }}
+        <span class="userstatus idle">Idle</span>
+        {{- else }}
+        <span class="userstatus {{ .Status }}">{{ statusLabel .Status }}</span>
+        {{- end }}
       </li>
       {{- end }}
     </ul>
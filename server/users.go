@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// UserRecord is everything the relay keeps about a registered nickname.
+type UserRecord struct {
+	Nickname   string      `json:"nickname"`
+	Keys       []StoredKey `json:"keys"`
+	Roles      []string    `json:"roles,omitempty"`
+	Registered time.Time   `json:"registered"`
+	LastSeen   time.Time   `json:"lastSeen,omitempty"`
+}
+
+// StoredKey is a public key allowed to log in as a nickname.
+type StoredKey struct {
+	Key   string    `json:"key"` // base64 of the SSH wire format
+	Added time.Time `json:"added"`
+}
+
+// HasRole reports whether the record carries role.
+func (r UserRecord) HasRole(role string) bool {
+	for _, have := range r.Roles {
+		if have == role {
+			return true
+		}
+	}
+	return false
+}
+
+// UserStore persists user records. Implementations must apply each Update
+// atomically and durably, so a crash leaves either the old record or the
+// new one.
+type UserStore interface {
+	// Get returns the record for nick, and whether there is one.
+	Get(nick string) (UserRecord, bool, error)
+	// Update loads nick's record (empty if missing), passes it to fn and
+	// stores the result, all in one transaction. If fn returns an error
+	// nothing is written.
+	Update(nick string, fn func(rec *UserRecord, exists bool) error) error
+	// Lookalike returns the registered nickname that nick could be
+	// mistaken for (same nickSkeleton), if there is one other than nick.
+	Lookalike(nick string) (string, bool, error)
+	Close() error
+}
+
+// userStoreBackends opens a UserStore by backend name. legacyNickDB is the
+// old nickname file, imported while bringing a new store up to date.
+var userStoreBackends = map[string]func(path, legacyNickDB string) (UserStore, error){
+	"bolt": OpenBoltUserStore,
+}
+
+// OpenUserStore opens the store at path with the named backend.
+func OpenUserStore(backend, path, legacyNickDB string) (UserStore, error) {
+	open, ok := userStoreBackends[backend]
+	if !ok {
+		return nil, fmt.Errorf("unknown user store backend %q", backend)
+	}
+	return open(path, legacyNickDB)
+}
+
+// errUnchanged tells Update there is nothing to write.
+var errUnchanged = errors.New("unchanged")
+
+// Users is the account logic on top of a UserStore. The first key to use a
+// nickname registers it, if the NickPolicy allows; more keys can be added
+// from a logged-in session (see accounts.go).
+type Users struct {
+	store  UserStore
+	policy atomic.Pointer[NickPolicy] // replaced on reload
+}
+
+func NewUsers(store UserStore, policy *NickPolicy) *Users {
+	u := &Users{store: store}
+	u.policy.Store(policy)
+	return u
+}
+
+// SetPolicy switches to a new nickname policy.
+func (u *Users) SetPolicy(policy *NickPolicy) {
+	u.policy.Store(policy)
+}
+
+// update is store.Update, treating errUnchanged as success.
+func (u *Users) update(nick string, fn func(rec *UserRecord, exists bool) error) error {
+	err := u.store.Update(nick, fn)
+	if errors.Is(err, errUnchanged) {
+		return nil
+	}
+	return err
+}
+
+// Lookup returns nick's record. Store errors are logged and reported as
+// not found.
+func (u *Users) Lookup(nick string) (UserRecord, bool) {
+	rec, ok, err := u.store.Get(nick)
+	if err != nil {
+		logStore.Error("Failed to read user", "nick", nick, "err", err)
+		return UserRecord{}, false
+	}
+	return rec, ok
+}
+
+// Has reports whether a nickname has ever been registered.
+func (u *Users) Has(nick string) bool {
+	_, ok := u.Lookup(nick)
+	return ok
+}
+
+// Keys returns the stored keys for a nickname, oldest first.
+func (u *Users) Keys(nick string) []string {
+	rec, _ := u.Lookup(nick)
+	keys := make([]string, 0, len(rec.Keys))
+	for _, k := range rec.Keys {
+		keys = append(keys, k.Key)
+	}
+	return keys
+}
+
+// Authorize reports whether pubkey is on nick's account (registered) or
+// nick is free for it to claim (not registered). Refusals the user should
+// see are *NickError.
+func (u *Users) Authorize(nick string, pubkey ssh.PublicKey) (registered bool, err error) {
+	rec, ok, err := u.store.Get(nick)
+	if err != nil {
+		return false, err
+	}
+	if ok {
+		if rec.keyIndex(encodeKey(pubkey)) < 0 {
+			return false, errNickTaken(nick)
+		}
+		return true, nil
+	}
+	return false, u.claimable(nick)
+}
+
+// claimable checks a new nickname against the policy and the registered
+// ones it could be mistaken for.
+func (u *Users) claimable(nick string) error {
+	if err := u.policy.Load().Check(nick); err != nil {
+		return err
+	}
+	if owner, found, err := u.store.Lookalike(nick); err != nil {
+		return err
+	} else if found {
+		return &NickError{Nick: nick, Reason: fmt.Sprintf("The nickname %q is too similar to %q, which is already registered.", nick, owner)}
+	}
+	return nil
+}
+
+// Register lets pubkey log in as nick, claiming the nickname if it is new.
+// Logging in with a known key only reads the store. Refusals the user
+// should see are *NickError.
+func (u *Users) Register(nick string, pubkey ssh.PublicKey) error {
+	keyStr := encodeKey(pubkey)
+	registered, err := u.Authorize(nick, pubkey)
+	if err != nil || registered {
+		return err
+	}
+	return u.update(nick, func(rec *UserRecord, exists bool) error {
+		if exists {
+			// Claimed by someone else in the meantime
+			if rec.keyIndex(keyStr) < 0 {
+				return errNickTaken(nick)
+			}
+			return errUnchanged
+		}
+		now := time.Now().UTC()
+		*rec = UserRecord{Nickname: nick, Keys: []StoredKey{{Key: keyStr, Added: now}}, Registered: now}
+		return nil
+	})
+}
+
+// Certify makes sure a nickname vouched for by a certificate authority
+// has a record, registering it without keys if it is new.
+func (u *Users) Certify(nick string) error {
+	if _, ok, err := u.store.Get(nick); err != nil || ok {
+		return err
+	}
+	if err := u.claimable(nick); err != nil {
+		return err
+	}
+	return u.update(nick, func(rec *UserRecord, exists bool) error {
+		if exists {
+			return errUnchanged
+		}
+		*rec = UserRecord{Nickname: nick, Registered: time.Now().UTC()}
+		return nil
+	})
+}
+
+func errNickTaken(nick string) error {
+	return &NickError{Nick: nick, Reason: fmt.Sprintf("The nickname %q is registered with a different key.", nick)}
+}
+
+// AddKey authorizes another key for a registered nickname.
+func (u *Users) AddKey(nick string, pubkey ssh.PublicKey) error {
+	keyStr := encodeKey(pubkey)
+	return u.update(nick, func(rec *UserRecord, exists bool) error {
+		if !exists {
+			return fmt.Errorf("%s is not registered", nick)
+		}
+		if rec.keyIndex(keyStr) >= 0 {
+			return errors.New("that key is already on the account")
+		}
+		rec.Keys = append(rec.Keys, StoredKey{Key: keyStr, Added: time.Now().UTC()})
+		return nil
+	})
+}
+
+// RemoveKey revokes the key with the given fingerprint. The last key cannot
+// be removed, or nobody could log in as nick again.
+func (u *Users) RemoveKey(nick, fingerprint string) error {
+	return u.update(nick, func(rec *UserRecord, exists bool) error {
+		for i, k := range rec.Keys {
+			if fingerprintFromStored(k.Key) != fingerprint {
+				continue
+			}
+			if len(rec.Keys) == 1 {
+				return errors.New("cannot remove the only key on the account")
+			}
+			rec.Keys = append(rec.Keys[:i:i], rec.Keys[i+1:]...)
+			return nil
+		}
+		return fmt.Errorf("no key %s on the account", fingerprint)
+	})
+}
+
+// ResetKeys replaces every key of a registered nickname with pubkey.
+func (u *Users) ResetKeys(nick string, pubkey ssh.PublicKey) error {
+	return u.update(nick, func(rec *UserRecord, exists bool) error {
+		if !exists {
+			return fmt.Errorf("%s is not registered", nick)
+		}
+		rec.Keys = []StoredKey{{Key: encodeKey(pubkey), Added: time.Now().UTC()}}
+		return nil
+	})
+}
+
+// Seen records that nick was online just now.
+func (u *Users) Seen(nick string) {
+	err := u.update(nick, func(rec *UserRecord, exists bool) error {
+		if !exists {
+			return errUnchanged
+		}
+		rec.LastSeen = time.Now().UTC()
+		return nil
+	})
+	if err != nil {
+		logStore.Error("Failed to update last seen", "nick", nick, "err", err)
+	}
+}
+
+func (r UserRecord) keyIndex(keyStr string) int {
+	for i, k := range r.Keys {
+		if k.Key == keyStr {
+			return i
+		}
+	}
+	return -1
+}
+
+// encodeKey is how keys are stored: base64 of the wire format.
+func encodeKey(pubkey ssh.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(pubkey.Marshal())
+}
+
+// readLegacyNickDB reads the old nicks.db text file, lines of
+// "nickname key [key...]". A nickname listed twice keeps its last line.
+// Registration times are unknown, so the file's modification time stands
+// in. A missing file has no users.
+func readLegacyNickDB(path string) ([]UserRecord, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	since := info.ModTime().UTC()
+	var recs []UserRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		parts := strings.Fields(scanner.Text())
+		if len(parts) < 2 {
+			continue
+		}
+		rec := UserRecord{Nickname: parts[0], Registered: since}
+		for _, k := range parts[1:] {
+			rec.Keys = append(rec.Keys, StoredKey{Key: k, Added: since})
+		}
+		recs = append(recs, rec)
+	}
+	return recs, scanner.Err()
+}
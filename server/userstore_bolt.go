@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	usersBucket     = []byte("users")
+	skeletonsBucket = []byte("skeletons")
+	metaBucket      = []byte("meta")
+	versionKey      = []byte("version")
+)
+
+// boltMigration moves the schema up one version inside tx. All pending
+// migrations and the new version number commit together, or none do.
+type boltMigration func(tx *bolt.Tx, m *migrationState) error
+
+// migrationState is what migrations need from outside the store, and what
+// they leave to do once their transaction has committed.
+type migrationState struct {
+	legacyNickDB string
+	imported     int // users read from legacyNickDB
+}
+
+// boltMigrations bring a store up to date. Entry i moves the schema from
+// version i to i+1; append to add one, never edit or reorder.
+var boltMigrations = []boltMigration{
+	// 0 -> 1: one JSON UserRecord per nickname
+	func(tx *bolt.Tx, _ *migrationState) error {
+		_, err := tx.CreateBucketIfNotExists(usersBucket)
+		return err
+	},
+	// 1 -> 2: index nicknames by skeleton (see nickSkeleton). Existing
+	// lookalikes keep their accounts; the first one in key order owns the
+	// skeleton.
+	func(tx *bolt.Tx, _ *migrationState) error {
+		skeletons, err := tx.CreateBucketIfNotExists(skeletonsBucket)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(usersBucket).ForEach(func(nick, _ []byte) error {
+			return indexSkeleton(skeletons, string(nick))
+		})
+	},
+	// 2 -> 3: import the legacy nickname file, if there is one, into a
+	// store without users.
+	func(tx *bolt.Tx, m *migrationState) error {
+		recs, err := readLegacyNickDB(m.legacyNickDB)
+		if err != nil || len(recs) == 0 {
+			return err
+		}
+		b := tx.Bucket(usersBucket)
+		if n := b.Stats().KeyN; n > 0 {
+			logStore.Warn("Not importing legacy nickname file: the user store already has users", "path", m.legacyNickDB, "users", n)
+			return nil
+		}
+		skeletons := tx.Bucket(skeletonsBucket)
+		for _, rec := range recs {
+			data, err := json.Marshal(rec)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(rec.Nickname), data); err != nil {
+				return fmt.Errorf("import %s: %w", rec.Nickname, err)
+			}
+			if err := indexSkeleton(skeletons, rec.Nickname); err != nil {
+				return err
+			}
+		}
+		m.imported = len(recs)
+		return nil
+	},
+}
+
+// indexSkeleton records nick as the owner of its skeleton, unless another
+// nickname already is.
+func indexSkeleton(skeletons *bolt.Bucket, nick string) error {
+	sk := []byte(nickSkeleton(nick))
+	if skeletons.Get(sk) != nil {
+		return nil
+	}
+	return skeletons.Put(sk, []byte(nick))
+}
+
+// boltUserStore keeps users in a bbolt file. Every Update is its own
+// transaction and is synced to disk before it returns.
+type boltUserStore struct {
+	db *bolt.DB
+}
+
+// OpenBoltUserStore opens or creates the store at path and migrates it to
+// the current schema, importing legacyNickDB on the way. The file is
+// locked, so a second relay using it fails here instead of corrupting it.
+func OpenBoltUserStore(path, legacyNickDB string) (UserStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", path, err)
+	}
+	m := &migrationState{legacyNickDB: legacyNickDB}
+	err = db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+		var version uint64
+		if v := meta.Get(versionKey); v != nil {
+			version = binary.BigEndian.Uint64(v)
+		}
+		if version > uint64(len(boltMigrations)) {
+			return fmt.Errorf("schema version %d is newer than this relay understands", version)
+		}
+		for ; version < uint64(len(boltMigrations)); version++ {
+			if err := boltMigrations[version](tx, m); err != nil {
+				return fmt.Errorf("migrate to version %d: %w", version+1, err)
+			}
+		}
+		return meta.Put(versionKey, binary.BigEndian.AppendUint64(nil, version))
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if m.imported > 0 {
+		logStore.Info("Imported users from legacy nickname file", "path", legacyNickDB, "users", m.imported)
+		// The schema version already says it is done; renaming the file
+		// just makes that plain
+		if err := os.Rename(legacyNickDB, legacyNickDB+".migrated"); err != nil {
+			logStore.Warn("Could not rename imported legacy nickname file", "path", legacyNickDB, "err", err)
+		}
+	}
+	return &boltUserStore{db: db}, nil
+}
+
+func (s *boltUserStore) Get(nick string) (UserRecord, bool, error) {
+	var rec UserRecord
+	var found bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(usersBucket).Get([]byte(nick))
+		if data == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(data, &rec)
+	})
+	return rec, found, err
+}
+
+func (s *boltUserStore) Update(nick string, fn func(rec *UserRecord, exists bool) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(usersBucket)
+		var rec UserRecord
+		data := b.Get([]byte(nick))
+		if data != nil {
+			if err := json.Unmarshal(data, &rec); err != nil {
+				return fmt.Errorf("decode %s: %w", nick, err)
+			}
+		}
+		if err := fn(&rec, data != nil); err != nil {
+			return err
+		}
+		rec.Nickname = nick
+		if data == nil {
+			if err := indexSkeleton(tx.Bucket(skeletonsBucket), nick); err != nil {
+				return err
+			}
+		}
+		data, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(nick), data)
+	})
+}
+
+func (s *boltUserStore) Lookalike(nick string) (string, bool, error) {
+	var owner string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		owner = string(tx.Bucket(skeletonsBucket).Get([]byte(nickSkeleton(nick))))
+		return nil
+	})
+	return owner, owner != "" && owner != nick, err
+}
+
+func (s *boltUserStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// writeFile writes lines to dir/name and returns the path.
+func writeFile(t *testing.T, dir, name string, lines ...string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// boltState reads the schema version and nicknames of a closed store
+// straight from the file.
+func boltState(t *testing.T, path string) (version uint64, nicks []string) {
+	t.Helper()
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.View(func(tx *bolt.Tx) error {
+		if meta := tx.Bucket(metaBucket); meta != nil {
+			if v := meta.Get(versionKey); v != nil {
+				version = binary.BigEndian.Uint64(v)
+			}
+		}
+		if users := tx.Bucket(usersBucket); users != nil {
+			users.ForEach(func(k, _ []byte) error {
+				nicks = append(nicks, string(k))
+				return nil
+			})
+		}
+		return nil
+	})
+	return version, nicks
+}
+
+// makeBoltStore creates a store at schema version 2, before the legacy
+// import existed, holding nicks.
+func makeBoltStore(t *testing.T, path string, nicks ...string) {
+	t.Helper()
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, m := range boltMigrations[:2] {
+			if err := m(tx, &migrationState{}); err != nil {
+				return err
+			}
+		}
+		for _, nick := range nicks {
+			if err := tx.Bucket(usersBucket).Put([]byte(nick), []byte(`{"nickname":"`+nick+`"}`)); err != nil {
+				return err
+			}
+		}
+		meta, err := tx.CreateBucket(metaBucket)
+		if err != nil {
+			return err
+		}
+		return meta.Put(versionKey, binary.BigEndian.AppendUint64(nil, 2))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenBoltUserStore(t *testing.T) {
+	tests := []struct {
+		name          string
+		existing      []string // users already in a version 2 store; nil for a new store
+		legacy        []string // lines of nicks.db; nil for no file
+		wantNicks     []string
+		wantRenamed   bool
+		wantLookalike string // a nickname whose skeleton must be indexed
+	}{
+		{name: "new store"},
+		{
+			name:          "new store with legacy file",
+			legacy:        []string{"ana AAAA", "bob BBBB CCCC", "short", "ana DDDD"},
+			wantNicks:     []string{"ana", "bob"},
+			wantRenamed:   true,
+			wantLookalike: "b0b",
+		},
+		{
+			name:        "old store without users",
+			existing:    []string{},
+			legacy:      []string{"ana AAAA"},
+			wantNicks:   []string{"ana"},
+			wantRenamed: true,
+		},
+		{
+			name:      "old store with users",
+			existing:  []string{"cid"},
+			legacy:    []string{"ana AAAA"},
+			wantNicks: []string{"cid"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "users.db")
+			legacy := filepath.Join(dir, "nicks.db")
+			if tt.existing != nil {
+				makeBoltStore(t, path, tt.existing...)
+			}
+			if tt.legacy != nil {
+				writeFile(t, dir, "nicks.db", tt.legacy...)
+			}
+			store, err := OpenBoltUserStore(path, legacy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantLookalike != "" {
+				if _, found, err := store.Lookalike(tt.wantLookalike); err != nil || !found {
+					t.Errorf("Lookalike(%q) = %v, %v; want found", tt.wantLookalike, found, err)
+				}
+			}
+			store.Close()
+
+			version, nicks := boltState(t, path)
+			if version != uint64(len(boltMigrations)) {
+				t.Errorf("version = %d, want %d", version, len(boltMigrations))
+			}
+			sort.Strings(nicks)
+			if !reflect.DeepEqual(nicks, tt.wantNicks) {
+				t.Errorf("users = %v, want %v", nicks, tt.wantNicks)
+			}
+			_, err = os.Stat(legacy + ".migrated")
+			if renamed := err == nil; renamed != tt.wantRenamed {
+				t.Errorf("renamed = %v, want %v", renamed, tt.wantRenamed)
+			}
+		})
+	}
+}
+
+func TestOpenBoltUserStoreImportsOnce(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "users.db")
+	legacy := writeFile(t, dir, "nicks.db", "ana AAAA")
+	store, err := OpenBoltUserStore(path, legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	// A nicks.db that turns up again is left alone
+	writeFile(t, dir, "nicks.db", "bob BBBB")
+	store, err = OpenBoltUserStore(path, legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+	if _, nicks := boltState(t, path); !reflect.DeepEqual(nicks, []string{"ana"}) {
+		t.Errorf("users = %v, want [ana]", nicks)
+	}
+	if _, err := os.Stat(legacy); err != nil {
+		t.Errorf("second nicks.db: %v, want it kept", err)
+	}
+}
+
+func TestOpenBoltUserStoreFailedImport(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "users.db")
+	// bbolt refuses the third key, after two have gone in
+	tooLong := strings.Repeat("x", bolt.MaxKeySize+1)
+	legacy := writeFile(t, dir, "nicks.db", "ana AAAA", "bob BBBB", tooLong+" CCCC", "cid DDDD")
+	if _, err := OpenBoltUserStore(path, legacy); err == nil {
+		t.Fatal("OpenBoltUserStore succeeded with an unstorable nickname")
+	}
+	// Nothing of the upgrade or the import is left behind
+	if version, nicks := boltState(t, path); version != 0 || nicks != nil {
+		t.Errorf("after failure: version %d, users %v; want 0, none", version, nicks)
+	}
+	if _, err := os.Stat(legacy); err != nil {
+		t.Fatalf("nicks.db after failure: %v", err)
+	}
+
+	// Fixed, the next start imports everyone
+	writeFile(t, dir, "nicks.db", "ana AAAA", "bob BBBB", "cid DDDD")
+	store, err := OpenBoltUserStore(path, legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+	version, nicks := boltState(t, path)
+	if version != uint64(len(boltMigrations)) || !reflect.DeepEqual(nicks, []string{"ana", "bob", "cid"}) {
+		t.Errorf("after retry: version %d, users %v; want %d, [ana bob cid]", version, nicks, len(boltMigrations))
+	}
+}
+
+func TestReadLegacyNickDB(t *testing.T) {
+	dir := t.TempDir()
+	recs, err := readLegacyNickDB(filepath.Join(dir, "missing.db"))
+	if err != nil || recs != nil {
+		t.Errorf("missing file: %v, %v; want nothing", recs, err)
+	}
+
+	path := writeFile(t, dir, "nicks.db", "ana AAAA BBBB", "", "lonely", "  bob   CCCC  ")
+	recs, err = readLegacyNickDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, _ := os.Stat(path)
+	since := info.ModTime().UTC()
+	want := []UserRecord{
+		{Nickname: "ana", Keys: []StoredKey{{Key: "AAAA", Added: since}, {Key: "BBBB", Added: since}}, Registered: since},
+		{Nickname: "bob", Keys: []StoredKey{{Key: "CCCC", Added: since}}, Registered: since},
+	}
+	if !reflect.DeepEqual(recs, want) {
+		t.Errorf("readLegacyNickDB = %+v\nwant %+v", recs, want)
+	}
+}